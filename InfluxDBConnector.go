@@ -23,16 +23,29 @@ SOFTWARE.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	eiimsgbus "github.com/open-edge-insights/eii-messagebus-go/eiimsgbus"
 	common "influxdbconnector/common"
 	configManager "influxdbconnector/configmanager"
 	dbManager "influxdbconnector/dbmanager"
+	metrics "influxdbconnector/metrics"
 	pubManager "influxdbconnector/pubmanager"
 	subManager "influxdbconnector/submanager"
-	"strconv"
+	tracing "influxdbconnector/tracing"
 
 	"github.com/golang/glog"
 )
@@ -47,15 +60,73 @@ const (
 	maxSubTopics   = 50
 )
 
+// minInfluxStopTimeout lets influxd flush its cache when the shutdown
+// timeout is already spent on draining
+const minInfluxStopTimeout = time.Second
+
+// queryReceiveTimeout is how long in milliseconds the query service waits
+// for a request before checking whether it is stopped
+const queryReceiveTimeout = 1000
+
 // InfluxObj is an object for InfluxDB Manager
 var InfluxObj dbManager.InfluxDBManager
 
 var pubMgr pubManager.PubManager
+var subMgr subManager.SubManager
+var influxWrite dbManager.InfluxWriter
+var queryMgr *dbManager.InfluxQuery
+// queryStop stops the query service, which closes queryDone once it has
+// closed its message bus service
+var queryStop = make(chan struct{})
+var queryDone = make(chan struct{})
+// reloadMutex serializes the config reloads
+var reloadMutex sync.Mutex
 var credConfig common.DbCredential
 var runtimeInfo common.AppConfig
+var subTopics []string
+var backupMgr *dbManager.InfluxBackup
+var exportMgr *dbManager.InfluxExport
+var importMgr *dbManager.InfluxImport
+var diskMgr *dbManager.InfluxDiskMonitor
+
+// selfMgr writes the stats of the connector into InfluxDB
+var selfMgr *dbManager.SelfMonitor
+var monitoringServer *http.Server
 // CfgMgr is an object for ConfigManager
 var CfgMgr configManager.ConfigManager
 
+// configFile is the config.json to use instead of etcd
+var configFile = flag.String("config", os.Getenv("CONFIG_FILE"),
+	"Path of a config.json with the config and interfaces to run without etcd")
+
+// validateOnly makes the connector check the config and exit
+var validateOnly = flag.Bool("validate-config", false,
+	"Validate the config and interfaces, print the effective config and exit")
+
+// shutdownTimeout is the deadline of the graceful shutdown on SIGINT and
+// SIGTERM
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second,
+	"Deadline to write and publish the received data and stop influxd on SIGINT or SIGTERM")
+
+// healthCheck makes the binary probe a health endpoint of a running
+// connector, for the docker healthcheck
+var healthCheck = flag.String("health-check", "",
+	"URL of a health endpoint to probe, the exit status is 0 when it replies 200")
+
+// queryHealth is the health of the query service, stopped is set once it
+// has exited
+var queryHealth = struct {
+	sync.Mutex
+	status  common.ComponentStatus
+	stopped bool
+}{status: common.ComponentStatus{Name: "query_service", Status: common.StatusDown, Detail: "not started yet"}}
+
+// healthReport structure is the reply of the health endpoints
+type healthReport struct {
+	Status     string                   `json:"status"`
+	Components []common.ComponentStatus `json:"components"`
+}
+
 //Function to read the DB credential and container runtime info from the config file
 func readConfig() {
 	var errConfig error
@@ -73,22 +144,464 @@ func readConfig() {
 	}
 }
 
+// validateConfig will check the config and the interfaces without starting
+// anything, print the effective config and return the exit status
+func validateConfig() int {
+	effective, errs := CfgMgr.Check()
+	if effective.Config != nil {
+		config := effective.Config
+		errs = append(errs, dbManager.ValidateConfig(config.DbCredential(), config.InfluxdbServer,
+			config.Backup, config.Export, config.Import, config.DiskQuota, config.BlacklistQuery,
+			effective.DevMode)...)
+	}
+
+	out, err := json.MarshalIndent(effective, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print the effective config: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs.Error())
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "config is valid")
+	return 0
+}
+
 //StartDb Function to start Influx Database
 //Initialize the Influx database with the configurations
 func StartDb() {
 	InfluxObj.DbInfo = credConfig
 	InfluxObj.CnInfo = runtimeInfo
-	err := InfluxObj.Init()
+	serverConfig, err := CfgMgr.ReadInfluxServerConfig()
+	if err != nil {
+		glog.Errorf("StartDb: Failed to read the influxdb_server config : %v", err)
+		os.Exit(-1)
+	}
+	InfluxObj.Server = serverConfig
+	dataDirEmpty := InfluxObj.DataDirEmpty()
+	err = InfluxObj.Init()
 	if err != nil {
 		glog.Errorf("StartDb: Failed to initialize InfluxDB : %v", err)
 		os.Exit(-1)
 	}
 
+	if backupMgr != nil {
+		err = backupMgr.RestoreAtStartup(dataDirEmpty)
+		if err != nil {
+			glog.Errorf("StartDb: Failed to restore backup : %v", err)
+			os.Exit(-1)
+		}
+	}
+
 	err = InfluxObj.CreateDataBase(InfluxObj.DbInfo.Database, InfluxObj.DbInfo.Retention)
 	if err != nil {
 		glog.Errorf("StartDb: Failed to create database : %v", err)
 		os.Exit(-1)
 	}
+
+	err = InfluxObj.Reconcile()
+	if err != nil {
+		glog.Errorf("StartDb: Failed to reconcile InfluxDB configuration : %v", err)
+		os.Exit(-1)
+	}
+}
+
+// initBackup function to set up the backups and restores of InfluxDB when
+// the backup section is configured
+func initBackup() {
+	backupConfig, err := CfgMgr.ReadBackupConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the backup config : %v", err)
+		os.Exit(-1)
+	}
+	if backupConfig == nil {
+		return
+	}
+
+	backup := &dbManager.InfluxBackup{
+		DbInfo: credConfig,
+		CnInfo: runtimeInfo,
+		Config: *backupConfig,
+		// Re-create the database, continuous queries and subscription
+		// once a backup is restored
+		OnRestore: InfluxObj.Reinit,
+	}
+	err = backup.Init()
+	if err != nil {
+		glog.Errorf("Backups disabled : %v", err)
+		return
+	}
+	backupMgr = backup
+}
+
+// initExport function to set up the exports when the export section is
+// configured
+func initExport() {
+	exportConfig, err := CfgMgr.ReadExportConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the export config : %v", err)
+		os.Exit(-1)
+	}
+	if exportConfig == nil {
+		return
+	}
+
+	export := &dbManager.InfluxExport{
+		DbInfo: credConfig,
+		CnInfo: runtimeInfo,
+		Config: *exportConfig,
+	}
+	err = export.Init()
+	if err != nil {
+		glog.Errorf("Exports disabled : %v", err)
+		return
+	}
+	exportMgr = export
+}
+
+// StartImport function to import the files dropped in the import directory
+// when the import section is configured
+func StartImport() {
+	importConfig, err := CfgMgr.ReadImportConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the import config : %v", err)
+		os.Exit(-1)
+	}
+	if importConfig == nil {
+		return
+	}
+
+	influxdbConnectorConfig, err := CfgMgr.ReadInfluxDBConnectorConfig()
+	if err != nil {
+		glog.Error("Error in creating Ignore list")
+	}
+	importer := &dbManager.InfluxImport{
+		Config: *importConfig,
+		Writer: &dbManager.InfluxWriter{
+			DbInfo:  credConfig,
+			CnInfo:  runtimeInfo,
+			TagList: influxdbConnectorConfig["tagsList"],
+		},
+	}
+	if backupMgr != nil {
+		// Imported points are missed by the incremental backups
+		importer.OnImported = backupMgr.RequireFull
+	}
+	err = importer.Init()
+	if err != nil {
+		glog.Errorf("Imports disabled : %v", err)
+		return
+	}
+	importMgr = importer
+	go importMgr.Run()
+}
+
+// StartDiskMonitor will monitor the disk usage of influxd when the disk_quota
+// section is configured, the quota warnings are published through pubMgr
+func StartDiskMonitor() {
+	quotaConfig, err := CfgMgr.ReadDiskQuotaConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the disk quota config : %v", err)
+		os.Exit(-1)
+	}
+	if quotaConfig == nil {
+		return
+	}
+
+	monitor := &dbManager.InfluxDiskMonitor{
+		DbInfo: credConfig,
+		CnInfo: runtimeInfo,
+		Config: *quotaConfig,
+		Events: &pubMgr,
+	}
+	err = monitor.Init()
+	if err != nil {
+		glog.Errorf("Disk monitoring disabled : %v", err)
+		return
+	}
+	diskMgr = monitor
+	go diskMgr.Run()
+
+	metrics.NewGaugeFunc("influxdbconnector_disk_used_bytes",
+		"Size of the data and wal directories of influxd.", func() float64 {
+			return float64(diskMgr.Usage().TotalBytes)
+		})
+	metrics.NewGaugeFunc("influxdbconnector_disk_quota_bytes",
+		"Disk quota of the data and wal directories of influxd.", func() float64 {
+			return float64(diskMgr.Usage().QuotaBytes)
+		})
+}
+
+// StartTracing will export the traces to the collector when the tracing
+// section is configured
+func StartTracing() {
+	tracingConfig, err := CfgMgr.ReadTracingConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the tracing config : %v", err)
+		os.Exit(-1)
+	}
+	if tracingConfig == nil {
+		return
+	}
+
+	appName, err := CfgMgr.ConfigMgr.GetAppName()
+	if err != nil {
+		glog.Errorf("Error in reading the appname : %v", err)
+		os.Exit(-1)
+	}
+	sampleRatio := tracingConfig.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+	err = tracing.Init(tracingConfig.Endpoint, sampleRatio, appName)
+	if err != nil {
+		glog.Errorf("Tracing disabled : %v", err)
+	}
+}
+
+// StartSelfMonitor will write the stats of the connector into InfluxDB when
+// the self_monitoring section is configured
+func StartSelfMonitor() {
+	selfConfig, err := CfgMgr.ReadSelfMonitoringConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the self monitoring config : %v", err)
+		os.Exit(-1)
+	}
+	if selfConfig == nil {
+		return
+	}
+
+	monitor := &dbManager.SelfMonitor{
+		DbInfo: credConfig,
+		CnInfo: runtimeInfo,
+		Config: *selfConfig,
+		Queues: []common.QueueReporter{&InfluxObj, &subMgr},
+	}
+	err = monitor.Init()
+	if err != nil {
+		glog.Errorf("Self monitoring disabled : %v", err)
+		return
+	}
+	selfMgr = monitor
+	go selfMgr.Run()
+}
+
+// StartMonitoring function to serve the metrics over HTTP
+func StartMonitoring() {
+	monitoringConfig, err := CfgMgr.ReadMonitoringConfig()
+	if err != nil {
+		glog.Errorf("Error in reading the monitoring config : %v", err)
+		os.Exit(-1)
+	}
+	if monitoringConfig == nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		queryHealth.Lock()
+		report := healthReport{Status: common.StatusOK}
+		if queryHealth.stopped {
+			report.Status = common.StatusDown
+			report.Components = []common.ComponentStatus{queryHealth.status}
+		}
+		queryHealth.Unlock()
+		writeHealth(w, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		writeHealth(w, componentHealth())
+	})
+	monitoringServer = &http.Server{Addr: monitoringConfig.Address, Handler: mux}
+	go func() {
+		glog.Infof("Serving the metrics and health on %s", monitoringConfig.Address)
+		err := monitoringServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			glog.Errorf("Monitoring server failed : %v", err)
+		}
+	}()
+}
+
+// StartBackup function to run the scheduled backups
+func StartBackup() {
+	if backupMgr != nil {
+		go backupMgr.Run()
+	}
+}
+
+// watchConfig will reload the connector whenever the app config or the
+// interfaces change
+func watchConfig() {
+	err := CfgMgr.WatchConfig(reloadConfig)
+	if err != nil {
+		glog.Warningf("Config changes will not be applied until restart: %v", err)
+	}
+}
+
+// reloadConfig will apply the changed app config and interfaces without
+// restarting the connector, an invalid part is logged and ignored
+func reloadConfig() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	err := CfgMgr.Reload()
+	if err != nil {
+		glog.Errorf("Ignoring config change: %v", err)
+		return
+	}
+
+	if _, err = CfgMgr.Load(); err != nil {
+		// The validation errors are all logged by Load
+		glog.Errorf("Ignoring the invalid app config change")
+	} else {
+		reloadAppConfig()
+	}
+	reloadInterfaces()
+}
+
+// reloadAppConfig will apply the validated app config
+func reloadAppConfig() {
+	dbInfo, err := CfgMgr.ReadInfluxConfig()
+	if err == nil {
+		err = InfluxObj.ApplyConfig(dbInfo)
+	}
+	if err != nil {
+		glog.Errorf("Failed to apply config change: %v", err)
+	}
+
+	influxdbConnectorConfig, err := CfgMgr.ReadInfluxDBConnectorConfig()
+	if err == nil {
+		influxWrite.SetKeys(influxdbConnectorConfig["ignoreList"], influxdbConnectorConfig["tagsList"])
+		if importMgr != nil {
+			importMgr.Writer.SetKeys(nil, influxdbConnectorConfig["tagsList"])
+		}
+	}
+
+	influxdbQueryconfig, err := CfgMgr.ReadInfluxDBQueryConfig()
+	if err == nil && queryMgr != nil {
+		err = queryMgr.SetQueryList(influxdbQueryconfig)
+	}
+	if err != nil {
+		glog.Errorf("Ignoring invalid blacklist_query: %v", err)
+	}
+
+	cInfo, err := CfgMgr.ReadContainerInfo()
+	if err != nil {
+		glog.Errorf("Ignoring sub_workers and pub_workers: %v", err)
+		return
+	}
+	if cInfo.SubWorker != runtimeInfo.SubWorker {
+		glog.Infof("Resizing the subscriber workers to %d", cInfo.SubWorker)
+		subMgr.SetWorkers(int(cInfo.SubWorker))
+	}
+	if cInfo.PubWorker != runtimeInfo.PubWorker {
+		glog.Infof("Resizing the publisher workers to %d", cInfo.PubWorker)
+		InfluxObj.SetPubWorkers(int(cInfo.PubWorker))
+	}
+	runtimeInfo.SubWorker = cInfo.SubWorker
+	runtimeInfo.PubWorker = cInfo.PubWorker
+}
+
+// reloadInterfaces will add the new publishers and subscribers, remove the
+// deleted ones and re-create the ones whose message bus config changed
+func reloadInterfaces() {
+	publishers, err := readInterfaceTopics(true)
+	if err != nil {
+		glog.Errorf("Ignoring invalid publisher interfaces: %v", err)
+	} else if len(publishers) > maxTopics {
+		glog.Errorf("Ignoring publisher interfaces, Max Topics Exceeded %d", len(publishers))
+	} else {
+		current := pubMgr.Topics()
+		for topic, config := range current {
+			if newConfig, ok := publishers[topic]; !ok || !reflect.DeepEqual(newConfig, config) {
+				pubMgr.RemovePublisher(topic)
+			}
+		}
+		for topic, config := range publishers {
+			if oldConfig, ok := current[topic]; !ok || !reflect.DeepEqual(oldConfig, config) {
+				if err := pubMgr.AddPublisher(topic, config); err != nil {
+					glog.Errorf("Failed to add publisher %s: %v", topic, err)
+				}
+			}
+		}
+	}
+
+	subscribers, err := readInterfaceTopics(false)
+	if err != nil {
+		glog.Errorf("Ignoring invalid subscriber interfaces: %v", err)
+		return
+	}
+	if len(subscribers) > maxSubTopics {
+		glog.Errorf("Ignoring subscriber interfaces, Max SubTopics Exceeded %d", len(subscribers))
+		return
+	}
+	current := subMgr.Topics()
+	for topic, config := range current {
+		if newConfig, ok := subscribers[topic]; !ok || !reflect.DeepEqual(newConfig, config) {
+			subMgr.RemoveSubscriber(topic)
+		}
+	}
+	for topic, config := range subscribers {
+		if oldConfig, ok := current[topic]; !ok || !reflect.DeepEqual(oldConfig, config) {
+			if err := subMgr.AddSubscriber(topic, config); err != nil {
+				glog.Errorf("Failed to add subscriber %s: %v", topic, err)
+			}
+		}
+	}
+
+	topics := []string{}
+	for topic := range subMgr.Topics() {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	subTopics = topics
+	if queryMgr != nil {
+		queryMgr.SetSubTopics(subTopics)
+	}
+}
+
+// readInterfaceTopics will read the message bus config of the publishers or
+// subscribers by topic
+func readInterfaceTopics(publishers bool) (map[string]map[string]interface{}, error) {
+	var count int
+	var err error
+	if publishers {
+		count, err = CfgMgr.ConfigMgr.GetNumPublishers()
+	} else {
+		count, err = CfgMgr.ConfigMgr.GetNumSubscribers()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]map[string]interface{})
+	for index := 0; index < count; index++ {
+		var ctx configManager.TopicConfig
+		if publishers {
+			ctx, err = CfgMgr.ConfigMgr.GetPublisherByIndex(index)
+		} else {
+			ctx, err = CfgMgr.ConfigMgr.GetSubscriberByIndex(index)
+		}
+		if err != nil {
+			return nil, err
+		}
+		names, err := ctx.GetTopics()
+		if err != nil || len(names) == 0 {
+			ctx.Destroy()
+			return nil, errors.New("failed to fetch topics")
+		}
+		config, err := ctx.GetMsgbusConfig()
+		ctx.Destroy()
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			topics[names[0]] = config
+		}
+	}
+	return topics, nil
 }
 
 // StartPublisher function to register the publisher and subscribe to influxdb
@@ -140,6 +653,13 @@ func StartPublisher() {
 	var SubObj common.SubScriptionInfo
 	SubObj.DbName = InfluxObj.DbInfo.Database
 	SubObj.Host = subServHost
+	SubObj.BindHost = subServHost
+	if InfluxObj.DbInfo.External {
+		// The external InfluxDB has to reach the subscription server
+		// from outside of this container
+		SubObj.Host = InfluxObj.DbInfo.SubscriptionHost
+		SubObj.BindHost = ""
+	}
 	SubObj.Port = subServPort
 	SubObj.Worker = int(runtimeInfo.PubWorker)
 	err = InfluxObj.Subscribe(SubObj, &pubMgr)
@@ -153,8 +673,6 @@ func StartPublisher() {
 //StartSubscriber Function to start the subscriber and insert data to influxdb
 func StartSubscriber() {
 	InfluxObj.CnInfo = runtimeInfo
-	var subMgr subManager.SubManager
-	var influxWrite dbManager.InfluxWriter
 	var err error
 
 	numOfSubscribers, err := CfgMgr.ConfigMgr.GetNumSubscribers()
@@ -192,6 +710,7 @@ func StartSubscriber() {
 		}
 		topic := topics[0]
 		glog.Infof("Subscriber topic is : %v", topic)
+		subTopics = append(subTopics, topic)
 
 		subMgr.RegSubscriberList(topic)
 		config, err := subCtx.GetMsgbusConfig()
@@ -211,8 +730,87 @@ func StartSubscriber() {
 	subMgr.ReceiveFromAll(&influxWrite, int(InfluxObj.CnInfo.SubWorker))
 }
 
+// componentHealth will check every component of the connector, the report
+// is down when one of them is down
+func componentHealth() healthReport {
+	components := InfluxObj.Health()
+	components = append(components, pubMgr.Health()...)
+	components = append(components, subMgr.Health()...)
+
+	queryHealth.Lock()
+	components = append(components, queryHealth.status)
+	queryHealth.Unlock()
+
+	if importMgr != nil {
+		components = append(components, importMgr.Health())
+	}
+	if diskMgr != nil {
+		usage := diskMgr.Usage()
+		disk := common.ComponentStatus{Name: "disk_quota", Status: common.StatusOK}
+		if usage.Exceeded {
+			disk.Status = common.StatusDegraded
+			disk.Detail = fmt.Sprintf("%d bytes used, quota is %d bytes", usage.TotalBytes, usage.QuotaBytes)
+		}
+		components = append(components, disk)
+	}
+
+	report := healthReport{Status: common.StatusOK, Components: components}
+	for _, component := range components {
+		if component.Status == common.StatusDown {
+			report.Status = common.StatusDown
+			break
+		}
+		if component.Status == common.StatusDegraded {
+			report.Status = common.StatusDegraded
+		}
+	}
+	return report
+}
+
+// writeHealth will reply with the report, 503 when it is down
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == common.StatusDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// probeHealth will request the health endpoint and return the exit status
+func probeHealth(url string) int {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s replied %s\n", url, resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// setQueryHealth will update the health of the query service
+func setQueryHealth(status string, detail string) {
+	queryHealth.Lock()
+	defer queryHealth.Unlock()
+	queryHealth.status.Status = status
+	queryHealth.status.Detail = detail
+	queryHealth.stopped = status == common.StatusDown
+}
+
 //Function to start the query server
 func startReqReply() {
+	defer close(queryDone)
+	stopStatus, stopDetail := common.StatusDown, "query service stopped, see the logs"
+	defer func() { setQueryHealth(stopStatus, stopDetail) }()
 
 	InfluxObj.CnInfo = runtimeInfo
 
@@ -224,6 +822,7 @@ func startReqReply() {
 	serverCtx, err := CfgMgr.ConfigMgr.GetServerByIndex(0)
 	if err != nil {
 		glog.Errorf("Error occured with error:%v", err)
+		stopStatus, stopDetail = common.StatusDisabled, "no Servers interface"
 		return
 	}
 	defer serverCtx.Destroy()
@@ -238,11 +837,13 @@ func startReqReply() {
 		glog.Errorf("-- Error initializing message bus context: %v\n", err)
 		return
 	}
+	defer client.Close()
 	service, err := client.NewService(keyword)
 	if err != nil {
 		glog.Errorf("-- Error initializing service: %v\n", err)
 		return
 	}
+	defer service.Close()
 
 	var influxQuery dbManager.InfluxQuery
 	influxQuery.DbInfo = credConfig
@@ -253,38 +854,139 @@ func startReqReply() {
 		os.Exit(-1)
 	}
 	influxQuery.QueryListcon = influxdbQueryconfig
+	influxQuery.Backup = backupMgr
+	influxQuery.Export = exportMgr
+	influxQuery.Import = importMgr
+	influxQuery.Disk = diskMgr
+	if len(influxdbQueryconfig["StreamTopic"]) > 0 {
+		influxQuery.StreamTopic = influxdbQueryconfig["StreamTopic"][0]
+		influxQuery.StreamOut = &pubMgr
+		glog.Infof("Query results will be streamed on topic : %s", influxQuery.StreamTopic)
+	}
+	if len(influxdbQueryconfig["MaxStreams"]) > 0 {
+		influxQuery.MaxStreams, _ = strconv.Atoi(influxdbQueryconfig["MaxStreams"][0])
+	}
 
 	influxQuery.Init()
-	flag := true
+	reloadMutex.Lock()
+	influxQuery.SubTopics = subTopics
+	queryMgr = &influxQuery
+	reloadMutex.Unlock()
+	setQueryHealth(common.StatusOK, "")
 
-	for flag {
-		msg, err := service.ReceiveRequest(-1)
+	for {
+		select {
+		case <-queryStop:
+			stopDetail = "query service stopped"
+			return
+		default:
+		}
+		msg, err := service.ReceiveRequest(queryReceiveTimeout)
 		if err != nil {
 			glog.Errorf("-- Error receiving request: %v\n", err)
 			return
 		}
+		if msg == nil {
+			continue
+		}
 		glog.Infof("Command received: %s", msg)
-		response, _ := influxQuery.QueryInflux(msg)
+		response, err := influxQuery.QueryInflux(msg)
+		if err != nil {
+			response.Data["Error"] = err.Error()
+		}
 		service.Response(response.Data)
 	}
-
 }
 
-//Function to stop the publishers
+// cleanup will stop the connector within the shutdown timeout. The inputs
+// are stopped first, the messages and points already received are written
+// and published, then the message bus and influxd are stopped.
 func cleanup() {
-	pubMgr.StopAllClient()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// The query service takes reloadMutex while starting
+	close(queryStop)
+	select {
+	case <-queryDone:
+	case <-ctx.Done():
+		glog.Errorf("Query service not stopped : %v", ctx.Err())
+	}
+
+	// No config change is applied while stopping
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if queryMgr != nil {
+		queryMgr.StopStreams()
+		if err := queryMgr.WaitStreams(ctx); err != nil {
+			glog.Errorf("Query results not all streamed : %v", err)
+		}
+	}
+	if exportMgr != nil {
+		exportMgr.Stop()
+		if err := exportMgr.Wait(ctx); err != nil {
+			glog.Errorf("Exports not stopped : %v", err)
+		}
+	}
+	if backupMgr != nil {
+		backupMgr.Stop()
+		if err := backupMgr.Wait(ctx); err != nil {
+			glog.Errorf("Backup or restore not finished : %v", err)
+		}
+	}
+	if diskMgr != nil {
+		diskMgr.Stop()
+	}
+	if selfMgr != nil {
+		selfMgr.Stop()
+	}
+	if importMgr != nil {
+		importMgr.Stop()
+		if err := importMgr.Wait(ctx); err != nil {
+			glog.Errorf("Import of the current file not finished : %v", err)
+		}
+	}
+
+	if err := subMgr.StopAllSubscribers(ctx); err != nil {
+		glog.Errorf("Messages of the subscribers not all written : %v", err)
+	}
+	subMgr.StopAllClient()
+	if err := InfluxObj.StopSubscription(ctx); err != nil {
+		glog.Errorf("Points of the subscription not all published : %v", err)
+	}
 	pubMgr.StopAllPublisher()
-	CfgMgr.ConfigMgr.Destroy()
+	pubMgr.StopAllClient()
+
+	timeout := minInfluxStopTimeout
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) > timeout {
+		timeout = time.Until(deadline)
+	}
+	if err := InfluxObj.Stop(timeout); err != nil {
+		glog.Errorf("Error in stopping influxd : %v", err)
+	}
+
+	tracing.Shutdown()
+	if monitoringServer != nil {
+		monitoringServer.Close()
+	}
+	CfgMgr.Destroy()
+	glog.Infof("InfluxDBConnector stopped")
 }
 
 func main() {
 	flag.Parse()
-	profiling, _ := strconv.ParseBool(os.Getenv("PROFILING_MODE"))
-	common.Profiling = profiling
+	if *healthCheck != "" {
+		os.Exit(probeHealth(*healthCheck))
+	}
 
-	// Initializing Etcd to set env variables
+	// Initializing Etcd or the config file to set env variables
 
+	CfgMgr.ConfigFile = *configFile
 	CfgMgr.Init()
+	if *validateOnly {
+		os.Exit(validateConfig())
+	}
 	devMode, err := CfgMgr.ConfigMgr.IsDevMode()
 	if err != nil {
 		glog.Fatalf("Error occured with error:%v", err)
@@ -297,12 +999,29 @@ func main() {
 	flag.Set("logtostderr", "true")
 	flag.Set("stderrthreshold", os.Getenv("GO_LOG_LEVEL"))
 	flag.Set("v", os.Getenv("GO_VERBOSE"))
-	done := make(chan bool)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	readConfig()
+	StartMonitoring()
+	StartTracing()
+	initBackup()
 	StartDb()
+	initExport()
+	StartBackup()
 	StartPublisher()
 	StartSubscriber()
+	StartImport()
+	StartDiskMonitor()
+	StartSelfMonitor()
+	watchConfig()
 	go startReqReply()
-	<-done
+
+	sig := <-signals
+	glog.Infof("Received %v, stopping InfluxDBConnector", sig)
+	go func() {
+		sig := <-signals
+		glog.Errorf("Received %v again, exiting without waiting", sig)
+		os.Exit(1)
+	}()
 	cleanup()
 }
@@ -22,6 +22,10 @@ SOFTWARE.
 
 package common
 
+import (
+	"context"
+)
+
 // DbCredential structure
 type DbCredential struct {
 	Username  string
@@ -32,6 +36,186 @@ type DbCredential struct {
 	Port      string
 	Ssl       string
 	Verifyssl string
+	// External is set when the connector uses an existing InfluxDB
+	// instead of starting influxd
+	External bool
+	// SubscriptionHost is the host InfluxDB sends the subscription data to
+	SubscriptionHost string
+	// Backend is influxdb1 or influxdb2, the later one authenticates with
+	// the Token and maps the Database to the Bucket of the Org
+	Backend string
+	Org     string
+	Bucket  string
+	Token   string
+	// DryRun keeps the points in memory instead of using InfluxDB
+	DryRun bool
+	// RetentionPolicies and Downsampling are reconciled on the Database at
+	// startup
+	RetentionPolicies []RetentionPolicy
+	Downsampling      []DownsampleRule
+	// Databases and Users are the other databases and users reconciled on
+	// InfluxDB at startup and on config change
+	Databases []DatabaseSpec
+	Users     []UserSpec
+}
+
+// RetentionPolicy structure
+type RetentionPolicy struct {
+	Name string `json:"name"`
+	// Duration is an InfluxQL duration like 2h, 30d or INF
+	Duration      string `json:"duration"`
+	ShardDuration string `json:"shard_duration"`
+	// Replication is the number of copies of the data, 1 by default
+	Replication int  `json:"replication"`
+	Default     bool `json:"default"`
+}
+
+// DatabaseSpec structure
+type DatabaseSpec struct {
+	Name              string            `json:"name"`
+	RetentionPolicies []RetentionPolicy `json:"retention_policies"`
+}
+
+// UserSpec structure
+type UserSpec struct {
+	Name string `json:"name"`
+	// PasswordEnv is the environment variable holding the password
+	PasswordEnv string `json:"password_env"`
+	Admin       bool   `json:"admin"`
+	// Privileges maps the databases to READ, WRITE or ALL
+	Privileges map[string]string `json:"privileges"`
+}
+
+// DownsampleRule structure
+type DownsampleRule struct {
+	// Measurement to downsample, empty for all the measurements
+	Measurement string `json:"measurement"`
+	// From and To are the source and target retention policies
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Interval of the GROUP BY time() of the continuous query
+	Interval string `json:"interval"`
+	// Aggregate function applied to all the fields, mean by default
+	Aggregate string `json:"aggregate"`
+}
+
+// BackupConfig structure
+type BackupConfig struct {
+	// Schedule is a cron expression, empty to back up only on request
+	Schedule  string `json:"schedule"`
+	Directory string `json:"directory"`
+	// Generations is the number of full backups kept along with their
+	// incremental backups
+	Generations int  `json:"generations"`
+	Incremental bool `json:"incremental"`
+	// FullEvery is the number of backups of a generation, the first one
+	// being full and the others incremental
+	FullEvery int `json:"full_every"`
+	// Host is the RPC address of influxd used for the backups
+	Host string `json:"host"`
+	// RestoreFrom is the backup restored at startup when InfluxDB has no
+	// data, a backup name or latest
+	RestoreFrom string `json:"restore_from"`
+	// AdminOps enables the backup and restore ops of the query service,
+	// which every query client can send
+	AdminOps bool `json:"admin_ops"`
+}
+
+// ExportConfig structure
+type ExportConfig struct {
+	Directory string `json:"directory"`
+	// Window is the time range exported at once, the export is resumed from
+	// the last completed window
+	Window string `json:"window"`
+}
+
+// ImportConfig structure
+type ImportConfig struct {
+	// Directory is watched for .lp and .csv files, optionally gzipped
+	Directory       string `json:"directory"`
+	DoneDirectory   string `json:"done_directory"`
+	FailedDirectory string `json:"failed_directory"`
+	BatchSize       int    `json:"batch_size"`
+	PollInterval    string `json:"poll_interval"`
+	// Precision of the line protocol timestamps, ns by default
+	Precision string `json:"precision"`
+}
+
+// InfluxServerConfig structure holds the influxd settings rendered into its
+// config file, the influxd defaults apply to the empty ones
+type InfluxServerConfig struct {
+	// CacheMaxMemorySize and CacheSnapshotMemorySize are sizes like 1GB
+	CacheMaxMemorySize      string `json:"cache_max_memory_size"`
+	CacheSnapshotMemorySize string `json:"cache_snapshot_memory_size"`
+	WalFsyncDelay           string `json:"wal_fsync_delay"`
+	// MaxSeriesPerDatabase of 0 disables the limit
+	MaxSeriesPerDatabase *int   `json:"max_series_per_database"`
+	QueryTimeout         string `json:"query_timeout"`
+	TLSCertificate       string `json:"tls_certificate"`
+	TLSPrivateKey        string `json:"tls_private_key"`
+	TLSCa                string `json:"tls_ca"`
+	// BindAddress of the HTTP service, its port must be the influxdb port
+	BindAddress string `json:"bind_address"`
+	LogLevel    string `json:"log_level"`
+}
+
+// DiskQuotaConfig structure
+type DiskQuotaConfig struct {
+	// Quota of the data and wal directories together, e.g. 500MB or 20GB
+	Quota         string `json:"quota"`
+	CheckInterval string `json:"check_interval"`
+	// Action is drop_shards or shorten_retention
+	Action string `json:"action"`
+	// Measurements are deleted oldest shard first instead of dropping whole
+	// shards when set
+	Measurements []string `json:"measurements"`
+	// MinRetention is the lowest duration shorten_retention goes down to
+	MinRetention string `json:"min_retention"`
+	// EventTopic is the publisher topic of the quota warning events
+	EventTopic string `json:"event_topic"`
+}
+
+// MonitoringConfig structure
+type MonitoringConfig struct {
+	// Address of the HTTP server of /metrics, e.g. 0.0.0.0:9273
+	Address string `json:"address"`
+}
+
+// TracingConfig structure
+type TracingConfig struct {
+	// Endpoint of the OTLP/HTTP receiver of the collector, e.g.
+	// http://localhost:4318
+	Endpoint string `json:"endpoint"`
+	// SampleRatio is the share of the traces exported, 1 when not set
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// SelfMonitoringConfig structure
+type SelfMonitoringConfig struct {
+	// Interval between two writes of the stats, e.g. 10s
+	Interval string `json:"interval"`
+	// Retention is the duration of the _connector retention policy
+	Retention string `json:"retention"`
+}
+
+// Status of a component of the connector
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+	StatusDisabled = "disabled"
+)
+
+// ComponentStatus structure is the health of a component of the connector
+type ComponentStatus struct {
+	Name string `json:"name"`
+	// Status is ok, degraded, down or disabled
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Backlog is the number of items waiting in a buffer out of its
+	// Capacity, 0 when it has no limit
+	Backlog  int `json:"backlog,omitempty"`
+	Capacity int `json:"capacity,omitempty"`
 }
 
 // SubScriptionInfo structure
@@ -40,6 +224,9 @@ type SubScriptionInfo struct {
 	Host   string
 	Port   string
 	Worker int
+	// BindHost is the address the subscription server listens on, empty
+	// for all the interfaces
+	BindHost string
 }
 
 // Filter Interface
@@ -47,14 +234,25 @@ type Filter interface {
 	GetAttribute(data []byte) (string, error)
 }
 
-// OutPutInterface interface
+// OutPutInterface interface, ctx carries the trace context of the data
 type OutPutInterface interface {
-	Write(data []byte)
+	Write(ctx context.Context, data []byte)
 }
 
-// InsertInterface interface
+// InsertInterface interface, ctx carries the trace context of the data
 type InsertInterface interface {
-	Write(data []byte, topic string)
+	Write(ctx context.Context, data []byte, topic string)
+}
+
+// TopicPublisher interface
+type TopicPublisher interface {
+	Publish(topic string, msg map[string]interface{}) error
+}
+
+// QueueReporter interface reports the number of messages waiting in each
+// queue by name
+type QueueReporter interface {
+	QueueDepths() map[string]int
 }
 
 // PubEndPoint structure
@@ -84,6 +282,3 @@ type AppConfig struct {
 type SubEndPoint struct {
 	Measurement string
 }
-
-// Profiling variable
-var Profiling bool = false
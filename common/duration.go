@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package common
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxDurationPattern = regexp.MustCompile(`^(\d+(ns|us|u|µ|ms|s|m|h|d|w))+$`)
+	influxDurationPart    = regexp.MustCompile(`(\d+)(ns|us|u|µ|ms|s|m|h|d|w)`)
+)
+
+var influxDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// ParseInfluxDuration will parse the InfluxQL duration literal like 1h30m or
+// 7d, INF is returned as 0 like InfluxDB does
+func ParseInfluxDuration(value string) (time.Duration, error) {
+	if strings.EqualFold(value, "inf") {
+		return 0, nil
+	}
+	if !influxDurationPattern.MatchString(value) {
+		return 0, errors.New("invalid duration " + strconv.Quote(value))
+	}
+	var duration time.Duration
+	for _, part := range influxDurationPart.FindAllStringSubmatch(value, -1) {
+		n, err := strconv.ParseInt(part[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		duration += time.Duration(n) * influxDurationUnits[part[2]]
+	}
+	return duration, nil
+}
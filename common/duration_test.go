@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInfluxDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		duration time.Duration
+		invalid  bool
+	}{
+		{value: "1h", duration: time.Hour},
+		{value: "1h30m5s", duration: time.Hour + 30*time.Minute + 5*time.Second},
+		{value: "7d", duration: 7 * 24 * time.Hour},
+		{value: "52w", duration: 52 * 7 * 24 * time.Hour},
+		{value: "1w2d", duration: 9 * 24 * time.Hour},
+		{value: "100ms", duration: 100 * time.Millisecond},
+		{value: "10us", duration: 10 * time.Microsecond},
+		{value: "10µ", duration: 10 * time.Microsecond},
+		{value: "5ns", duration: 5},
+		{value: "INF", duration: 0},
+		{value: "inf", duration: 0},
+		{value: "", invalid: true},
+		{value: "1", invalid: true},
+		{value: "1y", invalid: true},
+		{value: "1.5h", invalid: true},
+		{value: "-1h", invalid: true},
+		{value: "1h ", invalid: true},
+	}
+
+	for _, test := range tests {
+		duration, err := ParseInfluxDuration(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseInfluxDuration(%q) = %v, expected an error", test.value, duration)
+			}
+			continue
+		}
+		if err != nil || duration != test.duration {
+			t.Errorf("ParseInfluxDuration(%q) = %v, %v, expected %v", test.value, duration, err, test.duration)
+		}
+	}
+}
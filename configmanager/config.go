@@ -0,0 +1,445 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package configmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	common "influxdbconnector/common"
+	util "influxdbconnector/util"
+)
+
+const (
+	schemaPath        = "./schema.json"
+	defaultWorkers    = 5
+	maxWorkers        = 100
+	defaultInfluxPort = 8086
+	// defaultQueryStreams is the number of query result sets streamed at once
+	defaultQueryStreams = 4
+	maxQueryStreams     = 100
+	// minRetention is the shortest retention accepted by InfluxDB, 1h
+	minRetention = time.Hour
+)
+
+// ValidationErrors is the list of the problems found in the config
+type ValidationErrors []string
+
+func (errs ValidationErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(errs, "\n  ")
+}
+
+func (errs *ValidationErrors) add(format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, args...))
+}
+
+// InfluxdbConfig structure is the influxdb section of the app config
+type InfluxdbConfig struct {
+	Retention string `json:"retention"`
+	Dbname    string `json:"dbname"`
+	Ssl       bool   `json:"ssl"`
+	VerifySsl bool   `json:"verifySsl"`
+	Port      int    `json:"port"`
+	Host      string `json:"host"`
+	External  bool   `json:"external"`
+	// Host on which InfluxDB can reach the subscription server
+	SubscriptionHost string `json:"subscription_host"`
+	Backend          string `json:"backend"`
+	Org              string `json:"org"`
+	Bucket           string `json:"bucket"`
+	DryRun           bool   `json:"dry_run"`
+	// Retention policies and downsampling rules of the database
+	RetentionPolicies []common.RetentionPolicy `json:"retention_policies"`
+	Downsampling      []common.DownsampleRule  `json:"downsampling"`
+	// Other databases and users managed by the connector
+	Databases []common.DatabaseSpec `json:"databases"`
+	Users     []common.UserSpec     `json:"users"`
+}
+
+// Config structure is the typed app config, the optional sections are nil
+// when they are not configured
+type Config struct {
+	Influxdb         InfluxdbConfig               `json:"influxdb"`
+	PubWorkers       int                          `json:"pub_workers"`
+	SubWorkers       int                          `json:"sub_workers"`
+	IgnoreKeys       []string                     `json:"ignore_keys"`
+	TagKeys          []string                     `json:"tag_keys"`
+	BlacklistQuery   []string                     `json:"blacklist_query"`
+	QueryStreamTopic string                       `json:"query_stream_topic"`
+	QueryMaxStreams  int                          `json:"query_max_streams"`
+	InfluxdbServer   common.InfluxServerConfig    `json:"influxdb_server"`
+	Backup           *common.BackupConfig         `json:"backup"`
+	Export           *common.ExportConfig         `json:"export"`
+	Import           *common.ImportConfig         `json:"import"`
+	DiskQuota        *common.DiskQuotaConfig      `json:"disk_quota"`
+	Monitoring       *common.MonitoringConfig     `json:"monitoring"`
+	SelfMonitoring   *common.SelfMonitoringConfig `json:"self_monitoring"`
+	Tracing          *common.TracingConfig        `json:"tracing"`
+}
+
+// ParseConfig will check the app config against schema.json, decode it
+// accepting numbers and booleans given as strings and the other way round,
+// apply the defaults and validate the values. All the problems found are
+// returned together as ValidationErrors.
+func ParseConfig(data map[string]interface{}) (*Config, error) {
+	var errs ValidationErrors
+
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return nil, errors.New("schema file not found: " + err.Error())
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if !util.ValidateJSON(string(schema), string(value)) {
+		errs.add("config does not match %s", schemaPath)
+	}
+
+	config := &Config{
+		PubWorkers: defaultWorkers,
+		SubWorkers: defaultWorkers,
+		// Streams are read from a store connection each, keep them bounded
+		QueryMaxStreams: defaultQueryStreams,
+	}
+	config.Influxdb.Ssl = true
+	config.Influxdb.VerifySsl = true
+	config.Influxdb.Port = defaultInfluxPort
+
+	coerced := coerce(data, reflect.TypeOf(*config), "", &errs)
+	raw, _ := json.Marshal(coerced)
+	if err = json.Unmarshal(raw, config); err != nil {
+		errs.add("%v", err)
+	}
+
+	config.validate(&errs)
+	if len(errs) > 0 {
+		return config, errs
+	}
+	return config, nil
+}
+
+// validate will apply the defaults depending on other values and check the
+// ranges and the combinations of the values
+func (config *Config) validate(errs *ValidationErrors) {
+	influx := &config.Influxdb
+	if influx.Dbname == "" {
+		errs.add("influxdb.dbname is required")
+	}
+	if err := checkRetention(influx.Retention); err != nil {
+		errs.add("influxdb.retention: %v", err)
+	}
+	if influx.Port < 1 || influx.Port > 65535 {
+		errs.add("influxdb.port: %d is not in 1..65535", influx.Port)
+	}
+
+	switch influx.Backend {
+	case "", "influxdb1":
+		influx.Backend = "influxdb1"
+	case "influxdb2":
+		// InfluxDB 2.x is not bundled, it is always an external instance
+		influx.External = true
+		if influx.Org == "" {
+			errs.add("influxdb.org is required for the influxdb2 backend")
+		}
+		if os.Getenv("INFLUXDB_TOKEN") == "" {
+			errs.add("INFLUXDB_TOKEN is required for the influxdb2 backend")
+		}
+	default:
+		errs.add("influxdb.backend: unknown backend %q, expected influxdb1 or influxdb2", influx.Backend)
+	}
+	if influx.External && influx.Host == "" {
+		errs.add("influxdb.host is required for an external InfluxDB")
+	}
+
+	for i, rp := range influx.RetentionPolicies {
+		if rp.Name == "" {
+			errs.add("influxdb.retention_policies[%d].name is required", i)
+		}
+		if err := checkRetention(rp.Duration); err != nil {
+			errs.add("influxdb.retention_policies[%d].duration: %v", i, err)
+		}
+	}
+
+	if config.Monitoring != nil {
+		_, port, err := net.SplitHostPort(config.Monitoring.Address)
+		if n, _ := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errs.add("monitoring.address: %q is not a host:port address", config.Monitoring.Address)
+		}
+	}
+
+	if config.SelfMonitoring != nil {
+		if interval := config.SelfMonitoring.Interval; interval != "" {
+			if d, err := time.ParseDuration(interval); err != nil || d < time.Second {
+				errs.add("self_monitoring.interval: %q is not a duration of at least 1s", interval)
+			}
+		}
+		if retention := config.SelfMonitoring.Retention; retention != "" {
+			if err := checkRetention(retention); err != nil {
+				errs.add("self_monitoring.retention: %v", err)
+			}
+		}
+	}
+
+	if config.Tracing != nil {
+		endpoint, err := url.Parse(config.Tracing.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs.add("tracing.endpoint: %q is not an http or https URL", config.Tracing.Endpoint)
+		}
+		if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+			errs.add("tracing.sample_ratio: %v is not in 0..1", config.Tracing.SampleRatio)
+		}
+	}
+
+	for _, key := range config.TagKeys {
+		for _, ignored := range config.IgnoreKeys {
+			if key == ignored {
+				errs.add("tag_keys: %q is also in ignore_keys", key)
+			}
+		}
+	}
+
+	if config.PubWorkers < 1 || config.PubWorkers > maxWorkers {
+		errs.add("pub_workers: %d is not in 1..%d", config.PubWorkers, maxWorkers)
+	}
+	if config.SubWorkers < 1 || config.SubWorkers > maxWorkers {
+		errs.add("sub_workers: %d is not in 1..%d", config.SubWorkers, maxWorkers)
+	}
+	if config.QueryMaxStreams < 1 || config.QueryMaxStreams > maxQueryStreams {
+		errs.add("query_max_streams: %d is not in 1..%d", config.QueryMaxStreams, maxQueryStreams)
+	}
+}
+
+// DbCredential will return the influxdb section along with the credentials
+// from the environment
+func (config *Config) DbCredential() common.DbCredential {
+	influx := config.Influxdb
+	influxCred := common.DbCredential{
+		Username:          os.Getenv("INFLUXDB_USERNAME"),
+		Password:          os.Getenv("INFLUXDB_PASSWORD"),
+		Database:          influx.Dbname,
+		Retention:         influx.Retention,
+		Port:              strconv.Itoa(influx.Port),
+		Ssl:               strconv.FormatBool(influx.Ssl),
+		Verifyssl:         strconv.FormatBool(influx.VerifySsl),
+		Host:              "localhost",
+		External:          influx.External,
+		DryRun:            influx.DryRun,
+		Backend:           influx.Backend,
+		RetentionPolicies: influx.RetentionPolicies,
+		Downsampling:      influx.Downsampling,
+		Databases:         influx.Databases,
+		Users:             influx.Users,
+	}
+	if influx.Backend == "influxdb2" {
+		influxCred.Org = influx.Org
+		influxCred.Bucket = influx.Bucket
+		influxCred.Token = os.Getenv("INFLUXDB_TOKEN")
+	}
+	if influx.External {
+		influxCred.Host = influx.Host
+		influxCred.SubscriptionHost = influx.SubscriptionHost
+		if influxCred.SubscriptionHost == "" {
+			influxCred.SubscriptionHost, _ = os.Hostname()
+		}
+	}
+	return influxCred
+}
+
+// checkRetention will check the InfluxQL duration of a retention policy,
+// INF keeps the data forever
+func checkRetention(value string) error {
+	duration, err := common.ParseInfluxDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 1h30m, 7d or INF", value)
+	}
+	if duration != 0 && duration < minRetention {
+		return fmt.Errorf("%q is shorter than 1h", value)
+	}
+	return nil
+}
+
+// coerce will convert the decoded JSON value to the kinds of the target type:
+// numbers and booleans given as strings, numbers and booleans given for a
+// string, and a comma separated string given for a list of strings. The
+// values which can't be converted are reported in errs.
+func coerce(value interface{}, target reflect.Type, path string, errs *ValidationErrors) interface{} {
+	if value == nil {
+		return nil
+	}
+	if target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+
+	switch target.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add("%s: expected an object, got %s", displayPath(path), describe(value))
+			return nil
+		}
+		fields := make(map[string]reflect.StructField, target.NumField())
+		for i := 0; i < target.NumField(); i++ {
+			field := target.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			fields[strings.ToLower(name)] = field
+		}
+		result := make(map[string]interface{}, len(object))
+		for _, key := range sortedKeys(object) {
+			item := object[key]
+			if field, ok := fields[strings.ToLower(key)]; ok {
+				result[key] = coerce(item, field.Type, joinPath(path, key), errs)
+			} else {
+				result[key] = item
+			}
+		}
+		return result
+	case reflect.Slice:
+		if text, ok := value.(string); ok && target.Elem().Kind() == reflect.String {
+			var list []interface{}
+			for _, item := range strings.Split(text, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			return list
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.add("%s: expected a list, got %s", displayPath(path), describe(value))
+			return nil
+		}
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			result[i] = coerce(item, target.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+		return result
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add("%s: expected an object, got %s", displayPath(path), describe(value))
+			return nil
+		}
+		result := make(map[string]interface{}, len(object))
+		for _, key := range sortedKeys(object) {
+			result[key] = coerce(object[key], target.Elem(), joinPath(path, key), errs)
+		}
+		return result
+	case reflect.Int, reflect.Int64:
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) {
+				return v
+			}
+		case string:
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				return n
+			}
+		}
+		errs.add("%s: expected an integer, got %s", displayPath(path), describe(value))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case float64:
+			return v
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return f
+			}
+		}
+		errs.add("%s: expected a number, got %s", displayPath(path), describe(value))
+		return nil
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			return v
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b
+			}
+		}
+		errs.add("%s: expected true or false, got %s", displayPath(path), describe(value))
+		return nil
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+		}
+		errs.add("%s: expected a string, got %s", displayPath(path), describe(value))
+		return nil
+	}
+	return value
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// describe will format the JSON value for the validation errors
+func describe(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	}
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package configmanager
+
+import (
+	"strings"
+)
+
+// EffectiveInterface is a server, publisher or subscriber along with its
+// resolved message bus config
+type EffectiveInterface struct {
+	Topics []string               `json:"topics,omitempty"`
+	Msgbus map[string]interface{} `json:"msgbus"`
+}
+
+// EffectiveConfig is the config the connector would run with, the defaults
+// applied and the secret keys redacted
+type EffectiveConfig struct {
+	AppName     string               `json:"app_name"`
+	DevMode     bool                 `json:"dev_mode"`
+	Config      *Config              `json:"config"`
+	Server      *EffectiveInterface  `json:"server"`
+	Publishers  []EffectiveInterface `json:"publishers"`
+	Subscribers []EffectiveInterface `json:"subscribers"`
+}
+
+// Check will load the app config and the interfaces the way the connector
+// does at startup and check the topics of the interfaces, all the problems
+// found are returned together
+func (CfgMgr *ConfigManager) Check() (*EffectiveConfig, ValidationErrors) {
+	var errs ValidationErrors
+	effective := &EffectiveConfig{}
+
+	var err error
+	effective.AppName, err = CfgMgr.ConfigMgr.GetAppName()
+	if err != nil {
+		errs.add("AppName: %v", err)
+	}
+	effective.DevMode, err = CfgMgr.ConfigMgr.IsDevMode()
+	if err != nil {
+		errs.add("DEV_MODE: %v", err)
+	}
+
+	effective.Config, err = CfgMgr.Load()
+	if validationErrs, ok := err.(ValidationErrors); ok {
+		errs = append(errs, validationErrs...)
+	} else if err != nil {
+		errs.add("%v", err)
+	}
+
+	serverCtx, err := CfgMgr.ConfigMgr.GetServerByIndex(0)
+	if err != nil {
+		errs.add("Servers: the query service needs a server: %v", err)
+	} else {
+		msgbus, err := serverCtx.GetMsgbusConfig()
+		serverCtx.Destroy()
+		if err != nil {
+			errs.add("Servers: %v", err)
+		}
+		effective.Server = &EffectiveInterface{Msgbus: redactSecrets(msgbus)}
+	}
+
+	effective.Publishers = CfgMgr.checkTopics("Publishers", CfgMgr.ConfigMgr.GetNumPublishers,
+		CfgMgr.ConfigMgr.GetPublisherByIndex, &errs)
+	effective.Subscribers = CfgMgr.checkTopics("Subscribers", CfgMgr.ConfigMgr.GetNumSubscribers,
+		CfgMgr.ConfigMgr.GetSubscriberByIndex, &errs)
+
+	if effective.Config != nil {
+		published := make(map[string]bool)
+		for _, publisher := range effective.Publishers {
+			for _, topic := range publisher.Topics {
+				published[topic] = true
+			}
+		}
+		config := effective.Config
+		if config.QueryStreamTopic != "" && !published[config.QueryStreamTopic] {
+			errs.add("query_stream_topic: %q is not a Publishers topic", config.QueryStreamTopic)
+		}
+		if config.DiskQuota != nil && config.DiskQuota.EventTopic != "" && !published[config.DiskQuota.EventTopic] {
+			errs.add("disk_quota.event_topic: %q is not a Publishers topic", config.DiskQuota.EventTopic)
+		}
+	}
+	return effective, errs
+}
+
+// checkTopics will read the publishers or subscribers and check that every
+// topic is used by a single one of them
+func (CfgMgr *ConfigManager) checkTopics(kind string, count func() (int, error),
+	byIndex func(int) (TopicConfig, error), errs *ValidationErrors) []EffectiveInterface {
+	num, err := count()
+	if err != nil {
+		errs.add("%s: %v", kind, err)
+		return nil
+	}
+
+	interfaces := []EffectiveInterface{}
+	seen := make(map[string]bool)
+	for index := 0; index < num; index++ {
+		ctx, err := byIndex(index)
+		if err != nil {
+			errs.add("%s[%d]: %v", kind, index, err)
+			continue
+		}
+		topics, err := ctx.GetTopics()
+		if err != nil || len(topics) == 0 {
+			errs.add("%s[%d]: no topics: %v", kind, index, err)
+		}
+		for _, topic := range topics {
+			if seen[topic] {
+				errs.add("%s[%d]: topic %q is used more than once", kind, index, topic)
+			}
+			seen[topic] = true
+		}
+		msgbus, err := ctx.GetMsgbusConfig()
+		if err != nil {
+			errs.add("%s[%d]: %v", kind, index, err)
+		}
+		ctx.Destroy()
+		interfaces = append(interfaces, EffectiveInterface{Topics: topics, Msgbus: redactSecrets(msgbus)})
+	}
+	return interfaces
+}
+
+// redactSecrets will return a copy of the message bus config without the
+// values of the secret keys
+func redactSecrets(config map[string]interface{}) map[string]interface{} {
+	if config == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		if strings.Contains(strings.ToLower(key), "secret") {
+			redacted[key] = "<redacted>"
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = redactSecrets(nested)
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
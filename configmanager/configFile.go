@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package configmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultAppName         = "InfluxDBConnector"
+	configFilePollInterval = 5 * time.Second
+)
+
+// fileInterface is a server, publisher or subscriber of the interfaces
+// section of the config file
+type fileInterface struct {
+	Name             string
+	Type             string
+	EndPoint         interface{}
+	Topics           []string
+	PublisherAppName string
+	AllowedClients   []string
+}
+
+// fileInterfaces is the interfaces section of the config file
+type fileInterfaces struct {
+	Servers     []fileInterface
+	Publishers  []fileInterface
+	Subscribers []fileInterface
+}
+
+// fileSource reads the config and interfaces from a config.json file, it
+// lets the connector run without etcd
+type fileSource struct {
+	path       string
+	appName    string
+	config     map[string]interface{}
+	interfaces fileInterfaces
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// newFileSource will read the config file at path
+func newFileSource(path string) (ConfigSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Config     map[string]interface{} `json:"config"`
+		Interfaces fileInterfaces         `json:"interfaces"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if file.Config == nil {
+		return nil, fmt.Errorf("config file %s has no config section", path)
+	}
+
+	source := &fileSource{
+		path:       path,
+		appName:    os.Getenv("AppName"),
+		config:     file.Config,
+		interfaces: file.Interfaces,
+		stop:       make(chan struct{}),
+	}
+	if source.appName == "" {
+		source.appName = defaultAppName
+	}
+	return source, nil
+}
+
+// GetAppConfig will return the config section of the file
+func (source *fileSource) GetAppConfig() (map[string]interface{}, error) {
+	return source.config, nil
+}
+
+// GetAppName will return the AppName environment variable
+func (source *fileSource) GetAppName() (string, error) {
+	return source.appName, nil
+}
+
+// IsDevMode will read the DEV_MODE environment variable, the file mode runs
+// in dev mode unless DEV_MODE is set to false
+func (source *fileSource) IsDevMode() (bool, error) {
+	value := os.Getenv("DEV_MODE")
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// GetNumPublishers will return the number of publishers of the file
+func (source *fileSource) GetNumPublishers() (int, error) {
+	return len(source.interfaces.Publishers), nil
+}
+
+// GetPublisherByIndex will return the publisher at index
+func (source *fileSource) GetPublisherByIndex(index int) (TopicConfig, error) {
+	if index < 0 || index >= len(source.interfaces.Publishers) {
+		return nil, fmt.Errorf("no publisher at index %d", index)
+	}
+	return &fileInterfaceConfig{source.interfaces.Publishers[index], "publisher"}, nil
+}
+
+// GetNumSubscribers will return the number of subscribers of the file
+func (source *fileSource) GetNumSubscribers() (int, error) {
+	return len(source.interfaces.Subscribers), nil
+}
+
+// GetSubscriberByIndex will return the subscriber at index
+func (source *fileSource) GetSubscriberByIndex(index int) (TopicConfig, error) {
+	if index < 0 || index >= len(source.interfaces.Subscribers) {
+		return nil, fmt.Errorf("no subscriber at index %d", index)
+	}
+	return &fileInterfaceConfig{source.interfaces.Subscribers[index], "subscriber"}, nil
+}
+
+// GetServerByIndex will return the server at index
+func (source *fileSource) GetServerByIndex(index int) (InterfaceConfig, error) {
+	if index < 0 || index >= len(source.interfaces.Servers) {
+		return nil, fmt.Errorf("no server at index %d", index)
+	}
+	return &fileInterfaceConfig{source.interfaces.Servers[index], "server"}, nil
+}
+
+// Watch will poll the modification time of the config file until the
+// source is destroyed
+func (source *fileSource) Watch(onChange func(key string)) error {
+	info, err := os.Stat(source.path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		modTime := info.ModTime()
+		ticker := time.NewTicker(configFilePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-source.stop:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(source.path)
+			if err != nil {
+				glog.Errorf("Failed to stat the config file %s: %v", source.path, err)
+				continue
+			}
+			if !info.ModTime().Equal(modTime) {
+				modTime = info.ModTime()
+				onChange(source.path)
+			}
+		}
+	}()
+	return nil
+}
+
+// Destroy will stop the watch of the config file
+func (source *fileSource) Destroy() {
+	source.stopOnce.Do(func() {
+		close(source.stop)
+	})
+}
+
+// fileInterfaceConfig builds the message bus config of an interface of the
+// config file the way the EII config manager does, without the CURVE keys
+type fileInterfaceConfig struct {
+	iface fileInterface
+	kind  string
+}
+
+// GetTopics will return the topics of the interface
+func (ctx *fileInterfaceConfig) GetTopics() ([]string, error) {
+	if len(ctx.iface.Topics) == 0 {
+		return nil, fmt.Errorf("%s %s has no topics", ctx.kind, ctx.iface.Name)
+	}
+	return ctx.iface.Topics, nil
+}
+
+// GetMsgbusConfig will build the message bus config from the Type and the
+// EndPoint of the interface
+func (ctx *fileInterfaceConfig) GetMsgbusConfig() (map[string]interface{}, error) {
+	switch ctx.iface.Type {
+	case "zmq_ipc":
+		socketDir, ok := ctx.iface.EndPoint.(string)
+		if endPoint, isMap := ctx.iface.EndPoint.(map[string]interface{}); isMap {
+			socketDir, ok = endPoint["SocketDir"].(string)
+		}
+		if !ok || socketDir == "" {
+			return nil, fmt.Errorf("%s %s: zmq_ipc needs a socket directory EndPoint", ctx.kind, ctx.iface.Name)
+		}
+		return map[string]interface{}{
+			"type":       "zmq_ipc",
+			"socket_dir": socketDir,
+		}, nil
+	case "zmq_tcp":
+		endPoint, _ := ctx.iface.EndPoint.(string)
+		host, portStr, err := net.SplitHostPort(endPoint)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: invalid EndPoint %q: %v", ctx.kind, ctx.iface.Name, endPoint, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: invalid port %q", ctx.kind, ctx.iface.Name, portStr)
+		}
+		address := map[string]interface{}{"host": host, "port": port}
+
+		config := map[string]interface{}{"type": "zmq_tcp"}
+		switch ctx.kind {
+		case "server":
+			config[ctx.iface.Name] = address
+		case "publisher":
+			config["zmq_tcp_publish"] = address
+		default:
+			for _, topic := range ctx.iface.Topics {
+				config[topic] = address
+			}
+		}
+		return config, nil
+	}
+	return nil, errors.New(ctx.kind + " " + ctx.iface.Name + ": unsupported interface type " + ctx.iface.Type)
+}
+
+// Destroy has nothing to release for the config file
+func (ctx *fileInterfaceConfig) Destroy() {
+}
@@ -23,90 +23,124 @@ SOFTWARE.
 package configmanager
 
 import (
-	"encoding/json"
 	"fmt"
-	util "influxdbconnector/util"
 	"io/ioutil"
-	"os"
-	"strconv"
+	"sync"
 
 	common "influxdbconnector/common"
 
-	eiicfgmgr "github.com/open-edge-insights/eii-configmgr-go/eiiconfigmgr"
-
 	"github.com/golang/glog"
 )
 
-//InfluxConfig structure
-type InfluxConfig struct {
-	Influxdb struct {
-		Retention string `json:"Retention"`
-		Username  string `json:"Username"`
-		Password  string `json:"Password"`
-		Dbname    string `json:"Dbname"`
-		Ssl       string `json:"Ssl"`
-		VerifySsl string `json:"VerifySsl"`
-		Port      string `json:"Port"`
-	} `json:"influxdb"`
-}
-
 // ConfigManager structure
 type ConfigManager struct {
-	ConfigMgr *eiicfgmgr.ConfigMgr
+	// ConfigFile is the path of a config.json to read the config and the
+	// interfaces from instead of etcd, it is set before Init
+	ConfigFile string
+	ConfigMgr  ConfigSource
+	// watcher is the config source created at Init which runs the watch,
+	// ConfigMgr is replaced by a new one on Reload
+	watcher ConfigSource
+	mutex   sync.Mutex
+	// config is the app config loaded from ConfigMgr, loaded tells whether
+	// it was loaded since the last Reload
+	config    *Config
+	configErr error
+	loaded    bool
 }
 
 //Init will initailize the maps
 func (CfgMgr *ConfigManager) Init() {
-	CfgMgr.ConfigMgr, _ = eiicfgmgr.ConfigManager()
-	if CfgMgr.ConfigMgr == nil {
-		glog.Fatalf("Config Manager initialization failed...")
+	var err error
+	CfgMgr.ConfigMgr, err = CfgMgr.newSource()
+	if err != nil {
+		glog.Fatalf("Config Manager initialization failed: %v", err)
+	}
+	if CfgMgr.ConfigFile != "" {
+		glog.Infof("Reading the config and interfaces from %s", CfgMgr.ConfigFile)
 	}
+	CfgMgr.watcher = CfgMgr.ConfigMgr
 }
 
-// ReadInfluxConfig will read the influxdb configuration
-// from the json file
-func (CfgMgr *ConfigManager) ReadInfluxConfig() (common.DbCredential, error) {
-	var influx InfluxConfig
-	var influxCred common.DbCredential
+// newSource will read the config file when one is given, else connect to
+// the EII config manager
+func (CfgMgr *ConfigManager) newSource() (ConfigSource, error) {
+	if CfgMgr.ConfigFile != "" {
+		return newFileSource(CfgMgr.ConfigFile)
+	}
+	return newEtcdSource()
+}
 
-	appName, err := CfgMgr.ConfigMgr.GetAppName()
+// Reload will create a new config source to read the changed app config
+// and interfaces, the previous one is destroyed unless it runs the watch
+func (CfgMgr *ConfigManager) Reload() error {
+	configMgr, err := CfgMgr.newSource()
 	if err != nil {
-		glog.Fatalf("Not able to read appname from etcd")
+		glog.Errorf("Config Manager reload failed: %v", err)
+		return err
+	}
+
+	CfgMgr.mutex.Lock()
+	previous := CfgMgr.ConfigMgr
+	CfgMgr.ConfigMgr = configMgr
+	CfgMgr.loaded = false
+	CfgMgr.mutex.Unlock()
+	if previous != CfgMgr.watcher {
+		previous.Destroy()
+	}
+	return nil
+}
+
+// Destroy will destroy the config sources
+func (CfgMgr *ConfigManager) Destroy() {
+	CfgMgr.mutex.Lock()
+	defer CfgMgr.mutex.Unlock()
+	if CfgMgr.ConfigMgr != CfgMgr.watcher {
+		CfgMgr.ConfigMgr.Destroy()
+	}
+	CfgMgr.watcher.Destroy()
+}
+
+// Load will read and validate the app config once per config version, the
+// readers below return its sections
+func (CfgMgr *ConfigManager) Load() (*Config, error) {
+	CfgMgr.mutex.Lock()
+	defer CfgMgr.mutex.Unlock()
+	if CfgMgr.loaded {
+		return CfgMgr.config, CfgMgr.configErr
 	}
 
 	data, err := CfgMgr.ConfigMgr.GetAppConfig()
 	if err != nil {
+		appName, _ := CfgMgr.ConfigMgr.GetAppName()
 		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
-		return influxCred, err
+		return nil, err
 	}
-	value, _ := json.Marshal(data)
-	// Reading schema json
-	schema, err := ioutil.ReadFile("./schema.json")
-	if err != nil {
-		glog.Errorf("Schema file not found")
-		return influxCred, err
+	CfgMgr.config, CfgMgr.configErr = ParseConfig(data)
+	if CfgMgr.configErr != nil {
+		glog.Errorf("%v", CfgMgr.configErr)
 	}
+	CfgMgr.loaded = true
+	return CfgMgr.config, CfgMgr.configErr
+}
 
-	// Validating config json
-	if util.ValidateJSON(string(schema), string(value)) != true {
-		return influxCred, err
-	}
-	err = json.Unmarshal([]byte(value), &influx)
+// ReadInfluxConfig will read the influxdb configuration
+// from the json file
+func (CfgMgr *ConfigManager) ReadInfluxConfig() (common.DbCredential, error) {
+	config, err := CfgMgr.Load()
 	if err != nil {
-		glog.Errorf("json error: %s", err.Error())
-		return influxCred, err
+		return common.DbCredential{}, err
 	}
+	return config.DbCredential(), nil
+}
 
-	influxCred.Username = os.Getenv("INFLUXDB_USERNAME")
-	influxCred.Password = os.Getenv("INFLUXDB_PASSWORD")
-	influxCred.Database = influx.Influxdb.Dbname
-	influxCred.Retention = influx.Influxdb.Retention
-	influxCred.Port = influx.Influxdb.Port
-	influxCred.Ssl = influx.Influxdb.Ssl
-	influxCred.Verifyssl = influx.Influxdb.VerifySsl
-	influxCred.Host = "localhost"
-
-	return influxCred, nil
+// WatchConfig will call the callback whenever the app config or the
+// interfaces change in etcd or in the config file
+func (CfgMgr *ConfigManager) WatchConfig(callback func()) error {
+	return CfgMgr.watcher.Watch(func(key string) {
+		glog.Infof("Config changed: %s", key)
+		callback()
+	})
 }
 
 // ReadContainerInfo will read the environment variable
@@ -121,27 +155,12 @@ func (CfgMgr *ConfigManager) ReadContainerInfo() (common.AppConfig, error) {
 		return cInfo, err
 	}
 
-	appName, err := CfgMgr.ConfigMgr.GetAppName()
-	if err != nil {
-		glog.Fatalf("Not able to read appname from etcd")
-	}
-
-	data, err := CfgMgr.ConfigMgr.GetAppConfig()
+	config, err := CfgMgr.Load()
 	if err != nil {
-		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
-		return cInfo, err
-	}
-
-	cInfo.PubWorker, err = strconv.ParseInt(data["pub_workers"].(string), 10, 0)
-	if err != nil {
-		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
-		return cInfo, err
-	}
-	cInfo.SubWorker, err = strconv.ParseInt(data["sub_workers"].(string), 10, 0)
-	if err != nil {
-		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
 		return cInfo, err
 	}
+	cInfo.PubWorker = int64(config.PubWorkers)
+	cInfo.SubWorker = int64(config.SubWorkers)
 
 	return cInfo, nil
 }
@@ -152,7 +171,8 @@ func (CfgMgr *ConfigManager) ReadCertKey(keyName string, filePath string) error
 
 	appName, err := CfgMgr.ConfigMgr.GetAppName()
 	if err != nil {
-		glog.Fatalf("Not able to read appname from etcd")
+		glog.Errorf("Not able to read appname from etcd")
+		return err
 	}
 
 	data, err := CfgMgr.ConfigMgr.GetAppConfig()
@@ -185,37 +205,99 @@ func (CfgMgr *ConfigManager) ReadCertKey(keyName string, filePath string) error
 func (CfgMgr *ConfigManager) ReadInfluxDBConnectorConfig() (map[string][]string, error) {
 	influxdbConnCon := make(map[string][]string)
 
-	appName, err := CfgMgr.ConfigMgr.GetAppName()
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return influxdbConnCon, err
+	}
+	if len(config.IgnoreKeys) > 0 {
+		influxdbConnCon["ignoreList"] = config.IgnoreKeys
+	}
+	if len(config.TagKeys) > 0 {
+		influxdbConnCon["tagsList"] = config.TagKeys
+	}
+
+	glog.Infof("Influxdbconnector configs are: %v", influxdbConnCon)
+	return influxdbConnCon, nil
+}
+
+// ReadBackupConfig will read the backup section, nil is returned when the
+// backups are not configured
+func (CfgMgr *ConfigManager) ReadBackupConfig() (*common.BackupConfig, error) {
+	config, err := CfgMgr.Load()
 	if err != nil {
-		glog.Fatalf("Not able to read appname from etcd")
+		return nil, err
 	}
+	return config.Backup, nil
+}
 
-	data, err := CfgMgr.ConfigMgr.GetAppConfig()
+// ReadExportConfig will read the export section, nil is returned when the
+// exports are not configured
+func (CfgMgr *ConfigManager) ReadExportConfig() (*common.ExportConfig, error) {
+	config, err := CfgMgr.Load()
 	if err != nil {
-		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
-		return influxdbConnCon, err
+		return nil, err
 	}
+	return config.Export, nil
+}
 
-	for tags, value := range data {
+// ReadImportConfig will read the import section, nil is returned when the
+// imports are not configured
+func (CfgMgr *ConfigManager) ReadImportConfig() (*common.ImportConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config.Import, nil
+}
 
-		if tags == "ignore_keys" {
-			if value != nil {
-				for _, keys := range value.([]interface{}) {
-					influxdbConnCon["ignoreList"] = append(influxdbConnCon["ignoreList"], fmt.Sprintf("%v", keys))
-				}
-			}
-		}
-		if tags == "tag_keys" {
-			if value != nil {
-				for _, keys := range value.([]interface{}) {
-					influxdbConnCon["tagsList"] = append(influxdbConnCon["tagsList"], fmt.Sprintf("%v", keys))
-				}
-			}
-		}
+// ReadInfluxServerConfig will read the influxdb_server section, the influxd
+// defaults are used when it is absent
+func (CfgMgr *ConfigManager) ReadInfluxServerConfig() (common.InfluxServerConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return common.InfluxServerConfig{}, err
 	}
+	return config.InfluxdbServer, nil
+}
 
-	glog.Infof("Influxdbconnector configs are: %v", influxdbConnCon)
-	return influxdbConnCon, nil
+// ReadDiskQuotaConfig will read the disk_quota section, nil is returned when
+// no quota is configured
+func (CfgMgr *ConfigManager) ReadDiskQuotaConfig() (*common.DiskQuotaConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config.DiskQuota, nil
+}
+
+// ReadMonitoringConfig will read the monitoring section, nil is returned
+// when the metrics are not served
+func (CfgMgr *ConfigManager) ReadMonitoringConfig() (*common.MonitoringConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config.Monitoring, nil
+}
+
+// ReadSelfMonitoringConfig will read the self_monitoring section, nil is
+// returned when the stats are not written into InfluxDB
+func (CfgMgr *ConfigManager) ReadSelfMonitoringConfig() (*common.SelfMonitoringConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config.SelfMonitoring, nil
+}
+
+// ReadTracingConfig will read the tracing section, nil is returned when the
+// traces are not exported
+func (CfgMgr *ConfigManager) ReadTracingConfig() (*common.TracingConfig, error) {
+	config, err := CfgMgr.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config.Tracing, nil
 }
 
 // ReadInfluxDBQueryConfig will read the file
@@ -224,28 +306,17 @@ func (CfgMgr *ConfigManager) ReadInfluxDBQueryConfig() (map[string][]string, err
 
 	influxdbQuerycon := make(map[string][]string)
 
-	appName, err := CfgMgr.ConfigMgr.GetAppName()
-	if err != nil {
-		glog.Fatalf("Not able to read appname from etcd")
-	}
-
-	data, err := CfgMgr.ConfigMgr.GetAppConfig()
+	config, err := CfgMgr.Load()
 	if err != nil {
-		glog.Errorf("Not able to read value from etcd for /%v/config", appName)
 		return influxdbQuerycon, err
 	}
-
-	for tags, value := range data {
-
-		// parsing the config to fetch required value
-		if tags == "blacklist_query" {
-			if value != nil {
-				for _, keys := range value.([]interface{}) {
-					influxdbQuerycon["BlacklistQueryList"] = append(influxdbQuerycon["BlacklistQueryList"], fmt.Sprintf("%v", keys))
-				}
-			}
-		}
+	if len(config.BlacklistQuery) > 0 {
+		influxdbQuerycon["BlacklistQueryList"] = config.BlacklistQuery
+	}
+	if config.QueryStreamTopic != "" {
+		influxdbQuerycon["StreamTopic"] = []string{config.QueryStreamTopic}
 	}
+	influxdbQuerycon["MaxStreams"] = []string{fmt.Sprint(config.QueryMaxStreams)}
 
 	glog.Infof("Successfully read black listed item in query")
 	return influxdbQuerycon, nil
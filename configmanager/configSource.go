@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package configmanager
+
+import (
+	"errors"
+
+	eiicfgmgr "github.com/open-edge-insights/eii-configmgr-go/eiiconfigmgr"
+
+	"github.com/golang/glog"
+)
+
+// InterfaceConfig is the message bus config of a server, publisher or
+// subscriber interface
+type InterfaceConfig interface {
+	GetMsgbusConfig() (map[string]interface{}, error)
+	Destroy()
+}
+
+// TopicConfig is the message bus config of a publisher or subscriber
+// interface along with its topics
+type TopicConfig interface {
+	InterfaceConfig
+	GetTopics() ([]string, error)
+}
+
+// ConfigSource is where the app config and the interfaces are read from,
+// either the EII config manager backed by etcd or a config file
+type ConfigSource interface {
+	GetAppConfig() (map[string]interface{}, error)
+	GetAppName() (string, error)
+	IsDevMode() (bool, error)
+	GetNumPublishers() (int, error)
+	GetPublisherByIndex(index int) (TopicConfig, error)
+	GetNumSubscribers() (int, error)
+	GetSubscriberByIndex(index int) (TopicConfig, error)
+	GetServerByIndex(index int) (InterfaceConfig, error)
+	// Watch will call onChange with the changed key whenever the app
+	// config or the interfaces change
+	Watch(onChange func(key string)) error
+	Destroy()
+}
+
+// etcdSource reads the config through the EII config manager
+type etcdSource struct {
+	*eiicfgmgr.ConfigMgr
+}
+
+// newEtcdSource will create the EII config manager
+func newEtcdSource() (ConfigSource, error) {
+	configMgr, err := eiicfgmgr.ConfigManager()
+	if err != nil {
+		return nil, err
+	}
+	if configMgr == nil {
+		return nil, errors.New("config manager initialization failed")
+	}
+	return &etcdSource{configMgr}, nil
+}
+
+// GetPublisherByIndex will return the config of the publisher at index
+func (source *etcdSource) GetPublisherByIndex(index int) (TopicConfig, error) {
+	pubCtx, err := source.ConfigMgr.GetPublisherByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	return pubCtx, nil
+}
+
+// GetSubscriberByIndex will return the config of the subscriber at index
+func (source *etcdSource) GetSubscriberByIndex(index int) (TopicConfig, error) {
+	subCtx, err := source.ConfigMgr.GetSubscriberByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	return subCtx, nil
+}
+
+// GetServerByIndex will return the config of the server at index
+func (source *etcdSource) GetServerByIndex(index int) (InterfaceConfig, error) {
+	serverCtx, err := source.ConfigMgr.GetServerByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	return serverCtx, nil
+}
+
+// Watch will watch the app config and the interfaces keys in etcd
+func (source *etcdSource) Watch(onChange func(key string)) error {
+	watchObj, err := source.ConfigMgr.GetWatchObj()
+	if err != nil {
+		glog.Errorf("Failed to get the config watch object: %v", err)
+		return err
+	}
+
+	callback := func(key string, value map[string]interface{}, userData interface{}) {
+		onChange(key)
+	}
+	watchObj.WatchConfig(callback, nil)
+	watchObj.WatchInterface(callback, nil)
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package configmanager
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// inRepoRoot will run the test from the repository root, where schema.json
+// is read from
+func inRepoRoot(t *testing.T) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	return func() { os.Chdir(wd) }
+}
+
+func TestParseConfig(t *testing.T) {
+	defer inRepoRoot(t)()
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		check  func(*Config) bool
+		errors []string
+	}{
+		{
+			name: "strings",
+			config: map[string]interface{}{
+				"influxdb": map[string]interface{}{
+					"retention": "1h30m5s", "dbname": "datain", "ssl": "True", "verifySsl": "False", "port": "8086",
+				},
+				"pub_workers":     "3",
+				"sub_workers":     "5",
+				"ignore_keys":     "defects,frame",
+				"blacklist_query": []interface{}{"CREATE", "DROP"},
+			},
+			check: func(c *Config) bool {
+				return c.Influxdb.Port == 8086 && c.Influxdb.Ssl && !c.Influxdb.VerifySsl && c.PubWorkers == 3 &&
+					len(c.IgnoreKeys) == 2 && c.IgnoreKeys[1] == "frame" && c.Influxdb.Backend == "influxdb1"
+			},
+		},
+		{
+			name: "number as a string",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "7d", "dbname": "datain"},
+				"tracing":         map[string]interface{}{"endpoint": "http://collector:4318", "sample_ratio": "0.5"},
+				"blacklist_query": []interface{}{},
+			},
+			check: func(c *Config) bool { return c.Tracing != nil && c.Tracing.SampleRatio == 0.5 },
+		},
+		{
+			name: "defaults",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "7d", "dbname": "datain"},
+				"blacklist_query": []interface{}{},
+			},
+			check: func(c *Config) bool {
+				return c.Influxdb.Port == defaultInfluxPort && c.Influxdb.Ssl && c.Influxdb.VerifySsl &&
+					c.PubWorkers == defaultWorkers && c.SubWorkers == defaultWorkers &&
+					c.QueryMaxStreams == defaultQueryStreams
+			},
+		},
+		{
+			name: "infinite retention",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "INF", "dbname": "datain", "port": 8086.0},
+				"blacklist_query": []interface{}{},
+			},
+			check: func(c *Config) bool { return c.Influxdb.Retention == "INF" },
+		},
+		{
+			name: "short retention",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "30m", "dbname": "datain"},
+				"blacklist_query": []interface{}{},
+			},
+			errors: []string{"influxdb.retention: \"30m\" is shorter than 1h"},
+		},
+		{
+			name: "all problems",
+			config: map[string]interface{}{
+				"influxdb": map[string]interface{}{
+					"retention": "7d", "dbname": "datain", "port": 70000.0,
+					"retention_policies": []interface{}{map[string]interface{}{"name": "raw", "duration": "1y"}},
+				},
+				"sub_workers":       0.0,
+				"query_max_streams": 500.0,
+				"tag_keys":          []interface{}{"station"},
+				"ignore_keys":       []interface{}{"station"},
+				"blacklist_query":   []interface{}{},
+			},
+			errors: []string{
+				"influxdb.port: 70000 is not in 1..65535",
+				"sub_workers: 0 is not in 1..100",
+				"query_max_streams: 500 is not in 1..100",
+				`tag_keys: "station" is also in ignore_keys`,
+				"influxdb.retention_policies[0].duration",
+			},
+		},
+		{
+			name: "wrong types",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "7d", "dbname": "datain", "ssl": "maybe"},
+				"pub_workers":     "five",
+				"blacklist_query": []interface{}{},
+			},
+			errors: []string{"influxdb.ssl: expected true or false", "pub_workers: expected an integer"},
+		},
+		{
+			name: "wrong number",
+			config: map[string]interface{}{
+				"influxdb":        map[string]interface{}{"retention": "7d", "dbname": "datain"},
+				"tracing":         map[string]interface{}{"endpoint": "http://collector:4318", "sample_ratio": "half"},
+				"blacklist_query": []interface{}{},
+			},
+			errors: []string{`tracing.sample_ratio: expected a number, got "half"`},
+		},
+	}
+
+	for _, test := range tests {
+		config, err := ParseConfig(test.config)
+		if len(test.errors) == 0 {
+			if err != nil {
+				t.Errorf("%s: ParseConfig failed: %v", test.name, err)
+			} else if !test.check(config) {
+				t.Errorf("%s: unexpected config %+v", test.name, config)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: ParseConfig succeeded, expected %v", test.name, test.errors)
+			continue
+		}
+		for _, expected := range test.errors {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("%s: error %q does not report %q", test.name, err, expected)
+			}
+		}
+	}
+}
+
+func TestParseConfigWithoutSchema(t *testing.T) {
+	if _, err := ParseConfig(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "schema file not found") {
+		t.Errorf("ParseConfig without schema.json = %v, expected a schema error", err)
+	}
+}
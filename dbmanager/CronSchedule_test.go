@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC) // a Monday
+	tests := []struct {
+		spec    string
+		invalid bool
+		next    time.Time
+	}{
+		{spec: "* * * * *", next: time.Date(2026, 10, 19, 10, 31, 0, 0, time.UTC)},
+		{spec: "0 2 * * *", next: time.Date(2026, 10, 20, 2, 0, 0, 0, time.UTC)},
+		{spec: "@daily", next: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{spec: "@hourly", next: time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)},
+		{spec: "*/15 * * * *", next: time.Date(2026, 10, 19, 10, 45, 0, 0, time.UTC)},
+		{spec: "0 9-17/4 * * *", next: time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", next: time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 1,15 * *", next: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		// A restricted day of month and day of week match either
+		{spec: "0 0 1 * 3", next: time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", next: time.Time{}},
+		{spec: "0 0 * *", invalid: true},
+		{spec: "60 * * * *", invalid: true},
+		{spec: "* 24 * * *", invalid: true},
+		{spec: "5-1 * * * *", invalid: true},
+		{spec: "*/0 * * * *", invalid: true},
+		{spec: "a * * * *", invalid: true},
+		{spec: "@yearly", invalid: true},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseCron(%q) succeeded, expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCron(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if next := schedule.next(from); !next.Equal(test.next) {
+			t.Errorf("parseCron(%q).next(%v) = %v, expected %v", test.spec, from, next, test.next)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+const (
+	defaultBackupDir         = "/influxdata/backup"
+	defaultBackupGenerations = 7
+	defaultBackupFullEvery   = 7
+	backupRPCPort            = "8088"
+	backupTimeFormat         = "20060102T150405Z"
+	backupGenPrefix          = "gen-"
+	backupTmpPrefix          = ".tmp-"
+	backupFull               = "full"
+	backupIncremental        = "incremental"
+	// backupFullMarker in the backup directory makes the next backup a
+	// full one
+	backupFullMarker = ".full-required"
+)
+
+// BackupInfo structure
+type BackupInfo struct {
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	Type       string `json:"type"`
+	Time       string `json:"time"`
+	Size       int64  `json:"size"`
+	Path       string `json:"-"`
+}
+
+// InfluxBackup structure runs the portable backups of InfluxDB on schedule
+// and on request
+type InfluxBackup struct {
+	DbInfo common.DbCredential
+	CnInfo common.AppConfig
+	Config common.BackupConfig
+
+	// OnRestore is called once a backup has been restored to re-create the
+	// subscriptions and continuous queries
+	OnRestore func() error
+
+	schedule *cronSchedule
+	mutex    sync.Mutex
+	running  string
+	lastErr  string
+	done     chan struct{}
+	// jobs are the backups and restores running in the background
+	jobs sync.WaitGroup
+}
+
+// Init will apply the defaults, validate the config and create the backup
+// directory
+func (ib *InfluxBackup) Init() error {
+	if ib.DbInfo.DryRun || ib.DbInfo.Backend == BackendInfluxDB2 {
+		return errors.New("backups are supported only with an influxdb1 backend")
+	}
+
+	if ib.Config.Directory == "" {
+		ib.Config.Directory = defaultBackupDir
+	}
+	if ib.Config.Generations <= 0 {
+		ib.Config.Generations = defaultBackupGenerations
+	}
+	if ib.Config.FullEvery <= 0 {
+		ib.Config.FullEvery = defaultBackupFullEvery
+	}
+	if ib.Config.Host == "" {
+		ib.Config.Host = "127.0.0.1:" + backupRPCPort
+		if ib.DbInfo.External {
+			ib.Config.Host = ib.DbInfo.Host + ":" + backupRPCPort
+		}
+	}
+
+	if ib.Config.Schedule != "" {
+		schedule, err := parseCron(ib.Config.Schedule)
+		if err != nil {
+			return err
+		}
+		ib.schedule = schedule
+	}
+
+	ib.done = make(chan struct{})
+	return os.MkdirAll(ib.Config.Directory, 0750)
+}
+
+// Run will back up InfluxDB as per the schedule until Stop is called
+func (ib *InfluxBackup) Run() {
+	if ib.schedule == nil {
+		glog.Infof("No backup schedule, backups run only on request")
+		return
+	}
+
+	ib.mutex.Lock()
+	done := ib.done
+	ib.mutex.Unlock()
+	for {
+		next := ib.schedule.next(time.Now())
+		if next.IsZero() {
+			glog.Errorf("Backup schedule %q never matches", ib.Config.Schedule)
+			return
+		}
+		glog.Infof("Next backup at %v", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := ib.Trigger(); err != nil {
+			glog.Errorf("Scheduled backup skipped: %v", err)
+		}
+	}
+}
+
+// Stop will stop the scheduled backups, a running backup or restore is
+// completed
+func (ib *InfluxBackup) Stop() {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	if ib.done != nil {
+		close(ib.done)
+		ib.done = nil
+	}
+}
+
+// Wait will wait for the running backup or restore, until the deadline of ctx
+func (ib *InfluxBackup) Wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		ib.jobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Trigger will start a backup in the background and return its name, only
+// one backup or restore runs at a time
+func (ib *InfluxBackup) Trigger() (string, error) {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	if ib.running != "" {
+		return "", errors.New(ib.running + " is already running")
+	}
+
+	backups, err := ib.List()
+	if err != nil {
+		return "", err
+	}
+	marker := filepath.Join(ib.Config.Directory, backupFullMarker)
+	_, err = os.Stat(marker)
+	fullRequired := err == nil
+	info, since := ib.nextBackup(backups, time.Now().UTC(), fullRequired)
+	if fullRequired {
+		// Data backfilled while the backup runs requires the next one
+		os.Remove(marker)
+	}
+	ib.running = info.Name
+	ib.jobs.Add(1)
+	go func() {
+		defer ib.jobs.Done()
+		ib.run(info, since, fullRequired)
+	}()
+	return info.Name, nil
+}
+
+// RequireFull will make the next backup a full one. The incremental backups
+// select the points by timestamp since the last backup, so points written
+// with older timestamps, like the imported ones, would be missed.
+func (ib *InfluxBackup) RequireFull() {
+	marker := filepath.Join(ib.Config.Directory, backupFullMarker)
+	if err := ioutil.WriteFile(marker, nil, 0640); err != nil {
+		glog.Errorf("Failed to require a full backup: %v", err)
+	}
+}
+
+// Status will return the name of the running backup or restore and the
+// error of the last failed one
+func (ib *InfluxBackup) Status() (string, string) {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	return ib.running, ib.lastErr
+}
+
+// nextBackup will decide between a full backup starting a new generation and
+// an incremental one since the last backup of the current generation
+func (ib *InfluxBackup) nextBackup(backups []BackupInfo, now time.Time, fullRequired bool) (BackupInfo, string) {
+	info := BackupInfo{
+		Name:       now.Format(backupTimeFormat) + "-" + backupFull,
+		Generation: backupGenPrefix + now.Format(backupTimeFormat),
+		Type:       backupFull,
+		Time:       now.Format(time.RFC3339),
+	}
+	if !ib.Config.Incremental || len(backups) == 0 || fullRequired {
+		return info, ""
+	}
+
+	last := backups[len(backups)-1]
+	count := 0
+	for _, backup := range backups {
+		if backup.Generation == last.Generation {
+			count++
+		}
+	}
+	if count >= ib.Config.FullEvery {
+		return info, ""
+	}
+
+	info.Name = now.Format(backupTimeFormat) + "-" + backupIncremental
+	info.Generation = last.Generation
+	info.Type = backupIncremental
+	return info, last.Time
+}
+
+func (ib *InfluxBackup) run(info BackupInfo, since string, fullRequired bool) {
+	err := ib.backup(info, since)
+	if err != nil && fullRequired {
+		ib.RequireFull()
+	}
+
+	ib.mutex.Lock()
+	ib.running = ""
+	ib.lastErr = ""
+	if err != nil {
+		ib.lastErr = info.Name + ": " + err.Error()
+	}
+	ib.mutex.Unlock()
+
+	if err != nil {
+		glog.Errorf("Backup %s failed: %v", info.Name, err)
+		return
+	}
+	glog.Infof("Backup %s completed", info.Name)
+
+	if err := ib.prune(); err != nil {
+		glog.Errorf("Failed to remove old backups: %v", err)
+	}
+}
+
+// backup will run influxd backup into a temporary directory renamed once
+// the backup is complete
+func (ib *InfluxBackup) backup(info BackupInfo, since string) error {
+	genDir := filepath.Join(ib.Config.Directory, info.Generation)
+	if err := os.MkdirAll(genDir, 0750); err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(genDir, backupTmpPrefix+info.Name)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+
+	args := []string{"backup", "-portable", "-host", ib.Config.Host}
+	if since != "" {
+		args = append(args, "-start", since)
+	}
+	args = append(args, tmpDir)
+
+	glog.Infof("Running %s backup %s", info.Type, info.Name)
+	output, err := exec.Command(influxdBinary, args...).CombinedOutput()
+	if err != nil {
+		glog.Errorf("influxd backup output: %s", strings.TrimSpace(string(output)))
+		os.RemoveAll(tmpDir)
+		if info.Type == backupFull {
+			os.Remove(genDir)
+		}
+		return err
+	}
+	glog.V(1).Infof("influxd backup output: %s", output)
+
+	return os.Rename(tmpDir, filepath.Join(genDir, info.Name))
+}
+
+// List will return the completed backups, oldest first
+func (ib *InfluxBackup) List() ([]BackupInfo, error) {
+	generations, err := ioutil.ReadDir(ib.Config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, gen := range generations {
+		if !gen.IsDir() || !strings.HasPrefix(gen.Name(), backupGenPrefix) {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(ib.Config.Directory, gen.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			parts := strings.SplitN(entry.Name(), "-", 2)
+			if !entry.IsDir() || len(parts) != 2 || (parts[1] != backupFull && parts[1] != backupIncremental) {
+				continue
+			}
+			backupTime, err := time.Parse(backupTimeFormat, parts[0])
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(ib.Config.Directory, gen.Name(), entry.Name())
+			backups = append(backups, BackupInfo{
+				Name:       entry.Name(),
+				Generation: gen.Name(),
+				Type:       parts[1],
+				Time:       backupTime.Format(time.RFC3339),
+				Size:       dirSize(path),
+				Path:       path,
+			})
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name < backups[j].Name
+	})
+	return backups, nil
+}
+
+// prune will remove the oldest generations beyond the configured number
+func (ib *InfluxBackup) prune() error {
+	entries, err := ioutil.ReadDir(ib.Config.Directory)
+	if err != nil {
+		return err
+	}
+
+	var generations []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), backupGenPrefix) {
+			generations = append(generations, entry.Name())
+		}
+	}
+	sort.Strings(generations)
+
+	for len(generations) > ib.Config.Generations {
+		glog.Infof("Removing backup generation %s", generations[0])
+		if err := os.RemoveAll(filepath.Join(ib.Config.Directory, generations[0])); err != nil {
+			return err
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// errBackupDisabled is returned by the backup requests when the backups are
+// not configured
+var errBackupDisabled = errors.New("Backups are not configured")
+
+// errAdminOpsDisabled is returned by the backup and restore requests unless
+// admin_ops is set in the backup section
+var errAdminOpsDisabled = errors.New("Backup and restore requests are disabled, set admin_ops in the backup section")
+
+// TriggerBackup will start a backup and return its name
+func (iq *InfluxQuery) TriggerBackup() (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Backup == nil {
+		return val, errBackupDisabled
+	}
+	if !iq.Backup.Config.AdminOps {
+		return val, errAdminOpsDisabled
+	}
+
+	name, err := iq.Backup.Trigger()
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": "", "Backup": name}, nil), nil
+}
+
+// ListBackups will return the completed backups along with the running one
+// and the last error
+func (iq *InfluxQuery) ListBackups() (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Backup == nil {
+		return val, errBackupDisabled
+	}
+
+	backups, err := iq.Backup.List()
+	if err != nil {
+		return val, err
+	}
+	if backups == nil {
+		backups = []BackupInfo{}
+	}
+	output, err := json.Marshal(backups)
+	if err != nil {
+		return val, err
+	}
+
+	running, lastErr := iq.Backup.Status()
+	return types.NewMsgEnvelope(map[string]interface{}{
+		"Data":      string(output),
+		"Running":   running,
+		"LastError": lastErr,
+	}, nil), nil
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"encoding/json"
+	"sort"
+
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+// RetentionPolicyInfo structure
+type RetentionPolicyInfo struct {
+	Name               string `json:"name"`
+	Duration           string `json:"duration"`
+	ShardGroupDuration string `json:"shard_group_duration"`
+	ReplicaN           int64  `json:"replica_n"`
+	Default            bool   `json:"default"`
+}
+
+// MeasurementInfo structure
+type MeasurementInfo struct {
+	Name    string            `json:"name"`
+	Fields  map[string]string `json:"fields"`
+	TagKeys []string          `json:"tag_keys"`
+	Topics  []string          `json:"topics"`
+}
+
+// DatabaseInfo structure
+type DatabaseInfo struct {
+	Database          string                `json:"database"`
+	RetentionPolicies []RetentionPolicyInfo `json:"retention_policies"`
+	Measurements      []MeasurementInfo     `json:"measurements"`
+	SubscriberTopics  map[string]string     `json:"subscriber_topics"`
+}
+
+// Describe will return a single document describing the measurements,
+// fields, tags and retention policies of the configured database along with
+// the subscriber topics writing to each measurement
+func (iq *InfluxQuery) Describe() (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+
+	store, err := NewTimeSeriesStore(iq.DbInfo, iq.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("client error %s", err)
+		return val, err
+	}
+	defer store.Close()
+
+	dbInfo, err := iq.describeDatabase(store)
+	if err != nil {
+		glog.Errorf("Failed to describe database %s: %v", iq.DbInfo.Database, err)
+		return val, err
+	}
+
+	output, err := json.Marshal(dbInfo)
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil), err
+}
+
+func (iq *InfluxQuery) describeDatabase(store TimeSeriesStore) (*DatabaseInfo, error) {
+	dbInfo := &DatabaseInfo{
+		Database:          iq.DbInfo.Database,
+		RetentionPolicies: []RetentionPolicyInfo{},
+		Measurements:      []MeasurementInfo{},
+		SubscriberTopics:  make(map[string]string),
+	}
+
+	policies, err := iq.showSeries(store, "SHOW RETENTION POLICIES ON \""+iq.DbInfo.Database+"\"")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range policies {
+		for _, value := range row.Values {
+			var rp RetentionPolicyInfo
+			for i, column := range row.Columns {
+				if i >= len(value) {
+					break
+				}
+				switch column {
+				case "name":
+					rp.Name = toString(value[i])
+				case "duration":
+					rp.Duration = toString(value[i])
+				case "shardGroupDuration":
+					rp.ShardGroupDuration = toString(value[i])
+				case "replicaN":
+					rp.ReplicaN, _ = toInt64(value[i])
+				case "default":
+					rp.Default, _ = value[i].(bool)
+				}
+			}
+			dbInfo.RetentionPolicies = append(dbInfo.RetentionPolicies, rp)
+		}
+	}
+
+	measurements, err := iq.showSeries(store, "SHOW MEASUREMENTS")
+	if err != nil {
+		return nil, err
+	}
+	fieldKeys, err := iq.showSeries(store, "SHOW FIELD KEYS")
+	if err != nil {
+		return nil, err
+	}
+	tagKeys, err := iq.showSeries(store, "SHOW TAG KEYS")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := showResult(showFieldKeys, fieldKeys)["field_keys"].(map[string]map[string]string)
+	tags := showResult(showTagKeys, tagKeys)["tag_keys"].(map[string][]string)
+
+	// Data received on a subscriber topic is written to the measurement
+	// with the same name as the topic
+	topics := make(map[string][]string)
+	for _, topic := range iq.subscriberTopics() {
+		dbInfo.SubscriberTopics[topic] = topic
+		topics[topic] = append(topics[topic], topic)
+	}
+
+	for _, name := range showResult(showMeasurements, measurements)["measurements"].([]string) {
+		measurement := MeasurementInfo{
+			Name:    name,
+			Fields:  fields[name],
+			TagKeys: tags[name],
+			Topics:  topics[name],
+		}
+		if measurement.Fields == nil {
+			measurement.Fields = make(map[string]string)
+		}
+		if measurement.TagKeys == nil {
+			measurement.TagKeys = []string{}
+		}
+		if measurement.Topics == nil {
+			measurement.Topics = []string{}
+		}
+		dbInfo.Measurements = append(dbInfo.Measurements, measurement)
+	}
+	sort.Slice(dbInfo.Measurements, func(i, j int) bool {
+		return dbInfo.Measurements[i].Name < dbInfo.Measurements[j].Name
+	})
+
+	return dbInfo, nil
+}
+
+// showSeries will run the statement on the configured database and return
+// the series of all the results
+func (iq *InfluxQuery) showSeries(store TimeSeriesStore, command string) ([]models.Row, error) {
+	return store.Query(StoreQuery{
+		Command:  command,
+		Database: iq.DbInfo.Database,
+	})
+}
@@ -0,0 +1,498 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+const (
+	quotaDropShards          = "drop_shards"
+	quotaShortenRetention    = "shorten_retention"
+	defaultDiskCheckInterval = time.Minute
+	// defaultMinRetention is also the lowest retention InfluxDB accepts
+	defaultMinRetention = time.Hour
+	diskQuotaEvent      = "disk_quota_exceeded"
+	// retentionEnforcePeriod is the check-interval of the retention service
+	// of influxd, the data past a shortened retention is only dropped then
+	retentionEnforcePeriod = 30 * time.Minute
+)
+
+var byteSizePattern = regexp.MustCompile(`^(?i)\s*([0-9]+(?:\.[0-9]+)?)\s*([kmgt]i?b?|b)?\s*$`)
+
+// DiskUsage structure
+type DiskUsage struct {
+	DataDir    string `json:"data_dir"`
+	WalDir     string `json:"wal_dir"`
+	DataBytes  int64  `json:"data_bytes"`
+	WalBytes   int64  `json:"wal_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	QuotaBytes int64  `json:"quota_bytes"`
+	Exceeded   bool   `json:"exceeded"`
+	Time       string `json:"time"`
+}
+
+// InfluxDiskMonitor structure measures the data and wal directories of
+// influxd and enforces the disk quota on the database
+type InfluxDiskMonitor struct {
+	DbInfo common.DbCredential
+	CnInfo common.AppConfig
+	Config common.DiskQuotaConfig
+	// Events publishes the quota warnings on Config.EventTopic
+	Events common.TopicPublisher
+
+	quota        int64
+	interval     time.Duration
+	minRetention time.Duration
+	mutex        sync.Mutex
+	usage        DiskUsage
+	done         chan struct{}
+	// lastShortened is the time of the last shortening of the retention,
+	// only used by the checks
+	lastShortened time.Time
+}
+
+// Init will validate the quota config and read the directories of influxd
+// from its config file
+func (dm *InfluxDiskMonitor) Init() error {
+	if dm.DbInfo.External || dm.DbInfo.DryRun {
+		return errors.New("the disk usage is only monitored for the local influxd")
+	}
+	if err := dm.parseConfig(); err != nil {
+		return err
+	}
+
+	dm.usage.DataDir, dm.usage.WalDir = readInfluxDirs(influxConfPath)
+	dm.usage.QuotaBytes = dm.quota
+	dm.done = make(chan struct{})
+	return nil
+}
+
+// parseConfig will check the disk quota settings, also run by
+// ValidateConfig
+func (dm *InfluxDiskMonitor) parseConfig() error {
+	var err error
+	if dm.Config.Quota != "" {
+		dm.quota, err = parseByteSize(dm.Config.Quota)
+		if err != nil || dm.quota <= 0 {
+			return errors.New("invalid disk quota " + dm.Config.Quota)
+		}
+	}
+	if dm.Config.Action == "" {
+		dm.Config.Action = quotaDropShards
+	}
+	if dm.Config.Action != quotaDropShards && dm.Config.Action != quotaShortenRetention {
+		return errors.New("invalid disk quota action " + dm.Config.Action)
+	}
+	dm.interval = defaultDiskCheckInterval
+	if dm.Config.CheckInterval != "" {
+		dm.interval, err = time.ParseDuration(dm.Config.CheckInterval)
+		if err != nil || dm.interval <= 0 {
+			return errors.New("invalid disk quota check_interval " + dm.Config.CheckInterval)
+		}
+	}
+	dm.minRetention = defaultMinRetention
+	if dm.Config.MinRetention != "" {
+		dm.minRetention, err = common.ParseInfluxDuration(dm.Config.MinRetention)
+		if err != nil || dm.minRetention < defaultMinRetention {
+			return errors.New("invalid disk quota min_retention " + dm.Config.MinRetention)
+		}
+	}
+	return nil
+}
+
+// Run will check the disk usage every check interval until Stop is called
+func (dm *InfluxDiskMonitor) Run() {
+	dm.mutex.Lock()
+	done := dm.done
+	dm.mutex.Unlock()
+
+	ticker := time.NewTicker(dm.interval)
+	defer ticker.Stop()
+	for {
+		dm.check()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop will stop the disk usage checks
+func (dm *InfluxDiskMonitor) Stop() {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.done != nil {
+		close(dm.done)
+		dm.done = nil
+	}
+}
+
+// Usage will return the last measured disk usage
+func (dm *InfluxDiskMonitor) Usage() DiskUsage {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.usage
+}
+
+func (dm *InfluxDiskMonitor) check() {
+	dm.mutex.Lock()
+	usage := dm.usage
+	dm.mutex.Unlock()
+
+	usage.DataBytes = dirSize(usage.DataDir)
+	usage.WalBytes = dirSize(usage.WalDir)
+	usage.TotalBytes = usage.DataBytes + usage.WalBytes
+	usage.Exceeded = dm.quota > 0 && usage.TotalBytes > dm.quota
+	usage.Time = time.Now().UTC().Format(time.RFC3339)
+
+	dm.mutex.Lock()
+	dm.usage = usage
+	dm.mutex.Unlock()
+
+	if !usage.Exceeded {
+		return
+	}
+	glog.Warningf("Disk usage of influxdb %d bytes exceeds the quota of %d bytes", usage.TotalBytes, dm.quota)
+
+	action, err := dm.enforce()
+	if err != nil {
+		glog.Errorf("Failed to enforce the disk quota: %v", err)
+	} else {
+		glog.Infof("Disk quota enforced: %s", action)
+	}
+	dm.publish(usage, action, err)
+}
+
+// publish will send the quota warning event on the event topic
+func (dm *InfluxDiskMonitor) publish(usage DiskUsage, action string, enforceErr error) {
+	if dm.Config.EventTopic == "" || dm.Events == nil {
+		return
+	}
+	event := map[string]interface{}{
+		"event":       diskQuotaEvent,
+		"database":    dm.DbInfo.Database,
+		"data_bytes":  usage.DataBytes,
+		"wal_bytes":   usage.WalBytes,
+		"total_bytes": usage.TotalBytes,
+		"quota_bytes": usage.QuotaBytes,
+		"action":      action,
+		"time":        usage.Time,
+	}
+	if enforceErr != nil {
+		event["error"] = enforceErr.Error()
+	}
+	if err := dm.Events.Publish(dm.Config.EventTopic, event); err != nil {
+		glog.Errorf("Failed to publish the disk quota event: %v", err)
+	}
+}
+
+// enforce will free the disk space with the configured action and return
+// what was done
+func (dm *InfluxDiskMonitor) enforce() (string, error) {
+	store, err := NewTimeSeriesStore(dm.DbInfo, dm.CnInfo.DevMode)
+	if err != nil {
+		return "", err
+	}
+	defer store.Close()
+
+	if dm.Config.Action == quotaShortenRetention {
+		return dm.shortenRetention(store)
+	}
+	return dm.dropOldestShard(store)
+}
+
+// shardInfo structure
+type shardInfo struct {
+	id              int64
+	retentionPolicy string
+	start           time.Time
+	end             time.Time
+}
+
+// showShards will return the shards of the database oldest first
+func showShards(store TimeSeriesStore, database string) ([]shardInfo, error) {
+	series, err := store.Query(StoreQuery{Command: "SHOW SHARDS"})
+	if err != nil {
+		return nil, err
+	}
+
+	var shards []shardInfo
+	for _, row := range series {
+		if row.Name != database {
+			continue
+		}
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			var shard shardInfo
+			shard.id, _ = toInt64(record["id"])
+			shard.retentionPolicy = toString(record["retention_policy"])
+			shard.start, _ = time.Parse(time.RFC3339, toString(record["start_time"]))
+			shard.end, _ = time.Parse(time.RFC3339, toString(record["end_time"]))
+			shards = append(shards, shard)
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].start.Before(shards[j].start) })
+	return shards, nil
+}
+
+// defaultRetentionPolicy will return the default retention policy of the
+// database
+func defaultRetentionPolicy(store TimeSeriesStore, database string) (string, retentionInfo, error) {
+	policies, err := showRetentionPolicies(store, database)
+	if err != nil {
+		return "", retentionInfo{}, err
+	}
+	for name, info := range policies {
+		if info.isDefault {
+			return name, info, nil
+		}
+	}
+	return "", retentionInfo{}, errors.New("no default retention policy on " + database)
+}
+
+// dropOldestShard will drop the oldest shard of the default retention policy,
+// keeping the rollups of the other ones, or delete the designated
+// measurements in the oldest shard holding them. The shard being written to
+// is never touched.
+func (dm *InfluxDiskMonitor) dropOldestShard(store TimeSeriesStore) (string, error) {
+	database := dm.DbInfo.Database
+	shards, err := showShards(store, database)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	if len(dm.Config.Measurements) == 0 {
+		policy, _, err := defaultRetentionPolicy(store, database)
+		if err != nil {
+			return "", err
+		}
+		var oldest *shardInfo
+		for i := range shards {
+			if shards[i].retentionPolicy == policy {
+				oldest = &shards[i]
+				break
+			}
+		}
+		if oldest == nil || oldest.end.After(now) {
+			return "", errors.New("no shard older than the current one to drop in " + database + "." + policy)
+		}
+		shard := *oldest
+		_, err = store.Query(StoreQuery{Command: "DROP SHARD " + strconv.FormatInt(shard.id, 10)})
+		if err != nil {
+			return "", err
+		}
+		return "dropped shard " + strconv.FormatInt(shard.id, 10) + " of " + database + "." +
+			shard.retentionPolicy + " starting " + shard.start.Format(time.RFC3339), nil
+	}
+
+	oldest, err := dm.oldestPoint(store)
+	if err != nil {
+		return "", err
+	}
+	for _, shard := range shards {
+		if oldest.Before(shard.start) || !oldest.Before(shard.end) {
+			continue
+		}
+		if shard.end.After(now) {
+			break
+		}
+		end := shard.end.Format(time.RFC3339)
+		for _, measurement := range dm.Config.Measurements {
+			_, err = store.Query(StoreQuery{
+				Command:  "DELETE FROM " + quoteIdent(measurement) + " WHERE time < '" + end + "'",
+				Database: database,
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		return "deleted " + strings.Join(dm.Config.Measurements, ",") + " before " + end, nil
+	}
+	return "", errors.New("no data of " + strings.Join(dm.Config.Measurements, ",") +
+		" older than the current shard in " + database)
+}
+
+// oldestPoint will return the time of the oldest point of the designated
+// measurements
+func (dm *InfluxDiskMonitor) oldestPoint(store TimeSeriesStore) (time.Time, error) {
+	var oldest time.Time
+	for _, measurement := range dm.Config.Measurements {
+		series, err := store.Query(StoreQuery{
+			Command:  "SELECT * FROM " + quoteIdent(measurement) + " ORDER BY time ASC LIMIT 1",
+			Database: dm.DbInfo.Database,
+		})
+		if err != nil {
+			return oldest, err
+		}
+		for _, row := range series {
+			for _, values := range row.Values {
+				pointTime, err := time.Parse(time.RFC3339Nano, toString(rowRecord(row, values)["time"]))
+				if err == nil && (oldest.IsZero() || pointTime.Before(oldest)) {
+					oldest = pointTime
+				}
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return oldest, errors.New("no data of " + strings.Join(dm.Config.Measurements, ","))
+	}
+	return oldest, nil
+}
+
+// shortenRetention will halve the duration of the default retention policy,
+// an infinite retention is first set to half the age of the oldest shard. It
+// is not shortened again before influxd enforced the last shortening.
+func (dm *InfluxDiskMonitor) shortenRetention(store TimeSeriesStore) (string, error) {
+	if wait := retentionEnforcePeriod - time.Since(dm.lastShortened); wait > 0 {
+		return "waiting " + wait.Truncate(time.Second).String() + " for the last shortened retention to be enforced", nil
+	}
+
+	database := dm.DbInfo.Database
+	name, info, err := defaultRetentionPolicy(store, database)
+	if err != nil {
+		return "", err
+	}
+
+	current := info.duration
+	if current == 0 {
+		shards, err := showShards(store, database)
+		if err != nil {
+			return "", err
+		}
+		if len(shards) == 0 {
+			return "", errors.New("no shards in " + database)
+		}
+		current = time.Since(shards[0].start)
+	}
+	duration := current / 2
+	if duration < dm.minRetention {
+		duration = dm.minRetention
+	}
+	if duration < info.shardDuration {
+		duration = info.shardDuration
+	}
+	duration = duration.Truncate(time.Hour)
+	if info.duration != 0 && duration >= info.duration {
+		return "", errors.New("retention of " + database + "." + name + " is already at its minimum " + info.duration.String())
+	}
+
+	literal := strconv.FormatInt(int64(duration/time.Hour), 10) + "h"
+	_, err = store.Query(StoreQuery{
+		Command:  "ALTER RETENTION POLICY " + quoteIdent(name) + " ON " + quoteIdent(database) + " DURATION " + literal,
+		Database: database,
+	})
+	if err != nil {
+		return "", err
+	}
+	dm.lastShortened = time.Now()
+	return "shortened retention of " + database + "." + name + " to " + literal, nil
+}
+
+// readInfluxDirs will read the data and wal directories from the [data]
+// section of the influxd config, the defaults are returned when missing
+func readInfluxDirs(confPath string) (string, string) {
+	dataDir, walDir := influxDataDir, influxWalDir
+	file, err := os.Open(confPath)
+	if err != nil {
+		glog.Warningf("Failed to read %s, using the default directories: %v", confPath, err)
+		return dataDir, walDir
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[] ")
+			continue
+		}
+		if section != "data" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		switch strings.TrimSpace(parts[0]) {
+		case "dir":
+			dataDir = value
+		case "wal-dir":
+			walDir = value
+		}
+	}
+	return dataDir, walDir
+}
+
+// parseByteSize will parse sizes like 500MB or 20GiB, units are powers of
+// 1024
+func parseByteSize(value string) (int64, error) {
+	match := byteSizePattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, errors.New("invalid size " + strconv.Quote(value))
+	}
+	size, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := strings.ToLower(match[2])
+	if unit != "" && unit != "b" {
+		size *= float64(int64(1) << (10 * uint(strings.Index("kmgt", unit[:1])+1)))
+	}
+	return int64(size), nil
+}
+
+// DiskUsage will return the last measured disk usage of influxd
+func (iq *InfluxQuery) DiskUsage() (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Disk == nil {
+		return val, errors.New("Disk monitoring is not configured")
+	}
+
+	output, err := json.Marshal(iq.Disk.Usage())
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil), nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		size    int64
+		invalid bool
+	}{
+		{value: "1024", size: 1024},
+		{value: "10B", size: 10},
+		{value: "1k", size: 1 << 10},
+		{value: "500MB", size: 500 << 20},
+		{value: "20GB", size: 20 << 30},
+		{value: "20GiB", size: 20 << 30},
+		{value: "1.5gb", size: 3 << 29},
+		{value: " 2 TB ", size: 2 << 40},
+		{value: "", invalid: true},
+		{value: "MB", invalid: true},
+		{value: "-1GB", invalid: true},
+		{value: "10PB", invalid: true},
+		{value: "10 GB free", invalid: true},
+	}
+
+	for _, test := range tests {
+		size, err := parseByteSize(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %d, expected an error", test.value, size)
+			}
+			continue
+		}
+		if err != nil || size != test.size {
+			t.Errorf("parseByteSize(%q) = %d, %v, expected %d", test.value, size, err, test.size)
+		}
+	}
+}
@@ -0,0 +1,744 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+const (
+	defaultExportDir    = "/influxdata/export"
+	defaultExportWindow = time.Hour
+	exportFormatLP      = "lp"
+	exportFormatCSV     = "csv"
+	exportFormatParquet = "parquet"
+	exportRunning       = "running"
+	exportCompleted     = "completed"
+	exportFailed        = "failed"
+	exportInterrupted   = "interrupted"
+)
+
+var exportIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// errExportStopped is returned by the exports stopped by Stop
+var errExportStopped = errors.New("export stopped by the shutdown")
+
+// ExportRequest structure
+type ExportRequest struct {
+	// Measurements to export, all the measurements when empty
+	Measurements []string          `json:"measurements"`
+	Start        string            `json:"start"`
+	End          string            `json:"end"`
+	Tags         map[string]string `json:"tags"`
+	Format       string            `json:"format"`
+	Compress     bool              `json:"compress"`
+}
+
+// ExportProgress structure is the progress of the export of a measurement
+type ExportProgress struct {
+	Measurement string            `json:"measurement"`
+	File        string            `json:"file"`
+	Tags        []string          `json:"tags"`
+	Fields      map[string]string `json:"fields"`
+	// Checkpoint is the end of the last exported window and Offset the size
+	// of the file at that time
+	Checkpoint time.Time `json:"checkpoint"`
+	Offset     int64     `json:"offset"`
+	Rows       int64     `json:"rows"`
+	// RowGroups are the row groups written so far in a Parquet file
+	RowGroups []ParquetRowGroup `json:"row_groups,omitempty"`
+}
+
+// ExportJob structure is saved next to the exported files to report the
+// progress and resume the export
+type ExportJob struct {
+	ID           string            `json:"id"`
+	Request      ExportRequest     `json:"request"`
+	Status       string            `json:"status"`
+	Error        string            `json:"error,omitempty"`
+	Progress     float64           `json:"progress"`
+	Measurements []*ExportProgress `json:"measurements"`
+}
+
+// InfluxExport structure exports measurements to files
+type InfluxExport struct {
+	DbInfo common.DbCredential
+	CnInfo common.AppConfig
+	Config common.ExportConfig
+
+	window  time.Duration
+	mutex   sync.Mutex
+	running map[string]bool
+	stopped bool
+	// jobs are the exports running in the background
+	jobs sync.WaitGroup
+}
+
+// Init will apply the defaults, create the export directory and mark the
+// exports stopped by a restart as interrupted
+func (ie *InfluxExport) Init() error {
+	if ie.Config.Directory == "" {
+		ie.Config.Directory = defaultExportDir
+	}
+	err := ie.parseConfig()
+	if err != nil {
+		return err
+	}
+	ie.running = make(map[string]bool)
+
+	err = os.MkdirAll(ie.Config.Directory, 0750)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := ie.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Status == exportRunning {
+			job.Status = exportInterrupted
+			if err := ie.save(job); err != nil {
+				glog.Errorf("Failed to update export %s: %v", job.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConfig will check the export settings, also run by ValidateConfig
+func (ie *InfluxExport) parseConfig() error {
+	ie.window = defaultExportWindow
+	if ie.Config.Window != "" {
+		window, err := common.ParseInfluxDuration(ie.Config.Window)
+		if err != nil || window <= 0 {
+			return errors.New("invalid export window " + ie.Config.Window)
+		}
+		ie.window = window
+	}
+	return nil
+}
+
+// Start will validate the request and start the export in the background
+func (ie *InfluxExport) Start(req ExportRequest) (*ExportJob, error) {
+	if req.Format == "" {
+		req.Format = exportFormatLP
+	}
+	switch req.Format {
+	case exportFormatLP, exportFormatCSV, exportFormatParquet:
+	default:
+		return nil, errors.New("unknown export format " + req.Format)
+	}
+
+	start, end, err := exportRange(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.End == "" {
+		req.End = end.Format(time.RFC3339Nano)
+	}
+
+	store, err := NewTimeSeriesStore(ie.DbInfo, ie.CnInfo.DevMode)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if len(req.Measurements) == 0 {
+		series, err := store.Query(StoreQuery{Command: "SHOW MEASUREMENTS", Database: ie.DbInfo.Database})
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range series {
+			for _, values := range row.Values {
+				req.Measurements = append(req.Measurements, toString(values[0]))
+			}
+		}
+		if len(req.Measurements) == 0 {
+			return nil, errors.New("no measurement to export")
+		}
+	}
+
+	job := &ExportJob{
+		ID:      exportID(time.Now().UTC()),
+		Request: req,
+		Status:  exportRunning,
+	}
+	for _, measurement := range req.Measurements {
+		progress, err := ie.exportSchema(store, measurement)
+		if err != nil {
+			return nil, err
+		}
+		progress.File = job.ID + "/" + exportFileName(measurement, req)
+		progress.Checkpoint = start
+		job.Measurements = append(job.Measurements, progress)
+	}
+
+	if _, err := os.Stat(ie.jobPath(job.ID)); err == nil {
+		return nil, errors.New("export " + job.ID + " already exists, retry later")
+	}
+	err = os.MkdirAll(filepath.Join(ie.Config.Directory, job.ID), 0750)
+	if err != nil {
+		return nil, err
+	}
+	return job, ie.launch(job)
+}
+
+// Resume will continue an interrupted or failed export from its last
+// completed window
+func (ie *InfluxExport) Resume(id string) (*ExportJob, error) {
+	job, err := ie.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == exportCompleted {
+		return job, nil
+	}
+	job.Status = exportRunning
+	job.Error = ""
+	return job, ie.launch(job)
+}
+
+func (ie *InfluxExport) launch(job *ExportJob) error {
+	ie.mutex.Lock()
+	defer ie.mutex.Unlock()
+	if ie.stopped {
+		return errExportStopped
+	}
+	if ie.running[job.ID] {
+		return errors.New("export " + job.ID + " is already running")
+	}
+	if err := ie.save(job); err != nil {
+		return err
+	}
+	ie.running[job.ID] = true
+	ie.jobs.Add(1)
+	go ie.run(job)
+	return nil
+}
+
+// Stop will stop the running exports after their current window, they are
+// left interrupted to be resumed
+func (ie *InfluxExport) Stop() {
+	ie.mutex.Lock()
+	defer ie.mutex.Unlock()
+	ie.stopped = true
+}
+
+// Wait will wait for the exports to stop, until the deadline of ctx
+func (ie *InfluxExport) Wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		ie.jobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ie *InfluxExport) isStopped() bool {
+	ie.mutex.Lock()
+	defer ie.mutex.Unlock()
+	return ie.stopped
+}
+
+func (ie *InfluxExport) run(job *ExportJob) {
+	defer ie.jobs.Done()
+	err := ie.export(job)
+	if err == errExportStopped {
+		glog.Infof("Export %s interrupted at %.0f%%", job.ID, job.Progress*100)
+		job.Status = exportInterrupted
+	} else if err != nil {
+		glog.Errorf("Export %s failed: %v", job.ID, err)
+		job.Status = exportFailed
+		job.Error = err.Error()
+	} else {
+		glog.Infof("Export %s completed", job.ID)
+		job.Status = exportCompleted
+		job.Progress = 1
+	}
+	if err := ie.save(job); err != nil {
+		glog.Errorf("Failed to save export %s: %v", job.ID, err)
+	}
+
+	ie.mutex.Lock()
+	delete(ie.running, job.ID)
+	ie.mutex.Unlock()
+}
+
+// exportSchema will read the tag keys and field types of the measurement
+func (ie *InfluxExport) exportSchema(store TimeSeriesStore, measurement string) (*ExportProgress, error) {
+	progress := &ExportProgress{Measurement: measurement, Tags: []string{}, Fields: make(map[string]string)}
+
+	series, err := store.Query(StoreQuery{
+		Command:  "SHOW FIELD KEYS FROM " + quoteIdent(measurement),
+		Database: ie.DbInfo.Database,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range series {
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			progress.Fields[toString(record["fieldKey"])] = toString(record["fieldType"])
+		}
+	}
+	if len(progress.Fields) == 0 {
+		return nil, errors.New("measurement " + measurement + " not found")
+	}
+
+	series, err = store.Query(StoreQuery{
+		Command:  "SHOW TAG KEYS FROM " + quoteIdent(measurement),
+		Database: ie.DbInfo.Database,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range series {
+		for _, values := range row.Values {
+			progress.Tags = append(progress.Tags, toString(values[0]))
+		}
+	}
+	sort.Strings(progress.Tags)
+	return progress, nil
+}
+
+func exportID(now time.Time) string {
+	return fmt.Sprintf("export-%s-%03d", now.Format(backupTimeFormat), now.Nanosecond()/int(time.Millisecond))
+}
+
+func exportFileName(measurement string, req ExportRequest) string {
+	name := cqNamePattern.ReplaceAllString(measurement, "_") + "." + req.Format
+	// Parquet files compress their pages instead
+	if req.Compress && req.Format != exportFormatParquet {
+		name += ".gz"
+	}
+	return name
+}
+
+// exportRange will parse the time range of the request, the end defaults to
+// the current time
+func exportRange(req ExportRequest) (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339Nano, req.Start)
+	if err != nil {
+		return start, start, errors.New("invalid export start, expected RFC3339 time")
+	}
+	end := time.Now().UTC()
+	if req.End != "" {
+		end, err = time.Parse(time.RFC3339Nano, req.End)
+		if err != nil {
+			return start, end, errors.New("invalid export end, expected RFC3339 time")
+		}
+	}
+	if !start.Before(end) {
+		return start, end, errors.New("export start must be before end")
+	}
+	return start, end, nil
+}
+
+// export will export the measurements window by window, saving the progress
+// after every window
+func (ie *InfluxExport) export(job *ExportJob) error {
+	start, end, err := exportRange(job.Request)
+	if err != nil {
+		return err
+	}
+	store, err := NewTimeSeriesStore(ie.DbInfo, ie.CnInfo.DevMode)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	total := float64(end.Sub(start)) * float64(len(job.Measurements))
+	for _, progress := range job.Measurements {
+		path := filepath.Join(ie.Config.Directory, progress.File)
+		// Drop what was written after the last checkpoint before resuming
+		if _, err := os.Stat(path); err == nil {
+			if err := os.Truncate(path, progress.Offset); err != nil {
+				return err
+			}
+		}
+
+		for progress.Checkpoint.Before(end) {
+			if ie.isStopped() {
+				return errExportStopped
+			}
+			windowEnd := progress.Checkpoint.Add(ie.window)
+			if windowEnd.After(end) {
+				windowEnd = end
+			}
+			rows, offset, err := ie.exportWindow(store, job.Request, progress, path, windowEnd)
+			if err != nil {
+				return err
+			}
+			progress.Checkpoint = windowEnd
+			progress.Offset = offset
+			progress.Rows += rows
+
+			var done time.Duration
+			for _, p := range job.Measurements {
+				done += p.Checkpoint.Sub(start)
+			}
+			job.Progress = float64(done) / total
+			if err := ie.save(job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportWindow will append the points of the window to the file, as a
+// separate gzip member when compressed or as a new row group of a Parquet
+// file, and return the new file size
+func (ie *InfluxExport) exportWindow(store TimeSeriesStore, req ExportRequest, progress *ExportProgress, path string, windowEnd time.Time) (int64, int64, error) {
+	command := "SELECT * FROM " + quoteIdent(progress.Measurement) +
+		" WHERE time >= " + quoteString(progress.Checkpoint.Format(time.RFC3339Nano)) +
+		" AND time < " + quoteString(windowEnd.Format(time.RFC3339Nano))
+	tagKeys := make([]string, 0, len(req.Tags))
+	for key := range req.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		command += " AND " + quoteIdent(key) + " = " + quoteString(req.Tags[key])
+	}
+	command += " GROUP BY *"
+
+	series, err := store.Query(StoreQuery{Command: command, Database: ie.DbInfo.Database, Precision: "ns"})
+	if err != nil {
+		return 0, 0, err
+	}
+	if req.Format == exportFormatParquet {
+		return exportParquetWindow(req, progress, path, series)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var out io.Writer = file
+	var gz *gzip.Writer
+	if req.Compress {
+		gz = gzip.NewWriter(file)
+		out = gz
+	}
+
+	var rows int64
+	if req.Format == exportFormatCSV {
+		rows, err = writeCSV(out, progress, series)
+	} else {
+		rows, err = writeLineProtocol(out, progress, series)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return 0, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return rows, info.Size(), nil
+}
+
+// exportParquetWindow will write the points of the window as a row group of
+// the Parquet file and return the new file size
+func exportParquetWindow(req ExportRequest, progress *ExportProgress, path string, series []models.Row) (int64, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	rowGroups, size, err := writeParquet(file, progress, series, req.Compress)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, 0, err
+	}
+	var rows int64
+	if len(rowGroups) > len(progress.RowGroups) {
+		rows = rowGroups[len(rowGroups)-1].Rows
+	}
+	progress.RowGroups = rowGroups
+	return rows, size, nil
+}
+
+// exportFields will convert the values of the row to the field types
+func exportFields(progress *ExportProgress, row models.Row, values []interface{}) (time.Time, models.Fields) {
+	var timestamp time.Time
+	fields := make(models.Fields)
+	for i, column := range row.Columns {
+		if i >= len(values) || values[i] == nil {
+			continue
+		}
+		if column == "time" {
+			ns, _ := toInt64(values[i])
+			timestamp = time.Unix(0, ns).UTC()
+			continue
+		}
+		switch progress.Fields[column] {
+		case "integer":
+			fields[column], _ = toInt64(values[i])
+		case "float":
+			if number, ok := values[i].(json.Number); ok {
+				fields[column], _ = number.Float64()
+			} else {
+				fields[column] = values[i]
+			}
+		default:
+			fields[column] = values[i]
+		}
+	}
+	return timestamp, fields
+}
+
+func writeLineProtocol(out io.Writer, progress *ExportProgress, series []models.Row) (int64, error) {
+	var rows int64
+	for _, row := range series {
+		for _, values := range row.Values {
+			timestamp, fields := exportFields(progress, row, values)
+			if len(fields) == 0 {
+				continue
+			}
+			point, err := models.NewPoint(progress.Measurement, models.NewTags(row.Tags), fields, timestamp)
+			if err != nil {
+				return rows, err
+			}
+			if _, err := io.WriteString(out, point.String()+"\n"); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+	}
+	return rows, nil
+}
+
+func writeCSV(out io.Writer, progress *ExportProgress, series []models.Row) (int64, error) {
+	fieldKeys := make([]string, 0, len(progress.Fields))
+	for key := range progress.Fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+
+	writer := csv.NewWriter(out)
+	if progress.Offset == 0 && progress.Rows == 0 {
+		// The columns are annotated with their type for the import
+		header := []string{"time"}
+		for _, key := range progress.Tags {
+			header = append(header, key+":tag")
+		}
+		for _, key := range fieldKeys {
+			header = append(header, key+":"+progress.Fields[key])
+		}
+		if err := writer.Write(header); err != nil {
+			return 0, err
+		}
+	}
+
+	var rows int64
+	for _, row := range series {
+		for _, values := range row.Values {
+			timestamp, fields := exportFields(progress, row, values)
+			record := []string{timestamp.Format(time.RFC3339Nano)}
+			for _, key := range progress.Tags {
+				record = append(record, row.Tags[key])
+			}
+			for _, key := range fieldKeys {
+				if value, ok := fields[key]; ok {
+					record = append(record, fmt.Sprint(value))
+				} else {
+					record = append(record, "")
+				}
+			}
+			if err := writer.Write(record); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+	}
+	writer.Flush()
+	return rows, writer.Error()
+}
+
+func (ie *InfluxExport) jobPath(id string) string {
+	return filepath.Join(ie.Config.Directory, id+".json")
+}
+
+// save will write the job state atomically
+func (ie *InfluxExport) save(job *ExportJob) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ie.jobPath(job.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ie.jobPath(job.ID))
+}
+
+func (ie *InfluxExport) load(id string) (*ExportJob, error) {
+	if !exportIDPattern.MatchString(id) {
+		return nil, errors.New("invalid export id " + id)
+	}
+	data, err := ioutil.ReadFile(ie.jobPath(id))
+	if err != nil {
+		return nil, errors.New("export " + id + " not found")
+	}
+	var job ExportJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List will return the exports, oldest first
+func (ie *InfluxExport) List() ([]*ExportJob, error) {
+	entries, err := ioutil.ReadDir(ie.Config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*ExportJob
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		job, err := ie.load(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			glog.Warningf("Skipping export state %s: %v", entry.Name(), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// errExportDisabled is returned by the export requests when the exports are
+// not configured
+var errExportDisabled = errors.New("Exports are not configured")
+
+// ExportData will start or resume the export requested in the message
+func (iq *InfluxQuery) ExportData(msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Export == nil {
+		return val, errExportDisabled
+	}
+
+	var job *ExportJob
+	var err error
+	if id, ok := msg.Data["resume"].(string); ok {
+		job, err = iq.Export.Resume(id)
+	} else {
+		req := ExportRequest{Compress: true, Tags: make(map[string]string)}
+		if measurements, ok := msg.Data["measurements"].([]interface{}); ok {
+			for _, measurement := range measurements {
+				req.Measurements = append(req.Measurements, toString(measurement))
+			}
+		}
+		if tags, ok := msg.Data["tags"].(map[string]interface{}); ok {
+			for key, value := range tags {
+				req.Tags[key] = toString(value)
+			}
+		}
+		req.Start, _ = msg.Data["start"].(string)
+		req.End, _ = msg.Data["end"].(string)
+		req.Format, _ = msg.Data["format"].(string)
+		if compress, ok := msg.Data["compress"].(bool); ok {
+			req.Compress = compress
+		}
+		job, err = iq.Export.Start(req)
+	}
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": "", "Export": job.ID}, nil), nil
+}
+
+// ExportStatus will return the state of the export in the message, or of all
+// the exports
+func (iq *InfluxQuery) ExportStatus(msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Export == nil {
+		return val, errExportDisabled
+	}
+
+	var status interface{}
+	if id, ok := msg.Data["id"].(string); ok {
+		job, err := iq.Export.load(id)
+		if err != nil {
+			return val, err
+		}
+		status = job
+	} else {
+		jobs, err := iq.Export.List()
+		if err != nil {
+			return val, err
+		}
+		if jobs == nil {
+			jobs = []*ExportJob{}
+		}
+		status = jobs
+	}
+
+	output, err := json.Marshal(status)
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil), nil
+}
@@ -0,0 +1,399 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+	metrics "influxdbconnector/metrics"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	languageInfluxQL = "influxql"
+	languageFlux     = "flux"
+	fluxDisabledMsg  = "Flux queries are disabled in InfluxDB, set flux-enabled = true in the [http] section of the InfluxDB config"
+)
+
+var (
+	// Flux scripts are only allowed to import the pure data manipulation
+	// packages and must start reading with from(bucket: ...)
+	fluxWhitelistValidator = regexp.MustCompile(`^\s*(import\s+"(strings|math|date|regexp)"\s*)*from\s*\(\s*bucket\s*:`)
+	// Functions which write data or reach outside of the database. They are
+	// denied as identifiers, not only as calls, so they can't be called
+	// through a variable.
+	fluxDenyValidator = regexp.MustCompile(`(^|[^\w.])(to|buckets|sql|http|csv|socket|experimental|influxdb)\b`)
+	fluxFromPattern   = regexp.MustCompile(`(^|[^\w.])from\b`)
+	fluxArgPattern    = regexp.MustCompile(`^\s*(\w+)\s*:\s*(.*?)\s*$`)
+)
+
+// queryLanguage will return the query language requested in the message,
+// InfluxQL being the default
+func queryLanguage(msg *types.MsgEnvelope) (string, error) {
+	language, ok := msg.Data["language"].(string)
+	if !ok || language == "" {
+		return languageInfluxQL, nil
+	}
+	language = strings.ToLower(language)
+	if language != languageInfluxQL && language != languageFlux {
+		return "", errors.New("Unsupported language: " + language + ", use influxql or flux")
+	}
+	return language, nil
+}
+
+// validateFlux will check the Flux script against the blacklist, allow only
+// read operations and restrict the buckets to the configured database
+func (iq *InfluxQuery) validateFlux(script string) error {
+	cmdL := strings.ToLower(script)
+	if iq.isBlacklisted(cmdL) {
+		glog.Infof("Query is blacklisted")
+		metrics.QueriesRejected.Inc("blacklisted")
+		return errors.New("Query is blacklisted")
+	}
+	// Strings and comments are blanked, they could hide a call or sit
+	// between a function and its arguments
+	if !fluxWhitelistValidator.MatchString(script) || fluxDenyValidator.MatchString(blankFluxLiterals(script)) {
+		metrics.QueriesRejected.Inc("not_read_only")
+		return errors.New("Please send proper read only flux query")
+	}
+
+	buckets, err := fluxBuckets(script)
+	if err != nil {
+		metrics.QueriesRejected.Inc("bucket")
+		return err
+	}
+	for _, bucket := range buckets {
+		if bucket != bucketName(iq.DbInfo) && bucket != iq.DbInfo.Database && !strings.HasPrefix(bucket, iq.DbInfo.Database+"/") {
+			metrics.QueriesRejected.Inc("bucket")
+			return errors.New("Flux query is allowed only on bucket " + bucketName(iq.DbInfo))
+		}
+	}
+
+	return nil
+}
+
+// fluxBuckets will return the buckets read by the from() calls of the
+// script. from must only be called, with a single bucket argument given as
+// a string literal, so the bucket can't come from a variable or another
+// host, org or token.
+func fluxBuckets(script string) ([]string, error) {
+	code := blankFluxLiterals(script)
+
+	var buckets []string
+	for _, match := range fluxFromPattern.FindAllStringIndex(code, -1) {
+		open := match[1]
+		for open < len(code) && (code[open] == ' ' || code[open] == '\t' || code[open] == '\n' || code[open] == '\r') {
+			open++
+		}
+		if open == len(code) || code[open] != '(' {
+			return nil, errors.New("Flux from can only be called, not used as a value")
+		}
+		end := closingParen(code, open)
+		if end < 0 {
+			return nil, errors.New("Flux from call is not closed")
+		}
+
+		args := splitFluxArgs(code, open+1, end)
+		if len(args) != 1 {
+			return nil, errors.New("Flux from accepts only the bucket parameter")
+		}
+		arg := fluxArgPattern.FindStringSubmatch(script[args[0][0]:args[0][1]])
+		if arg == nil || arg[1] != "bucket" {
+			return nil, errors.New("Flux from accepts only the bucket parameter")
+		}
+		bucket, err := strconv.Unquote(arg[2])
+		if err != nil || !strings.HasPrefix(arg[2], `"`) || strings.Contains(bucket, "${") {
+			return nil, errors.New("Flux from bucket must be a string literal")
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// blankFluxLiterals will replace the content of the string literals and the
+// comments of the script by spaces, so the code around them is scanned
+// without being fooled by quoted parentheses or commas. The offsets are kept.
+func blankFluxLiterals(script string) string {
+	code := []byte(script)
+	inString := false
+	for i := 0; i < len(code); i++ {
+		switch {
+		case inString && code[i] == '\\':
+			code[i] = ' '
+			if i+1 < len(code) {
+				i++
+				code[i] = ' '
+			}
+		case inString && code[i] == '"':
+			inString = false
+		case inString:
+			if code[i] != '\n' {
+				code[i] = ' '
+			}
+		case code[i] == '"':
+			inString = true
+		case code[i] == '/' && i+1 < len(code) && code[i+1] == '/':
+			for i < len(code) && code[i] != '\n' {
+				code[i] = ' '
+				i++
+			}
+		}
+	}
+	return string(code)
+}
+
+// closingParen will return the offset of the parenthesis closing the one at
+// open, -1 if there is none
+func closingParen(code string, open int) int {
+	depth := 0
+	for i := open; i < len(code); i++ {
+		switch code[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitFluxArgs will return the offsets of the comma separated arguments
+// between start and end, the commas nested in brackets are skipped
+func splitFluxArgs(code string, start int, end int) [][2]int {
+	var args [][2]int
+	depth := 0
+	from := start
+	for i := start; i < end; i++ {
+		switch code[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, [2]int{from, i})
+				from = i + 1
+			}
+		}
+	}
+	if strings.TrimSpace(code[from:end]) != "" {
+		args = append(args, [2]int{from, end})
+	}
+	return args
+}
+
+// QueryFlux will validate and execute the Flux script and return the
+// response with the tables as JSON
+func (iq *InfluxQuery) QueryFlux(script string, msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if err := iq.validateFlux(script); err != nil {
+		return val, err
+	}
+
+	if stream, _ := msg.Data["stream"].(bool); stream {
+		return iq.streamQuery(script, msg)
+	}
+
+	tables, err := iq.fluxQuery(script)
+	if err != nil {
+		glog.Errorf("Flux query failed: %v", err)
+		return val, err
+	}
+	if len(tables) == 0 {
+		return val, errors.New("Response is nil")
+	}
+
+	output, err := json.Marshal(tables)
+	response := types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil)
+	return response, err
+}
+
+// fluxQuery will run the Flux script on the /api/v2/query endpoint of
+// InfluxDB and convert the annotated CSV response to rows
+func (iq *InfluxQuery) fluxQuery(script string) ([]models.Row, error) {
+	if iq.DbInfo.DryRun {
+		return nil, errors.New("Flux queries are not supported in dry run mode")
+	}
+
+	httpClient, baseURL, err := newInfluxHTTPClient(iq.DbInfo, iq.CnInfo.DevMode)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"query": script,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{"datatype"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queryURL := baseURL + "/api/v2/query"
+	token := iq.DbInfo.Username + ":" + iq.DbInfo.Password
+	if iq.DbInfo.Backend == BackendInfluxDB2 {
+		queryURL += "?" + url.Values{"org": {iq.DbInfo.Org}}.Encode()
+		token = iq.DbInfo.Token
+	}
+
+	req, err := http.NewRequest("POST", queryURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	req.Header.Set("Authorization", "Token "+token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return parseFluxCSV(resp.Body)
+	case http.StatusForbidden, http.StatusNotFound:
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound || strings.Contains(strings.ToLower(string(respBody)), "flux") {
+			return nil, errors.New(fluxDisabledMsg)
+		}
+		return nil, errors.New(strings.TrimSpace(string(respBody)))
+	default:
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		var fluxErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &fluxErr) == nil && fluxErr.Error != "" {
+			return nil, errors.New(fluxErr.Error)
+		}
+		return nil, errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from InfluxDB")
+	}
+}
+
+// parseFluxCSV will convert the annotated CSV tables into rows, using the
+// datatype annotation to restore the value types
+func parseFluxCSV(r io.Reader) ([]models.Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var tables []models.Row
+	var datatypes []string
+	var current *models.Row
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 {
+			continue
+		}
+
+		if record[0] == "#datatype" {
+			datatypes = record[1:]
+			current = nil
+			continue
+		}
+		if strings.HasPrefix(record[0], "#") {
+			continue
+		}
+
+		if current == nil {
+			columns := record[1:]
+			if len(columns) >= 1 && columns[0] == "error" {
+				row, err := reader.Read()
+				if err == nil && len(row) > 1 {
+					return nil, errors.New(row[1])
+				}
+				return nil, errors.New("Flux query failed")
+			}
+			tables = append(tables, models.Row{Columns: columns})
+			current = &tables[len(tables)-1]
+			continue
+		}
+
+		values := make([]interface{}, 0, len(record)-1)
+		for i, value := range record[1:] {
+			datatype := ""
+			if i < len(datatypes) {
+				datatype = datatypes[i]
+			}
+			values = append(values, fluxValue(datatype, value))
+		}
+		if current.Name == "" && len(values) > 0 {
+			current.Name, _ = values[0].(string)
+		}
+		current.Values = append(current.Values, values)
+	}
+
+	return tables, nil
+}
+
+func fluxValue(datatype string, value string) interface{} {
+	if value == "" && datatype != "string" {
+		return nil
+	}
+
+	switch datatype {
+	case "long":
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v
+		}
+	case "unsignedLong":
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return v
+		}
+	case "double":
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	case "boolean":
+		if v, err := strconv.ParseBool(value); err == nil {
+			return v
+		}
+	}
+	return value
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	common "influxdbconnector/common"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestParseFluxCSV(t *testing.T) {
+	tests := []struct {
+		name   string
+		csv    string
+		tables []models.Row
+		err    string
+	}{
+		{
+			name: "typed values",
+			csv: "#datatype,string,long,dateTime:RFC3339,double,long,boolean,string\n" +
+				"#group,false,false,false,false,false,false,true\n" +
+				"#default,_result,,,,,,\n" +
+				",result,table,_time,_value,count,ok,host\n" +
+				",,0,2026-10-19T10:00:00Z,1.5,3,true,a\n" +
+				",,0,2026-10-19T10:01:00Z,,4,false,\n",
+			tables: []models.Row{{
+				Name:    "",
+				Columns: []string{"result", "table", "_time", "_value", "count", "ok", "host"},
+				Values: [][]interface{}{
+					{"", int64(0), "2026-10-19T10:00:00Z", 1.5, int64(3), true, "a"},
+					{"", int64(0), "2026-10-19T10:01:00Z", nil, int64(4), false, ""},
+				},
+			}},
+		},
+		{
+			name: "tables",
+			csv: "#datatype,string,long,string\n" +
+				",result,table,_measurement\n" +
+				",_result,0,cpu\n" +
+				"\n" +
+				"#datatype,string,long,unsignedLong\n" +
+				",result,table,_value\n" +
+				",_result,1,7\n",
+			tables: []models.Row{
+				{Name: "_result", Columns: []string{"result", "table", "_measurement"}, Values: [][]interface{}{{"_result", int64(0), "cpu"}}},
+				{Name: "_result", Columns: []string{"result", "table", "_value"}, Values: [][]interface{}{{"_result", int64(1), uint64(7)}}},
+			},
+		},
+		{
+			name: "error",
+			csv:  ",error,reference\n,bucket not found,\n",
+			err:  "bucket not found",
+		},
+		{
+			name: "empty",
+			csv:  "",
+		},
+	}
+
+	for _, test := range tests {
+		tables, err := parseFluxCSV(strings.NewReader(test.csv))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: parseFluxCSV error = %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseFluxCSV failed: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tables, test.tables) {
+			t.Errorf("%s: parseFluxCSV = %#v, expected %#v", test.name, tables, test.tables)
+		}
+	}
+}
+
+func TestFluxBuckets(t *testing.T) {
+	tests := []struct {
+		script  string
+		buckets []string
+		invalid bool
+	}{
+		{script: `from(bucket: "datain") |> range(start: -1h)`, buckets: []string{"datain"}},
+		{script: `from(bucket:"datain/autogen")`, buckets: []string{"datain/autogen"}},
+		{
+			script:  `a = from(bucket: "datain") |> range(start: -1h)` + "\n" + `b = from(bucket: "other")`,
+			buckets: []string{"datain", "other"},
+		},
+		// A from in a string or a comment is not a call
+		{script: `from(bucket: "datain") |> filter(fn: (r) => r.name == "from(")` + "\n// from", buckets: []string{"datain"}},
+		{script: `from(bucketID: "0123456789abcdef")`, invalid: true},
+		{script: `b = "_internal" from(bucket: b)`, invalid: true},
+		{script: `from(bucket: "datain", host: "http://other:8086", token: "t")`, invalid: true},
+		{script: `from(bucket: "${b}")`, invalid: true},
+		{script: `f = from f(bucket: "_internal")`, invalid: true},
+		{script: `from(bucket: "datain"`, invalid: true},
+	}
+
+	for _, test := range tests {
+		buckets, err := fluxBuckets(test.script)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("fluxBuckets(%q) = %v, expected an error", test.script, buckets)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(buckets, test.buckets) {
+			t.Errorf("fluxBuckets(%q) = %v, %v, expected %v", test.script, buckets, err, test.buckets)
+		}
+	}
+}
+
+func TestValidateFlux(t *testing.T) {
+	iq := &InfluxQuery{DbInfo: common.DbCredential{Database: "datain"}}
+	tests := []struct {
+		script string
+		valid  bool
+	}{
+		{script: `from(bucket: "datain") |> range(start: -1h)`, valid: true},
+		{script: `from(bucket: "datain/autogen") |> range(start: -1h) |> filter(fn: (r) => r.to == "to(")`, valid: true},
+		{script: "import \"strings\"\nfrom(bucket: \"datain\") // to(bucket: \"other\")", valid: true},
+		{script: `from(bucket: "other") |> range(start: -1h)`},
+		{script: `buckets() |> filter(fn: (r) => true)`},
+		{script: `from(bucket: "datain") |> range(start: -1h) |> to(bucket: "other")`},
+		{script: "from(bucket: \"datain\") |> range(start: -1h) |> to //x\n(bucket: \"other\")"},
+		{script: "w = to\nfrom(bucket: \"datain\") |> range(start: -1h) |> w(bucket: \"other\", org: \"o\")"},
+		{script: `from(bucket: "datain") |> range(start: -1h) |> sql.to(driverName: "postgres")`},
+		{script: `import "sql" from(bucket: "datain")`},
+	}
+
+	for _, test := range tests {
+		err := iq.validateFlux(test.script)
+		if test.valid && err != nil {
+			t.Errorf("validateFlux(%q) = %v, expected the script to be allowed", test.script, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("validateFlux(%q) allowed the script", test.script)
+		}
+	}
+}
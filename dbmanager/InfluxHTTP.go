@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	common "influxdbconnector/common"
+	inflxUtil "influxdbconnector/util/influxdb"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const httpRequestTimeout = 60 * time.Second
+
+// useTLS will tell whether InfluxDB is reached over https. The InfluxDB
+// started by the connector follows the dev mode, an external one the ssl
+// setting as well.
+func useTLS(dbInfo common.DbCredential, devMode bool) bool {
+	if devMode {
+		return false
+	}
+	return !dbInfo.External || strings.EqualFold(dbInfo.Ssl, "true")
+}
+
+func influxBaseURL(dbInfo common.DbCredential, devMode bool) string {
+	if useTLS(dbInfo, devMode) {
+		return "https://" + dbInfo.Host + ":" + dbInfo.Port
+	}
+	return "http://" + dbInfo.Host + ":" + dbInfo.Port
+}
+
+func influxTLSConfig(dbInfo common.DbCredential) (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(influxCaPath)
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+
+	return &tls.Config{
+		RootCAs:            caCertPool,
+		InsecureSkipVerify: strings.EqualFold(dbInfo.Verifyssl, "false"),
+	}, nil
+}
+
+// newInfluxClient will create the v1 client for the InfluxDB started by the
+// connector or for the external one as per the configuration
+func newInfluxClient(dbInfo common.DbCredential, username string, password string, devMode bool) (client.Client, error) {
+	if dbInfo.Backend == BackendInfluxDB2 {
+		return newInfluxV2Client(dbInfo, devMode)
+	}
+	if !dbInfo.External {
+		return inflxUtil.CreateHTTPClient(dbInfo.Host, dbInfo.Port, username, password, devMode)
+	}
+
+	conf := client.HTTPConfig{
+		Addr:     influxBaseURL(dbInfo, devMode),
+		Username: username,
+		Password: password,
+	}
+	if useTLS(dbInfo, devMode) {
+		tlsConfig, err := influxTLSConfig(dbInfo)
+		if err != nil {
+			return nil, err
+		}
+		conf.TLSConfig = tlsConfig
+	}
+	return client.NewHTTPClient(conf)
+}
+
+// newInfluxHTTPClient will create a plain HTTP client for the InfluxDB
+// endpoints which are not covered by the v1 client, along with the base URL
+func newInfluxHTTPClient(dbInfo common.DbCredential, devMode bool) (*http.Client, string, error) {
+	if !useTLS(dbInfo, devMode) {
+		return &http.Client{Timeout: httpRequestTimeout}, influxBaseURL(dbInfo, devMode), nil
+	}
+
+	tlsConfig, err := influxTLSConfig(dbInfo)
+	if err != nil {
+		return nil, "", err
+	}
+	httpClient := &http.Client{
+		Timeout:   httpRequestTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return httpClient, influxBaseURL(dbInfo, devMode), nil
+}
+
+// pingInflux will check whether InfluxDB is responding on the /ping endpoint
+func pingInflux(dbInfo common.DbCredential, devMode bool) error {
+	httpClient, baseURL, err := newInfluxHTTPClient(dbInfo, devMode)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Get(baseURL + "/ping")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from /ping")
+	}
+	return nil
+}
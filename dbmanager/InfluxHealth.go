@@ -0,0 +1,170 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	common "influxdbconnector/common"
+)
+
+// Health will check that influxd responds, the database exists and the
+// subscription is registered, along with the backlog of the points received
+// from the subscription
+func (idbMgr *InfluxDBManager) Health() []common.ComponentStatus {
+	influxd := common.ComponentStatus{Name: "influxd", Status: common.StatusOK}
+	database := common.ComponentStatus{Name: "database", Status: common.StatusOK}
+	subscription := common.ComponentStatus{Name: "subscription", Status: common.StatusOK}
+
+	idbMgr.mutex.Lock()
+	subInfo := idbMgr.subInfo
+	subCtx := idbMgr.subCtx
+	idbMgr.mutex.Unlock()
+
+	if idbMgr.DbInfo.DryRun {
+		for _, status := range []*common.ComponentStatus{&influxd, &database, &subscription} {
+			status.Status = common.StatusDisabled
+			status.Detail = "dry run"
+		}
+		return []common.ComponentStatus{influxd, database, subscription}
+	}
+
+	if err := pingInflux(idbMgr.DbInfo, idbMgr.CnInfo.DevMode); err != nil {
+		influxd.Status = common.StatusDown
+		influxd.Detail = err.Error()
+	}
+
+	if influxd.Status == common.StatusDown {
+		database.Status = common.StatusDown
+		database.Detail = "influxd is not reachable"
+	} else {
+		found, err := idbMgr.showContains("SHOW DATABASES", "", "name", idbMgr.DbInfo.Database)
+		if err != nil || !found {
+			database.Status = common.StatusDown
+			database.Detail = statusDetail(err, "database "+idbMgr.DbInfo.Database+" does not exist")
+		}
+	}
+
+	switch {
+	case idbMgr.DbInfo.Backend == BackendInfluxDB2:
+		subscription.Status = common.StatusDisabled
+		subscription.Detail = "not supported by " + BackendInfluxDB2
+	case subInfo == nil:
+		subscription.Status = common.StatusDown
+		subscription.Detail = "not registered yet"
+	case database.Status == common.StatusDown:
+		subscription.Status = common.StatusDown
+		subscription.Detail = "database is not available"
+	default:
+		name := subInfo.DbName + "Subscription"
+		found, err := idbMgr.showContains("SHOW SUBSCRIPTIONS", idbMgr.DbInfo.Database, "name", name)
+		if err != nil || !found {
+			subscription.Status = common.StatusDown
+			subscription.Detail = statusDetail(err, "subscription "+name+" is not registered")
+		}
+	}
+
+	statuses := []common.ComponentStatus{influxd, database, subscription}
+	if subCtx != nil {
+		backlog, capacity := subCtx.backlog()
+		buffer := common.ComponentStatus{
+			Name:     "subscription_buffer",
+			Status:   common.StatusOK,
+			Backlog:  backlog,
+			Capacity: capacity,
+		}
+		if capacity > 0 && backlog >= capacity {
+			buffer.Status = common.StatusDegraded
+			buffer.Detail = "buffer is full, new points are discarded"
+		}
+		statuses = append(statuses, buffer)
+	}
+	return statuses
+}
+
+// showContains will run the SHOW statement and check whether the column of
+// one of its rows holds the value, series is the name of the series to look
+// into, empty for all of them
+func (idbMgr *InfluxDBManager) showContains(command string, series string, column string, value string) (bool, error) {
+	store, err := NewTimeSeriesStore(idbMgr.DbInfo, idbMgr.CnInfo.DevMode)
+	if err != nil {
+		return false, err
+	}
+	defer store.Close()
+
+	rows, err := store.Query(StoreQuery{Command: command})
+	if err != nil {
+		return false, err
+	}
+	for _, row := range rows {
+		if series != "" && row.Name != series {
+			continue
+		}
+		for index, name := range row.Columns {
+			if name != column {
+				continue
+			}
+			for _, values := range row.Values {
+				if index < len(values) && fmt.Sprintf("%v", values[index]) == value {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// statusDetail will return the error message if any, else the reason
+func statusDetail(err error, reason string) string {
+	if err != nil {
+		return err.Error()
+	}
+	return reason
+}
+
+// backlog will return the number of points waiting to be published and the
+// size of the buffer
+func (subCtx *InfluxSubCtx) backlog() (int, int) {
+	subCtx.workerMutex.Lock()
+	defer subCtx.workerMutex.Unlock()
+	return len(subCtx.pData), cap(subCtx.pData)
+}
+
+// Health will report the number of files waiting in the import directory
+func (im *InfluxImport) Health() common.ComponentStatus {
+	status := common.ComponentStatus{Name: "import", Status: common.StatusOK}
+	entries, err := ioutil.ReadDir(im.Config.Directory)
+	if err != nil {
+		status.Status = common.StatusDown
+		status.Detail = err.Error()
+		return status
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			status.Backlog++
+		}
+	}
+	return status
+}
@@ -0,0 +1,563 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+const (
+	defaultImportDir          = "/influxdata/import"
+	defaultImportBatchSize    = 5000
+	defaultImportPollInterval = 10 * time.Second
+	// importSettleTime is the time a file must be left unmodified before it
+	// is imported, to not read a file still being copied
+	importSettleTime = 5 * time.Second
+	// maxImportErrors is the number of invalid lines reported per file
+	maxImportErrors   = 100
+	maxImportStatuses = 100
+	importStatusExt   = ".status.json"
+)
+
+// writeRejections are the errors of InfluxDB rejecting points, as opposed to
+// failing to write them
+var writeRejections = []string{
+	"partial write",
+	"field type conflict",
+	"unable to parse",
+	"beyond retention policy",
+	"unsupported value",
+	"max-values-per-tag",
+}
+
+// csvColumnTypes are the types a CSV header column may be annotated with, as
+// name:type, like the columns of the CSV export
+var csvColumnTypes = map[string]bool{
+	"tag":      true,
+	"float":    true,
+	"integer":  true,
+	"unsigned": true,
+	"boolean":  true,
+	"string":   true,
+}
+
+// ImportLineError structure
+type ImportLineError struct {
+	Line  int64  `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportStatus structure is the result of the import of a file
+type ImportStatus struct {
+	File     string            `json:"file"`
+	Status   string            `json:"status"`
+	Started  string            `json:"started"`
+	Finished string            `json:"finished,omitempty"`
+	Points   int64             `json:"points"`
+	Invalid  int64             `json:"invalid"`
+	Error    string            `json:"error,omitempty"`
+	Errors   []ImportLineError `json:"errors,omitempty"`
+}
+
+// InfluxImport structure imports the line protocol and CSV files dropped in
+// the import directory through the writer
+type InfluxImport struct {
+	Config common.ImportConfig
+	Writer *InfluxWriter
+	// OnImported is called once a file wrote points, which may be older
+	// than the last backup
+	OnImported func()
+
+	pollInterval time.Duration
+	mutex        sync.Mutex
+	statuses     []*ImportStatus
+	done         chan struct{}
+	// stopped is closed when Run returns
+	stopped chan struct{}
+}
+
+// Init will apply the defaults and create the import directories
+func (im *InfluxImport) Init() error {
+	if im.Config.Directory == "" {
+		im.Config.Directory = defaultImportDir
+	}
+	if im.Config.DoneDirectory == "" {
+		im.Config.DoneDirectory = filepath.Join(im.Config.Directory, "done")
+	}
+	if im.Config.FailedDirectory == "" {
+		im.Config.FailedDirectory = filepath.Join(im.Config.Directory, "failed")
+	}
+	if im.Config.BatchSize <= 0 {
+		im.Config.BatchSize = defaultImportBatchSize
+	}
+	if im.Config.Precision == "" {
+		im.Config.Precision = "ns"
+	}
+	if err := im.parseConfig(); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{im.Config.Directory, im.Config.DoneDirectory, im.Config.FailedDirectory} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	im.done = make(chan struct{})
+	im.stopped = make(chan struct{})
+	return nil
+}
+
+// parseConfig will check the import settings, also run by ValidateConfig
+func (im *InfluxImport) parseConfig() error {
+	im.pollInterval = defaultImportPollInterval
+	if im.Config.PollInterval != "" {
+		interval, err := time.ParseDuration(im.Config.PollInterval)
+		if err != nil || interval <= 0 {
+			return errors.New("invalid import poll_interval " + im.Config.PollInterval)
+		}
+		im.pollInterval = interval
+	}
+	return nil
+}
+
+// Run will import the files of the import directory until Stop is called
+func (im *InfluxImport) Run() {
+	im.mutex.Lock()
+	done := im.done
+	im.mutex.Unlock()
+	defer close(im.stopped)
+
+	ticker := time.NewTicker(im.pollInterval)
+	defer ticker.Stop()
+	for {
+		im.scan(done)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop will stop watching the import directory once the current file is
+// imported
+func (im *InfluxImport) Stop() {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	if im.done != nil {
+		close(im.done)
+		im.done = nil
+	}
+}
+
+// Wait will wait for the file being imported when Stop was called, until the
+// deadline of ctx
+func (im *InfluxImport) Wait(ctx context.Context) error {
+	select {
+	case <-im.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Statuses will return the status of the recently imported files
+func (im *InfluxImport) Statuses() []ImportStatus {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	statuses := make([]ImportStatus, 0, len(im.statuses))
+	for _, status := range im.statuses {
+		statuses = append(statuses, *status)
+	}
+	return statuses
+}
+
+func (im *InfluxImport) scan(done chan struct{}) {
+	entries, err := ioutil.ReadDir(im.Config.Directory)
+	if err != nil {
+		glog.Errorf("Failed to read import directory: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || time.Since(entry.ModTime()) < importSettleTime {
+			continue
+		}
+		im.importFile(entry.Name())
+	}
+}
+
+func (im *InfluxImport) importFile(name string) {
+	status := &ImportStatus{
+		File:    name,
+		Status:  "running",
+		Started: time.Now().UTC().Format(time.RFC3339),
+	}
+	im.mutex.Lock()
+	im.statuses = append(im.statuses, status)
+	if len(im.statuses) > maxImportStatuses {
+		im.statuses = im.statuses[len(im.statuses)-maxImportStatuses:]
+	}
+	im.mutex.Unlock()
+
+	glog.Infof("Importing %s", name)
+	err := im.importPoints(filepath.Join(im.Config.Directory, name), status)
+
+	im.mutex.Lock()
+	status.Finished = time.Now().UTC().Format(time.RFC3339)
+	targetDir := im.Config.DoneDirectory
+	if err != nil || status.Invalid > 0 {
+		status.Status = "failed"
+		targetDir = im.Config.FailedDirectory
+		if err != nil {
+			status.Error = err.Error()
+		}
+	} else {
+		status.Status = "done"
+	}
+	result := *status
+	im.mutex.Unlock()
+
+	if result.Points > 0 && im.OnImported != nil {
+		im.OnImported()
+	}
+
+	glog.Infof("Import of %s %s: %d points written, %d invalid lines", name, result.Status, result.Points, result.Invalid)
+	if err != nil {
+		glog.Errorf("Import of %s failed: %v", name, err)
+	}
+
+	if err := os.Rename(filepath.Join(im.Config.Directory, name), filepath.Join(targetDir, name)); err != nil {
+		glog.Errorf("Failed to move %s to %s: %v", name, targetDir, err)
+	}
+	data, _ := json.MarshalIndent(result, "", "  ")
+	if err := ioutil.WriteFile(filepath.Join(targetDir, name+importStatusExt), data, 0640); err != nil {
+		glog.Errorf("Failed to write the import status of %s: %v", name, err)
+	}
+}
+
+// importPoints will parse the file and write the points in batches, invalid
+// lines are reported in the status and skipped
+func (im *InfluxImport) importPoints(path string, status *ImportStatus) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	invalid := func(line int64, err error) {
+		im.mutex.Lock()
+		defer im.mutex.Unlock()
+		status.Invalid++
+		if len(status.Errors) < maxImportErrors {
+			status.Errors = append(status.Errors, ImportLineError{Line: line, Error: err.Error()})
+		}
+	}
+	batch := &importBatch{points: make([]Point, 0, im.Config.BatchSize)}
+	add := func(line int64, point Point) error {
+		batch.points = append(batch.points, point)
+		batch.lines = append(batch.lines, line)
+		if len(batch.points) < im.Config.BatchSize {
+			return nil
+		}
+		return im.flush(batch, status, invalid)
+	}
+
+	switch filepath.Ext(name) {
+	case ".lp", ".txt":
+		err = im.readLineProtocol(reader, add, invalid)
+	case ".csv":
+		err = im.readCSV(reader, strings.TrimSuffix(name, ".csv"), add, invalid)
+	default:
+		return errors.New("unsupported file type, expected .lp, .txt or .csv optionally gzipped")
+	}
+	if err != nil {
+		return err
+	}
+	return im.flush(batch, status, invalid)
+}
+
+// importBatch is the batch of points to write and the lines they were read
+// from
+type importBatch struct {
+	points []Point
+	lines  []int64
+}
+
+// flush will write the batch. When InfluxDB rejects it, the points are
+// written one by one to report the rejected lines and keep the others, other
+// errors fail the import.
+func (im *InfluxImport) flush(batch *importBatch, status *ImportStatus, invalid func(int64, error)) error {
+	if len(batch.points) == 0 {
+		return nil
+	}
+	written := int64(len(batch.points))
+	if err := im.Writer.WritePoints(batch.points); err != nil {
+		glog.Warningf("Import batch failed, writing its points one by one: %v", err)
+		written = 0
+		for i, point := range batch.points {
+			if err := im.Writer.WritePoints([]Point{point}); err != nil {
+				if !isWriteRejected(err) {
+					return err
+				}
+				invalid(batch.lines[i], err)
+				continue
+			}
+			written++
+		}
+	}
+	im.mutex.Lock()
+	status.Points += written
+	im.mutex.Unlock()
+	batch.points = batch.points[:0]
+	batch.lines = batch.lines[:0]
+	return nil
+}
+
+// isWriteRejected will check whether InfluxDB rejected the points
+func isWriteRejected(err error) bool {
+	for _, rejection := range writeRejections {
+		if strings.Contains(err.Error(), rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+func (im *InfluxImport) readLineProtocol(reader io.Reader, add func(int64, Point) error, invalid func(int64, error)) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var line int64
+	for scanner.Scan() {
+		line++
+		points, err := models.ParsePointsWithPrecision(scanner.Bytes(), time.Now().UTC(), im.Config.Precision)
+		if err != nil {
+			invalid(line, err)
+			continue
+		}
+		for _, pt := range points {
+			fields, err := pt.Fields()
+			if err != nil {
+				invalid(line, err)
+				continue
+			}
+			err = add(line, Point{
+				Measurement: string(pt.Name()),
+				Tags:        pt.Tags().Map(),
+				Fields:      fields,
+				Time:        pt.Time(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// readCSV will read the CSV file with a header line. The time column holds
+// RFC3339 times or epoch nanoseconds, the measurement column the measurement
+// (the file name otherwise). The header columns may be annotated with their
+// type as name:tag or name:integer like the CSV export, otherwise the columns
+// in tag_keys are tags and the other ones fields.
+func (im *InfluxImport) readCSV(reader io.Reader, measurement string, add func(int64, Point) error, invalid func(int64, error)) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		return errors.New("missing CSV header: " + err.Error())
+	}
+
+	tags := make(map[string]bool)
+	_, tagList := im.Writer.Keys()
+	for _, tag := range tagList {
+		tags[tag] = true
+	}
+	columns, kinds := csvColumns(header, tags)
+
+	var line int64 = 1
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if err != nil {
+			invalid(line, err)
+			continue
+		}
+		if len(record) != len(header) {
+			invalid(line, fmt.Errorf("expected %d columns, got %d", len(header), len(record)))
+			continue
+		}
+
+		point := Point{
+			Measurement: measurement,
+			Tags:        make(map[string]string),
+			Fields:      make(map[string]interface{}),
+		}
+		for i, column := range columns {
+			value := record[i]
+			switch {
+			case column == "time":
+				point.Time, err = parseImportTime(value)
+			case column == "measurement":
+				point.Measurement = value
+			case value == "":
+			case kinds[i] == "tag":
+				point.Tags[column] = value
+			default:
+				point.Fields[column], err = csvValue(kinds[i], value)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			invalid(line, err)
+			continue
+		}
+		if point.Time.IsZero() || len(point.Fields) == 0 {
+			invalid(line, errors.New("time and at least one field are required"))
+			continue
+		}
+		if err := add(line, point); err != nil {
+			return err
+		}
+	}
+}
+
+// csvColumns will split the type annotations off the header columns, the
+// columns without one are tags when listed in tags
+func csvColumns(header []string, tags map[string]bool) ([]string, []string) {
+	columns := make([]string, len(header))
+	kinds := make([]string, len(header))
+	for i, column := range header {
+		if idx := strings.LastIndex(column, ":"); idx > 0 && csvColumnTypes[column[idx+1:]] {
+			columns[i], kinds[i] = column[:idx], column[idx+1:]
+			continue
+		}
+		columns[i] = column
+		if tags[column] {
+			kinds[i] = "tag"
+		}
+	}
+	return columns, kinds
+}
+
+func parseImportTime(value string) (time.Time, error) {
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ns).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return t, errors.New("invalid time " + strconv.Quote(value))
+	}
+	return t, nil
+}
+
+// csvValue will convert the value to the type of the column. Without a type,
+// integers with an i suffix are integers and other numbers floats like the
+// JSON values written by InfluxWriter, then booleans and strings.
+func csvValue(kind string, value string) (interface{}, error) {
+	var result interface{}
+	var err error
+	switch kind {
+	case "integer":
+		result, err = strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+	case "unsigned":
+		result, err = strconv.ParseUint(strings.TrimSuffix(value, "u"), 10, 64)
+	case "float":
+		result, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		result, err = strconv.ParseBool(value)
+	case "string":
+		result = value
+	default:
+		if strings.HasSuffix(value, "i") {
+			if i, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64); err == nil {
+				return i, nil
+			}
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, nil
+		}
+		if value == "true" || value == "false" {
+			return value == "true", nil
+		}
+		return value, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %s", kind, strconv.Quote(value))
+	}
+	return result, nil
+}
+
+// ImportStatuses will return the status of the recently imported files
+func (iq *InfluxQuery) ImportStatuses() (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Import == nil {
+		return val, errors.New("Imports are not configured")
+	}
+
+	output, err := json.Marshal(iq.Import.Statuses())
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil), nil
+}
@@ -0,0 +1,550 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Physical types, repetitions, encodings and codecs of the Parquet format
+const (
+	parquetBoolean      = 0
+	parquetInt64        = 2
+	parquetDouble       = 5
+	parquetByteArray    = 6
+	parquetRequired     = 0
+	parquetOptional     = 1
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetGzip         = 2
+	parquetUTF8         = 0
+	parquetUint64       = 14
+)
+
+// Thrift compact protocol types used by the Parquet metadata
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+var parquetMagic = []byte("PAR1")
+
+// ParquetRowGroup structure is a row group written in a Parquet export file,
+// kept in the progress to rewrite the footer after every window
+type ParquetRowGroup struct {
+	Rows    int64                `json:"rows"`
+	Columns []ParquetColumnChunk `json:"columns"`
+}
+
+// ParquetColumnChunk structure is the location and size of a column of a
+// row group
+type ParquetColumnChunk struct {
+	Offset           int64 `json:"offset"`
+	Values           int64 `json:"values"`
+	UncompressedSize int64 `json:"uncompressed_size"`
+	CompressedSize   int64 `json:"compressed_size"`
+}
+
+// parquetColumn is a column of the export schema and the values of the row
+// group being written
+type parquetColumn struct {
+	name     string
+	kind     int32
+	required bool
+	tag      bool
+	// unsigned columns hold the uint64 bits annotated as UINT_64
+	unsigned bool
+
+	present []bool
+	bools   []bool
+	values  bytes.Buffer
+}
+
+// parquetColumns will build the schema of the measurement, the time as a
+// timestamp in nanoseconds followed by the tags and the fields
+func parquetColumns(progress *ExportProgress) []*parquetColumn {
+	columns := []*parquetColumn{{name: "time", kind: parquetInt64, required: true}}
+	for _, key := range progress.Tags {
+		columns = append(columns, &parquetColumn{name: key, kind: parquetByteArray, tag: true})
+	}
+
+	fieldKeys := make([]string, 0, len(progress.Fields))
+	for key := range progress.Fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+	for _, key := range fieldKeys {
+		column := &parquetColumn{name: key, kind: parquetByteArray}
+		switch progress.Fields[key] {
+		case "float":
+			column.kind = parquetDouble
+		case "integer":
+			column.kind = parquetInt64
+		case "unsigned":
+			column.kind = parquetInt64
+			column.unsigned = true
+		case "boolean":
+			column.kind = parquetBoolean
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// add will append the value to the column, a value which does not match the
+// type of the column is written as null
+func (pc *parquetColumn) add(value interface{}) {
+	var scratch [8]byte
+	ok := value != nil
+	if ok {
+		switch {
+		case pc.unsigned:
+			number, err := toUint64(value)
+			if ok = err == nil; ok {
+				binary.LittleEndian.PutUint64(scratch[:], number)
+				pc.values.Write(scratch[:])
+			}
+		case pc.kind == parquetInt64:
+			var number int64
+			if number, ok = value.(int64); !ok {
+				var err error
+				number, err = toInt64(value)
+				ok = err == nil
+			}
+			if ok {
+				binary.LittleEndian.PutUint64(scratch[:], uint64(number))
+				pc.values.Write(scratch[:])
+			}
+		case pc.kind == parquetDouble:
+			var number float64
+			switch v := value.(type) {
+			case float64:
+				number = v
+			case int64:
+				number = float64(v)
+			case json.Number:
+				var err error
+				number, err = v.Float64()
+				ok = err == nil
+			default:
+				ok = false
+			}
+			if ok {
+				binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(number))
+				pc.values.Write(scratch[:])
+			}
+		case pc.kind == parquetBoolean:
+			var flag bool
+			if flag, ok = value.(bool); ok {
+				pc.bools = append(pc.bools, flag)
+			}
+		default:
+			text := toString(value)
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(text)))
+			pc.values.Write(scratch[:4])
+			pc.values.WriteString(text)
+		}
+	}
+	pc.present = append(pc.present, ok)
+}
+
+// toUint64 will convert the unsigned values decoded from the InfluxDB
+// response to uint64, the ones above the int64 range included
+func toUint64(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case uint64:
+		return v, nil
+	case json.Number:
+		return strconv.ParseUint(string(v), 10, 64)
+	case int64:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case float64:
+		if v >= 0 && v < math.MaxUint64 {
+			return uint64(v), nil
+		}
+	}
+	return 0, errors.New("Not a valid unsigned number")
+}
+
+// page will encode the column as a single PLAIN data page, with the
+// definition levels of the optional columns
+func (pc *parquetColumn) page() []byte {
+	var body bytes.Buffer
+	if !pc.required {
+		levels := parquetLevels(pc.present)
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(levels)))
+		body.Write(size[:])
+		body.Write(levels)
+	}
+	if pc.kind == parquetBoolean {
+		packed := make([]byte, (len(pc.bools)+7)/8)
+		for i, flag := range pc.bools {
+			if flag {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		body.Write(packed)
+	} else {
+		body.Write(pc.values.Bytes())
+	}
+	return body.Bytes()
+}
+
+// parquetLevels will encode the definition levels as runs of the RLE and
+// bit-packing hybrid encoding with a bit width of 1
+func parquetLevels(present []bool) []byte {
+	var levels []byte
+	for i := 0; i < len(present); {
+		j := i
+		for j < len(present) && present[j] == present[i] {
+			j++
+		}
+		levels = appendUvarint(levels, uint64(j-i)<<1)
+		if present[i] {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		i = j
+	}
+	return levels
+}
+
+// writeParquet will write the series as a new row group at the end of the
+// data of the file and rewrite the footer, it returns the row groups of the
+// file and its new size
+func writeParquet(file *os.File, progress *ExportProgress, series []models.Row, compress bool) ([]ParquetRowGroup, int64, error) {
+	offset := int64(len(parquetMagic))
+	if count := len(progress.RowGroups); count > 0 {
+		chunks := progress.RowGroups[count-1].Columns
+		last := chunks[len(chunks)-1]
+		offset = last.Offset + last.CompressedSize
+	}
+	// Drop the previous footer, the row groups are kept in the progress
+	if err := file.Truncate(offset); err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.WriteAt(parquetMagic, 0); err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	columns := parquetColumns(progress)
+	var rows int64
+	for _, row := range series {
+		for _, values := range row.Values {
+			timestamp, fields := exportFields(progress, row, values)
+			for _, column := range columns {
+				switch {
+				case column.required:
+					column.add(timestamp.UnixNano())
+				case column.tag:
+					if value := row.Tags[column.name]; value != "" {
+						column.add(value)
+					} else {
+						column.add(nil)
+					}
+				default:
+					column.add(fields[column.name])
+				}
+			}
+			rows++
+		}
+	}
+
+	rowGroups := progress.RowGroups[:len(progress.RowGroups):len(progress.RowGroups)]
+	if rows > 0 {
+		rowGroup := ParquetRowGroup{Rows: rows}
+		for _, column := range columns {
+			chunk, err := writeParquetPage(file, offset, column, compress)
+			if err != nil {
+				return nil, 0, err
+			}
+			rowGroup.Columns = append(rowGroup.Columns, chunk)
+			offset += chunk.CompressedSize
+		}
+		rowGroups = append(rowGroups, rowGroup)
+	}
+
+	footer := parquetFooter(columns, rowGroups, compress)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	for _, data := range [][]byte{footer, size[:], parquetMagic} {
+		if _, err := file.Write(data); err != nil {
+			return nil, 0, err
+		}
+	}
+	return rowGroups, offset + int64(len(footer)+len(size)+len(parquetMagic)), nil
+}
+
+// writeParquetPage will write the page header and the page of the column,
+// gzip compressed when asked
+func writeParquetPage(out io.Writer, offset int64, column *parquetColumn, compress bool) (ParquetColumnChunk, error) {
+	page := column.page()
+	data := page
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(page); err != nil {
+			return ParquetColumnChunk{}, err
+		}
+		if err := gz.Close(); err != nil {
+			return ParquetColumnChunk{}, err
+		}
+		data = buf.Bytes()
+	}
+
+	var header thriftWriter
+	header.i32(1, 0) // DATA_PAGE
+	header.i32(2, int32(len(page)))
+	header.i32(3, int32(len(data)))
+	header.beginStruct(5)
+	header.i32(1, int32(len(column.present)))
+	header.i32(2, parquetPlain)
+	header.i32(3, parquetRLE)
+	header.i32(4, parquetRLE)
+	header.endStruct()
+	header.end()
+
+	if _, err := out.Write(header.buf); err != nil {
+		return ParquetColumnChunk{}, err
+	}
+	if _, err := out.Write(data); err != nil {
+		return ParquetColumnChunk{}, err
+	}
+	return ParquetColumnChunk{
+		Offset:           offset,
+		Values:           int64(len(column.present)),
+		UncompressedSize: int64(len(header.buf) + len(page)),
+		CompressedSize:   int64(len(header.buf) + len(data)),
+	}, nil
+}
+
+// parquetFooter will encode the FileMetaData of the file
+func parquetFooter(columns []*parquetColumn, rowGroups []ParquetRowGroup, compress bool) []byte {
+	codec := int32(parquetUncompressed)
+	if compress {
+		codec = parquetGzip
+	}
+
+	var w thriftWriter
+	w.i32(1, 1)
+	w.beginList(2, thriftStruct, len(columns)+1)
+	w.beginElement()
+	w.binary(4, "schema")
+	w.i32(5, int32(len(columns)))
+	w.endStruct()
+	for _, column := range columns {
+		w.beginElement()
+		w.i32(1, column.kind)
+		if column.required {
+			w.i32(3, parquetRequired)
+		} else {
+			w.i32(3, parquetOptional)
+		}
+		w.binary(4, column.name)
+		switch {
+		case column.required:
+			// TIMESTAMP logical type, adjusted to UTC, in NANOS
+			w.beginStruct(10)
+			w.beginStruct(8)
+			w.bool(1, true)
+			w.beginStruct(2)
+			w.beginStruct(3)
+			w.endStruct()
+			w.endStruct()
+			w.endStruct()
+			w.endStruct()
+		case column.unsigned:
+			// UINT_64 converted type and unsigned INTEGER(64) logical type
+			w.i32(6, parquetUint64)
+			w.beginStruct(10)
+			w.beginStruct(10)
+			w.i8(1, 64)
+			w.bool(2, false)
+			w.endStruct()
+			w.endStruct()
+		case column.kind == parquetByteArray:
+			// UTF8 converted type and STRING logical type
+			w.i32(6, parquetUTF8)
+			w.beginStruct(10)
+			w.beginStruct(1)
+			w.endStruct()
+			w.endStruct()
+		}
+		w.endStruct()
+	}
+
+	var total int64
+	for _, rowGroup := range rowGroups {
+		total += rowGroup.Rows
+	}
+	w.i64(3, total)
+
+	w.beginList(4, thriftStruct, len(rowGroups))
+	for _, rowGroup := range rowGroups {
+		w.beginElement()
+		w.beginList(1, thriftStruct, len(rowGroup.Columns))
+		var size int64
+		for i, chunk := range rowGroup.Columns {
+			w.beginElement()
+			w.i64(2, chunk.Offset)
+			w.beginStruct(3)
+			w.i32(1, columns[i].kind)
+			w.beginList(2, thriftI32, 2)
+			w.varint(parquetPlain)
+			w.varint(parquetRLE)
+			w.beginList(3, thriftBinary, 1)
+			w.bytes(columns[i].name)
+			w.i32(4, codec)
+			w.i64(5, chunk.Values)
+			w.i64(6, chunk.UncompressedSize)
+			w.i64(7, chunk.CompressedSize)
+			w.i64(9, chunk.Offset)
+			w.endStruct()
+			w.endStruct()
+			size += chunk.UncompressedSize
+		}
+		w.i64(2, size)
+		w.i64(3, rowGroup.Rows)
+		w.endStruct()
+	}
+	w.binary(6, "influxdbconnector")
+	w.end()
+	return w.buf
+}
+
+// thriftWriter will encode structs with the Thrift compact protocol
+type thriftWriter struct {
+	buf    []byte
+	lastID int16
+	stack  []int16
+}
+
+func (w *thriftWriter) field(id int16, kind byte) {
+	if delta := id - w.lastID; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|kind)
+	} else {
+		w.buf = append(w.buf, kind)
+		w.varint(int64(id))
+	}
+	w.lastID = id
+}
+
+// varint will append a zigzag encoded integer
+func (w *thriftWriter) varint(value int64) {
+	w.buf = appendUvarint(w.buf, uint64(value<<1)^uint64(value>>63))
+}
+
+func (w *thriftWriter) bytes(value string) {
+	w.buf = appendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *thriftWriter) bool(id int16, value bool) {
+	if value {
+		w.field(id, thriftTrue)
+	} else {
+		w.field(id, thriftFalse)
+	}
+}
+
+func (w *thriftWriter) i8(id int16, value int8) {
+	w.field(id, thriftByte)
+	w.buf = append(w.buf, byte(value))
+}
+
+func (w *thriftWriter) i32(id int16, value int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(value))
+}
+
+func (w *thriftWriter) i64(id int16, value int64) {
+	w.field(id, thriftI64)
+	w.varint(value)
+}
+
+func (w *thriftWriter) binary(id int16, value string) {
+	w.field(id, thriftBinary)
+	w.bytes(value)
+}
+
+func (w *thriftWriter) beginList(id int16, kind byte, size int) {
+	w.field(id, thriftList)
+	if size < 15 {
+		w.buf = append(w.buf, byte(size)<<4|kind)
+	} else {
+		w.buf = append(w.buf, 0xf0|kind)
+		w.buf = appendUvarint(w.buf, uint64(size))
+	}
+}
+
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.beginElement()
+}
+
+// beginElement will start a struct in a list
+func (w *thriftWriter) beginElement() {
+	w.stack = append(w.stack, w.lastID)
+	w.lastID = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.end()
+	w.lastID = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+// end will write the stop of the current struct
+func (w *thriftWriter) end() {
+	w.buf = append(w.buf, 0)
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
@@ -0,0 +1,302 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// thriftReader will decode the Thrift compact protocol, the structs as
+// maps by field id and the lists as slices
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	r.pos += n
+	return value
+}
+
+func (r *thriftReader) varint() int64 {
+	value := r.uvarint()
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+func (r *thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case thriftTrue:
+		return true
+	case thriftFalse:
+		return false
+	case thriftByte:
+		r.pos++
+		return int64(int8(r.buf[r.pos-1]))
+	case 4, thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		size := int(r.uvarint())
+		r.pos += size
+		return string(r.buf[r.pos-size : r.pos])
+	case thriftList:
+		header := r.buf[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := []interface{}{}
+		for i := 0; i < size; i++ {
+			list = append(list, r.value(header&0xf))
+		}
+		return list
+	case thriftStruct:
+		fields := make(map[int64]interface{})
+		var id int64
+		for {
+			header := r.buf[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			if delta := int64(header >> 4); delta > 0 {
+				id += delta
+			} else {
+				id = r.varint()
+			}
+			fields[id] = r.value(header & 0xf)
+		}
+	}
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) structure() map[int64]interface{} {
+	return r.value(thriftStruct).(map[int64]interface{})
+}
+
+// readParquet will check the layout of the file and return its metadata
+// and the values of every column
+func readParquet(t *testing.T, path string) (map[int64]interface{}, map[string][]interface{}) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:4], parquetMagic) || !bytes.Equal(data[len(data)-4:], parquetMagic) {
+		t.Fatalf("%s misses the PAR1 magic", path)
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := &thriftReader{buf: data[len(data)-8-size : len(data)-8]}
+	meta := footer.structure()
+	if footer.pos != size {
+		t.Fatalf("footer of %d bytes decoded from %d", size, footer.pos)
+	}
+
+	schema := meta[2].([]interface{})
+	columns := make(map[string][]interface{})
+	for _, rowGroup := range meta[4].([]interface{}) {
+		for i, chunk := range rowGroup.(map[int64]interface{})[1].([]interface{}) {
+			element := schema[i+1].(map[int64]interface{})
+			chunkMeta := chunk.(map[int64]interface{})[3].(map[int64]interface{})
+			offset := chunkMeta[9].(int64)
+			pageReader := &thriftReader{buf: data[offset:]}
+			header := pageReader.structure()
+			start := int(offset) + pageReader.pos
+			page := data[start : start+int(header[3].(int64))]
+			if int64(pageReader.pos+len(page)) != chunkMeta[7].(int64) {
+				t.Fatalf("column %s: chunk size %d does not match the page", element[4], chunkMeta[7])
+			}
+			if chunkMeta[4].(int64) == parquetGzip {
+				gz, err := gzip.NewReader(bytes.NewReader(page))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page, err = ioutil.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if int64(len(page)) != header[2].(int64) {
+				t.Fatalf("column %s: page of %d bytes, expected %d", element[4], len(page), header[2])
+			}
+
+			count := int(header[5].(map[int64]interface{})[1].(int64))
+			present := make([]bool, 0, count)
+			if element[3].(int64) == parquetOptional {
+				length := int(binary.LittleEndian.Uint32(page))
+				levels := &thriftReader{buf: page[4 : 4+length]}
+				for levels.pos < length {
+					run := int(levels.uvarint() >> 1)
+					for j := 0; j < run; j++ {
+						present = append(present, levels.buf[levels.pos] == 1)
+					}
+					levels.pos++
+				}
+				page = page[4+length:]
+			} else {
+				for j := 0; j < count; j++ {
+					present = append(present, true)
+				}
+			}
+			if len(present) != count {
+				t.Fatalf("column %s: %d definition levels for %d values", element[4], len(present), count)
+			}
+
+			name := element[4].(string)
+			bit := 0
+			for _, ok := range present {
+				if !ok {
+					columns[name] = append(columns[name], nil)
+					continue
+				}
+				var value interface{}
+				switch element[1].(int64) {
+				case parquetInt64:
+					value = int64(binary.LittleEndian.Uint64(page))
+					if element[6] == int64(parquetUint64) {
+						value = binary.LittleEndian.Uint64(page)
+					}
+					page = page[8:]
+				case parquetDouble:
+					value = math.Float64frombits(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+				case parquetBoolean:
+					value = page[bit/8]>>uint(bit%8)&1 == 1
+					bit++
+				case parquetByteArray:
+					length := binary.LittleEndian.Uint32(page)
+					value = string(page[4 : 4+length])
+					page = page[4+length:]
+				}
+				columns[name] = append(columns[name], value)
+			}
+		}
+	}
+	return meta, columns
+}
+
+func TestWriteParquet(t *testing.T) {
+	columns := []string{"time", "b", "f", "i", "s", "u"}
+	windows := [][]models.Row{
+		{{
+			Name:    "m",
+			Tags:    map[string]string{"host": "a"},
+			Columns: columns,
+			Values: [][]interface{}{
+				{json.Number("1000"), true, json.Number("1.5"), json.Number("7"), "x", json.Number("18446744073709551615")},
+				{json.Number("2000"), nil, json.Number("2.5"), nil, "yy", json.Number("3")},
+			},
+		}},
+		{{
+			Name:    "m",
+			Columns: columns,
+			Values: [][]interface{}{
+				{json.Number("3000"), false, nil, json.Number("-4"), nil, nil},
+				{json.Number("4000"), true, json.Number("0.5"), json.Number("9"), "z", json.Number("1")},
+			},
+		}},
+		// An empty window only rewrites the footer
+		nil,
+	}
+	expected := map[string][]interface{}{
+		"time": {int64(1000), int64(2000), int64(3000), int64(4000)},
+		"host": {"a", "a", nil, nil},
+		"b":    {true, nil, false, true},
+		"f":    {1.5, 2.5, nil, 0.5},
+		"i":    {int64(7), nil, int64(-4), int64(9)},
+		"s":    {"x", "yy", nil, "z"},
+		"u":    {uint64(math.MaxUint64), uint64(3), nil, uint64(1)},
+	}
+
+	for _, compress := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "parquet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "m.parquet")
+		progress := &ExportProgress{
+			Measurement: "m",
+			Tags:        []string{"host"},
+			Fields:      map[string]string{"b": "boolean", "f": "float", "i": "integer", "s": "string", "u": "unsigned"},
+		}
+		write := func(series []models.Row) {
+			if _, err := os.Stat(path); err == nil {
+				if err := os.Truncate(path, progress.Offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rows, size, err := exportParquetWindow(ExportRequest{Compress: compress}, progress, path, series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			progress.Offset = size
+			progress.Rows += rows
+		}
+
+		write(windows[0])
+		// The second window is interrupted after writing part of a row group,
+		// the export resumes from the progress saved after the first one
+		saved, _ := json.Marshal(progress)
+		write(windows[1])
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("partial row group"))
+		file.Close()
+		progress = &ExportProgress{}
+		if err := json.Unmarshal(saved, progress); err != nil {
+			t.Fatal(err)
+		}
+		write(windows[1])
+		write(windows[2])
+
+		meta, values := readParquet(t, path)
+		if meta[3].(int64) != 4 || progress.Rows != 4 {
+			t.Errorf("compress %v: %d rows in the file and %d exported, expected 4", compress, meta[3], progress.Rows)
+		}
+		if len(meta[4].([]interface{})) != 2 || len(progress.RowGroups) != 2 {
+			t.Errorf("compress %v: %d row groups, expected 2", compress, len(meta[4].([]interface{})))
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("compress %v: read %v, expected %v", compress, values, expected)
+		}
+
+		unsigned := meta[2].([]interface{})[7].(map[int64]interface{})
+		integer, _ := unsigned[10].(map[int64]interface{})[10].(map[int64]interface{})
+		if unsigned[4] != "u" || unsigned[6] != int64(parquetUint64) || integer[1] != int64(64) || integer[2] != false {
+			t.Errorf("compress %v: unsigned column not annotated as UINT_64: %v", compress, unsigned)
+		}
+	}
+}
@@ -25,14 +25,16 @@ package dbmanager
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"regexp"
+	"sync"
+	"time"
 
 	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
 	common "influxdbconnector/common"
-	inflxUtil "influxdbconnector/util/influxdb"
+	metrics "influxdbconnector/metrics"
 
 	"github.com/golang/glog"
-	"github.com/influxdata/influxdb/client/v2"
 	"strings"
 )
 
@@ -43,55 +45,147 @@ type InfluxQuery struct {
 	queryWhitelistValidator *regexp.Regexp
 	queryBlacklistValidator *regexp.Regexp
 	QueryListcon map[string][]string
+	// rulesMutex guards QueryListcon, the blacklist validator and SubTopics
+	// which are swapped on config changes
+	rulesMutex   sync.RWMutex
+	StreamTopic  string
+	StreamOut    common.TopicPublisher
+	// MaxStreams is the number of result sets streamed at once, the stream
+	// requests beyond it are rejected
+	MaxStreams   int
+	SubTopics    []string
+	// Backup runs the backup requests, nil when backups are not configured
+	Backup *InfluxBackup
+	// Export runs the export requests, nil when exports are not configured
+	Export *InfluxExport
+	// Import reports the imported files, nil when imports are not configured
+	Import *InfluxImport
+	// Disk reports the disk usage, nil when it is not monitored
+	Disk *InfluxDiskMonitor
+	// streams are the result sets being published in the background,
+	// activeStreams counts them and streamsStopped is set by StopStreams
+	streams        sync.WaitGroup
+	streamsMutex   sync.Mutex
+	activeStreams  int
+	streamsStopped bool
 }
 
-// QueryInflux will block the blacklist queries, execute the select command and
-// return the response
+// queryOps are the ops of the query service, the other ones are counted as
+// unsupported in the metrics
+var queryOps = map[string]bool{
+	"describe": true, "backup": true, "list_backups": true, "restore": true, "export": true,
+	"export_status": true, "import_status": true, "disk_usage": true,
+}
+
+// QueryInflux will run the request and record its count and latency in the
+// metrics
 func (iq *InfluxQuery) QueryInflux(msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	start := time.Now()
+	response, err := iq.queryInflux(msg)
+
+	kind := languageInfluxQL
+	if op, present := msg.Data["op"]; present {
+		kind = "unsupported"
+		if name, ok := op.(string); ok && queryOps[name] {
+			kind = name
+		}
+	} else if language, _ := queryLanguage(msg); language == languageFlux {
+		kind = languageFlux
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Queries.Inc(kind, result)
+	metrics.QueryDuration.Observe(time.Since(start).Seconds(), kind)
+	return response, err
+}
+
+// queryInflux will block the blacklist queries, execute the select command and
+// return the response
+func (iq *InfluxQuery) queryInflux(msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
 	var validQuery bool
 	var invalidQuery bool
-	clientadmin, err := inflxUtil.CreateHTTPClient(iq.DbInfo.Host, iq.DbInfo.Port, iq.DbInfo.Username, iq.DbInfo.Password, iq.CnInfo.DevMode)
 
+	if op, present := msg.Data["op"]; present {
+		switch op {
+		case "describe":
+			return iq.Describe()
+		case "backup":
+			return iq.TriggerBackup()
+		case "list_backups":
+			return iq.ListBackups()
+		case "restore":
+			return iq.RestoreBackup(msg)
+		case "export":
+			return iq.ExportData(msg)
+		case "export_status":
+			return iq.ExportStatus(msg)
+		case "import_status":
+			return iq.ImportStatuses()
+		case "disk_usage":
+			return iq.DiskUsage()
+		}
+		val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+		return val, fmt.Errorf("Unsupported op: %v", op)
+	}
+
+	language, err := queryLanguage(msg)
 	if err != nil {
-		glog.Errorf("client error %s", err)
+		val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+		return val, err
 	}
 	command, ok := msg.Data["command"].(string)
-	cmdL := strings.ToLower(command)
-	if len(iq.QueryListcon) == 0 {
-		invalidQuery = false
+	if ok && language == languageFlux {
+		return iq.QueryFlux(command, msg)
+	}
+
+	store, err := NewTimeSeriesStore(iq.DbInfo, iq.CnInfo.DevMode)
+
+	if err != nil {
+		glog.Errorf("client error %s", err)
 	} else {
-		invalidQuery = iq.queryBlacklistValidator.MatchString(cmdL)
+		defer store.Close()
 	}
+	cmdL := strings.ToLower(command)
+	invalidQuery = iq.isBlacklisted(cmdL)
 	if !invalidQuery {
 		validQuery = iq.queryWhitelistValidator.MatchString(cmdL)
+		if kind := matchShowStatement(cmdL); ok && err == nil && kind != "" {
+			return iq.queryShow(store, command, kind)
+		}
 	} else {
 		glog.Infof("Query is blacklisted")
+		metrics.QueriesRejected.Inc("blacklisted")
+	}
+	if !invalidQuery && !validQuery {
+		metrics.QueriesRejected.Inc("not_select")
 	}
 
-	if ok && validQuery {
-		q := client.Query{
+	if ok && validQuery && err == nil {
+		if stream, _ := msg.Data["stream"].(bool); stream {
+			return iq.streamQuery(command, msg)
+		}
+
+		q := StoreQuery{
 			Command:   command,
 			Database:  iq.DbInfo.Database,
 			Precision: "ns",
 		}
 
-		if response, err := clientadmin.Query(q); err == nil {
-
-			if response.Error() != nil {
-				glog.V(1).Infof("Response received: %v", response)
-				glog.V(1).Infof("Response Error received: %v", response.Error())
-			} else {
-				if len(response.Results[0].Series) > 0 {
-					output := response.Results[0].Series[0]
-					glog.V(1).Infof("%v", output)
-					Output, err := json.Marshal(output)
-					response := types.NewMsgEnvelope(map[string]interface{}{"Data": string(Output)}, nil)
-					return response, err
-				}
-				val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
-				err = errors.New("Response is nil")
-				return val, err
+		if series, err := store.Query(q); err == nil {
+			if len(series) > 0 {
+				output := series[0]
+				glog.V(1).Infof("%v", output)
+				Output, err := json.Marshal(output)
+				response := types.NewMsgEnvelope(map[string]interface{}{"Data": string(Output)}, nil)
+				return response, err
 			}
+			val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+			err = errors.New("Response is nil")
+			return val, err
+		} else {
+			glog.V(1).Infof("Response Error received: %v", err)
 		}
 
 	}
@@ -104,9 +198,57 @@ func (iq *InfluxQuery) QueryInflux(msg *types.MsgEnvelope) (*types.MsgEnvelope,
 
 // Init function to check if select query is passed and forming regular expression for black list queries.
 func (iq *InfluxQuery) Init() {
+	validator, err := blacklistValidator(iq.QueryListcon["BlacklistQueryList"])
+	if err != nil {
+		glog.Fatalf("Invalid blacklist_query: %v", err)
+	}
+	iq.queryBlacklistValidator = validator
+	iq.queryWhitelistValidator = regexp.MustCompile("^(select\\s+.*)")
+}
+
+// SetQueryList will swap the blacklisted queries used by the next requests,
+// the current ones are kept when the new list is invalid
+func (iq *InfluxQuery) SetQueryList(queryList map[string][]string) error {
+	validator, err := blacklistValidator(queryList["BlacklistQueryList"])
+	if err != nil {
+		return err
+	}
+	iq.rulesMutex.Lock()
+	defer iq.rulesMutex.Unlock()
+	iq.QueryListcon = queryList
+	iq.queryBlacklistValidator = validator
+	return nil
+}
+
+// SetSubTopics will replace the subscriber topics reported by describe
+func (iq *InfluxQuery) SetSubTopics(subTopics []string) {
+	iq.rulesMutex.Lock()
+	defer iq.rulesMutex.Unlock()
+	iq.SubTopics = subTopics
+}
+
+func (iq *InfluxQuery) subscriberTopics() []string {
+	iq.rulesMutex.RLock()
+	defer iq.rulesMutex.RUnlock()
+	return iq.SubTopics
+}
+
+// isBlacklisted will check the lower case query against the blacklist
+func (iq *InfluxQuery) isBlacklisted(cmdL string) bool {
+	iq.rulesMutex.RLock()
+	defer iq.rulesMutex.RUnlock()
+	if len(iq.QueryListcon["BlacklistQueryList"]) == 0 {
+		return false
+	}
+	return iq.queryBlacklistValidator.MatchString(cmdL)
+}
+
+// blacklistValidator will form the regular expression matching the queries
+// containing elements of the blacklist
+func blacklistValidator(blacklistQueries []string) (*regexp.Regexp, error) {
 	var blacklist string
 
-	for _,value := range iq.QueryListcon["BlacklistQueryList"] {
+	for _,value := range blacklistQueries {
 		value = strings.ToLower(value)
 		// Regex is used for matching the query containing elements of Blacklist QueryList.Here '\s+' is used to match one or more whitespace charecter
                 // and '.*' is used to match zero or more number of any characters. '^' signifies start of the line and '$' signifies end of the line.
@@ -118,6 +260,5 @@ func (iq *InfluxQuery) Init() {
 		}
 	}
 
-	iq.queryBlacklistValidator = regexp.MustCompile("(" + blacklist + ")")
-	iq.queryWhitelistValidator = regexp.MustCompile("^(select\\s+.*)")
+	return regexp.Compile("(" + blacklist + ")")
 }
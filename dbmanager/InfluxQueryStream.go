@@ -0,0 +1,256 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	defaultStreamBatchSize = 1000
+	maxStreamBatchSize     = 10000
+)
+
+// errStreamStopped ends the streams stopped by StopStreams
+var errStreamStopped = errors.New("query results are not streamed while stopping")
+
+// streamQuery will acknowledge the request with the stream id and topic and
+// publish the result set in batches on the stream topic in the background
+func (iq *InfluxQuery) streamQuery(command string, msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	if iq.StreamOut == nil || iq.StreamTopic == "" {
+		val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+		return val, errors.New("Streaming of query results is not enabled")
+	}
+
+	batchSize := defaultStreamBatchSize
+	if value, ok := msg.Data["batch_size"]; ok {
+		size, err := toInt(value)
+		if err != nil || size <= 0 || size > maxStreamBatchSize {
+			val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+			return val, errors.New("batch_size must be between 1 and " + strconv.Itoa(maxStreamBatchSize))
+		}
+		batchSize = size
+	}
+
+	streamID, ok := msg.Data["correlation_id"].(string)
+	if !ok || streamID == "" {
+		streamID = newStreamID()
+	}
+
+	iq.streamsMutex.Lock()
+	if iq.streamsStopped {
+		iq.streamsMutex.Unlock()
+		val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+		return val, errStreamStopped
+	}
+	// Every stream holds its own store connection until the result set is
+	// published
+	if iq.activeStreams >= iq.MaxStreams {
+		iq.streamsMutex.Unlock()
+		val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+		return val, errors.New("Too many query results are being streamed, at most " + strconv.Itoa(iq.MaxStreams))
+	}
+	iq.activeStreams++
+	iq.streams.Add(1)
+	iq.streamsMutex.Unlock()
+
+	// The language was checked before the query was validated
+	language, _ := queryLanguage(msg)
+	go func() {
+		defer iq.streams.Done()
+		defer iq.endStream()
+		iq.publishStream(command, language, streamID, batchSize)
+	}()
+
+	val := types.NewMsgEnvelope(map[string]interface{}{
+		"Data":        "",
+		"StreamID":    streamID,
+		"StreamTopic": iq.StreamTopic,
+	}, nil)
+	return val, nil
+}
+
+// publishStream will run the query and publish every batch of rows as the
+// chunks are received, followed by an end-of-stream marker
+func (iq *InfluxQuery) publishStream(command string, language string, streamID string, batchSize int) {
+	seq := 0
+	rows := 0
+	publish := func(tables []models.Row) error {
+		if iq.isStreamsStopped() {
+			return errStreamStopped
+		}
+		for _, series := range tables {
+			for start := 0; start < len(series.Values); start += batchSize {
+				end := start + batchSize
+				if end > len(series.Values) {
+					end = len(series.Values)
+				}
+				batch := models.Row{
+					Name:    series.Name,
+					Tags:    series.Tags,
+					Columns: series.Columns,
+					Values:  series.Values[start:end],
+				}
+				if err := iq.publishBatch(streamID, seq, batch); err != nil {
+					glog.Errorf("Failed to publish stream %s batch %d: %v", streamID, seq, err)
+					return err
+				}
+				seq++
+				rows += end - start
+			}
+		}
+		return nil
+	}
+
+	var streamErr string
+	if err := iq.fetchSeries(command, language, batchSize, publish); err != nil {
+		streamErr = err.Error()
+	}
+
+	glog.Infof("Stream %s completed with %d rows in %d batches", streamID, rows, seq)
+	iq.publishEndOfStream(streamID, seq, rows, streamErr)
+}
+
+// StopStreams will stop publishing the result sets after their current chunk,
+// the streams end with an error
+func (iq *InfluxQuery) StopStreams() {
+	iq.streamsMutex.Lock()
+	defer iq.streamsMutex.Unlock()
+	iq.streamsStopped = true
+}
+
+// WaitStreams will wait for the streams to end, until the deadline of ctx
+func (iq *InfluxQuery) WaitStreams(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		iq.streams.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (iq *InfluxQuery) endStream() {
+	iq.streamsMutex.Lock()
+	defer iq.streamsMutex.Unlock()
+	iq.activeStreams--
+}
+
+func (iq *InfluxQuery) isStreamsStopped() bool {
+	iq.streamsMutex.Lock()
+	defer iq.streamsMutex.Unlock()
+	return iq.streamsStopped
+}
+
+// fetchSeries will run the query in the given language and call each with
+// the series of every chunk of the result set. A Flux result set comes in
+// one chunk.
+func (iq *InfluxQuery) fetchSeries(command string, language string, batchSize int, each func([]models.Row) error) error {
+	if language == languageFlux {
+		tables, err := iq.fluxQuery(command)
+		if err != nil {
+			return err
+		}
+		return each(tables)
+	}
+
+	store, err := NewTimeSeriesStore(iq.DbInfo, iq.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("client error %s", err)
+		return err
+	}
+	defer store.Close()
+
+	return store.QueryChunks(StoreQuery{
+		Command:   command,
+		Database:  iq.DbInfo.Database,
+		Precision: "ns",
+		ChunkSize: batchSize,
+	}, each)
+}
+
+func (iq *InfluxQuery) publishBatch(streamID string, seq int, batch models.Row) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	msg := map[string]interface{}{
+		"stream_id": streamID,
+		"seq":       int64(seq),
+		"eos":       false,
+		"data":      string(data),
+	}
+	return iq.StreamOut.Publish(iq.StreamTopic, msg)
+}
+
+func (iq *InfluxQuery) publishEndOfStream(streamID string, seq int, rows int, streamErr string) {
+	msg := map[string]interface{}{
+		"stream_id": streamID,
+		"seq":       int64(seq),
+		"eos":       true,
+		"rows":      int64(rows),
+		"error":     streamErr,
+	}
+	if err := iq.StreamOut.Publish(iq.StreamTopic, msg); err != nil {
+		glog.Errorf("Failed to publish end of stream %s: %v", streamID, err)
+	}
+}
+
+func newStreamID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		glog.Errorf("Failed to generate stream id: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// toInt will convert the numeric values received in the message envelope
+// to int
+func toInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, errors.New("Not a valid number")
+}
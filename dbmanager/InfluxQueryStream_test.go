@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	common "influxdbconnector/common"
+
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+// blockingPublisher holds every stream until release is closed
+type blockingPublisher struct {
+	release chan struct{}
+}
+
+func (bp *blockingPublisher) Publish(topic string, msg map[string]interface{}) error {
+	<-bp.release
+	return nil
+}
+
+func TestStreamQueryLimit(t *testing.T) {
+	publisher := &blockingPublisher{release: make(chan struct{})}
+	iq := &InfluxQuery{
+		DbInfo:      common.DbCredential{Database: "datain", DryRun: true},
+		StreamTopic: "query_results",
+		StreamOut:   publisher,
+		MaxStreams:  1,
+	}
+	request := func() error {
+		msg := types.NewMsgEnvelope(map[string]interface{}{"command": "select * from cpu", "stream": true}, nil)
+		_, err := iq.streamQuery("select * from cpu", msg)
+		return err
+	}
+
+	if err := request(); err != nil {
+		t.Fatalf("first stream rejected: %v", err)
+	}
+	if err := request(); err == nil {
+		t.Fatal("second stream accepted beyond query_max_streams")
+	}
+
+	close(publisher.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := iq.WaitStreams(ctx); err != nil {
+		t.Fatalf("stream did not end: %v", err)
+	}
+	if err := request(); err != nil {
+		t.Errorf("stream rejected once the previous one ended: %v", err)
+	}
+	if err := iq.WaitStreams(ctx); err != nil {
+		t.Fatalf("stream did not end: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+)
+
+// userLedgerPath records the users created by the connector, per database
+// of the connector, the other ones are never dropped
+const userLedgerPath = "/influxdata/connector/users.json"
+
+// privileges maps the configured privilege to the one shown by InfluxDB
+var privileges = map[string]string{
+	"READ":  "READ",
+	"WRITE": "WRITE",
+	"ALL":   "ALL PRIVILEGES",
+}
+
+// Reconcile will make the databases, retention policies, continuous queries
+// and users of InfluxDB match the configuration. It only adds and updates,
+// except for the retention policies, continuous queries and users of the
+// connector which are dropped once removed from the configuration.
+func (idbMgr *InfluxDBManager) Reconcile() error {
+	idbMgr.reconcileMutex.Lock()
+	defer idbMgr.reconcileMutex.Unlock()
+	return idbMgr.reconcile(nil)
+}
+
+// ApplyConfig will reconcile InfluxDB with the updated configuration and
+// drop the users removed from it
+func (idbMgr *InfluxDBManager) ApplyConfig(dbInfo common.DbCredential) error {
+	idbMgr.reconcileMutex.Lock()
+	defer idbMgr.reconcileMutex.Unlock()
+
+	configured := make(map[string]bool)
+	for _, user := range dbInfo.Users {
+		configured[user.Name] = true
+	}
+	var removed []string
+	for _, user := range idbMgr.DbInfo.Users {
+		if !configured[user.Name] && user.Name != idbMgr.DbInfo.Username {
+			removed = append(removed, user.Name)
+		}
+	}
+
+	idbMgr.DbInfo.RetentionPolicies = dbInfo.RetentionPolicies
+	idbMgr.DbInfo.Downsampling = dbInfo.Downsampling
+	idbMgr.DbInfo.Databases = dbInfo.Databases
+	idbMgr.DbInfo.Users = dbInfo.Users
+	return idbMgr.reconcile(removed)
+}
+
+func (idbMgr *InfluxDBManager) reconcile(removedUsers []string) error {
+	// Nothing configured still drops the retention policies and continuous
+	// queries of the connector removed from the configuration
+	dbInfo := idbMgr.DbInfo
+	if dbInfo.DryRun {
+		glog.Warningf("Databases, retention policies and users are not reconciled in dry run mode")
+		return nil
+	}
+	if dbInfo.Backend == BackendInfluxDB2 {
+		glog.Warningf("Databases, retention policies and users are not reconciled with %s", BackendInfluxDB2)
+		return nil
+	}
+
+	err := validateSpec(dbInfo)
+	if err != nil {
+		glog.Errorf("Invalid InfluxDB configuration: %v", err)
+		return err
+	}
+
+	store, err := NewTimeSeriesStore(dbInfo, idbMgr.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("Error creating InfluxDB client: %v", err)
+		return err
+	}
+	defer store.Close()
+
+	ledger, err := loadPolicyLedger(policyLedgerPath)
+	if err != nil {
+		glog.Errorf("Error reading the retention policies of the connector: %v", err)
+		return err
+	}
+	defer func() {
+		if err := ledger.save(); err != nil {
+			glog.Errorf("Error recording the retention policies of the connector: %v", err)
+		}
+	}()
+
+	err = reconcileRetention(store, dbInfo, ledger)
+	if err != nil {
+		return err
+	}
+
+	for _, db := range dbInfo.Databases {
+		if db.Name == dbInfo.Database {
+			// The retention policies of the configured database are kept
+			db.RetentionPolicies = append(append([]common.RetentionPolicy{},
+				dbInfo.RetentionPolicies...), db.RetentionPolicies...)
+		}
+		err = reconcileDatabase(store, db, ledger)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A failed authentication tells the password changed, it can't be read
+	// back from InfluxDB
+	passwordMatches := func(user string, password string) bool {
+		userStore, err := newInfluxStore(dbInfo, user, password, idbMgr.CnInfo.DevMode)
+		if err != nil {
+			return false
+		}
+		defer userStore.Close()
+		_, err = userStore.Query(StoreQuery{Command: "SHOW DATABASES"})
+		return err == nil
+	}
+	users, err := loadPolicyLedger(userLedgerPath)
+	if err != nil {
+		glog.Errorf("Error reading the users of the connector: %v", err)
+		return err
+	}
+	defer func() {
+		if err := users.save(); err != nil {
+			glog.Errorf("Error recording the users of the connector: %v", err)
+		}
+	}()
+
+	err = reconcileUsers(store, dbInfo, passwordMatches, users)
+	if err != nil {
+		return err
+	}
+	return dropUsers(store, dbInfo.Database, undeclaredUsers(dbInfo, users, removedUsers), users)
+}
+
+// undeclaredUsers will return the users to drop: the ones removed from the
+// configuration while running and the ones created by the connector which
+// are no longer declared, for example removed while it was down
+func undeclaredUsers(dbInfo common.DbCredential, users *policyLedger, removed []string) []string {
+	declared := map[string]bool{dbInfo.Username: true}
+	for _, user := range dbInfo.Users {
+		declared[user.Name] = true
+	}
+
+	names := append([]string{}, removed...)
+	seen := make(map[string]bool)
+	for _, name := range removed {
+		seen[name] = true
+	}
+	var created []string
+	if users != nil {
+		for name := range users.owned[dbInfo.Database] {
+			if !declared[name] && !seen[name] {
+				created = append(created, name)
+			}
+		}
+	}
+	sort.Strings(created)
+	return append(names, created...)
+}
+
+// validateSpec will check the whole configuration before touching InfluxDB
+func validateSpec(dbInfo common.DbCredential) error {
+	err := validateRetention(dbInfo)
+	if err != nil {
+		return err
+	}
+
+	databases := map[string]bool{dbInfo.Database: true}
+	for _, db := range dbInfo.Databases {
+		if db.Name == "" {
+			return errors.New("database name is empty")
+		}
+		if db.Name != dbInfo.Database && databases[db.Name] {
+			return errors.New("database " + db.Name + " is defined more than once")
+		}
+		databases[db.Name] = true
+		if _, err := validatePolicies(db.RetentionPolicies); err != nil {
+			return fmt.Errorf("database %s: %v", db.Name, err)
+		}
+	}
+
+	users := make(map[string]bool)
+	for _, user := range dbInfo.Users {
+		if user.Name == "" {
+			return errors.New("user name is empty")
+		}
+		if users[user.Name] {
+			return errors.New("user " + user.Name + " is defined more than once")
+		}
+		if user.Name == dbInfo.Username {
+			return errors.New("user " + user.Name + " is the admin user of the connector")
+		}
+		users[user.Name] = true
+		if user.PasswordEnv == "" || os.Getenv(user.PasswordEnv) == "" {
+			return errors.New("password of user " + user.Name + " is not set, password_env must name a non-empty environment variable")
+		}
+		for database, privilege := range user.Privileges {
+			if !databases[database] {
+				return fmt.Errorf("user %s: unknown database %s", user.Name, database)
+			}
+			if _, ok := privileges[strings.ToUpper(privilege)]; !ok {
+				return fmt.Errorf("user %s: invalid privilege %q on %s, expected READ, WRITE or ALL", user.Name, privilege, database)
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileDatabase will create the database if missing and reconcile its
+// retention policies, only the ones created by the connector are dropped
+func reconcileDatabase(store TimeSeriesStore, db common.DatabaseSpec, ledger *policyLedger) error {
+	// CREATE DATABASE does nothing when the database already exists
+	_, err := store.Query(StoreQuery{Command: "CREATE DATABASE " + quoteIdent(db.Name)})
+	if err != nil {
+		glog.Errorf("Error: %v while creating database: %s", err, db.Name)
+		return err
+	}
+
+	existing, err := createRetentionPolicies(store, db.Name, db.RetentionPolicies, ledger)
+	if err != nil {
+		return err
+	}
+	return dropRetentionPolicies(store, db.Name, db.RetentionPolicies, existing, ledger)
+}
+
+// quoteString will quote the InfluxQL string literal
+func quoteString(value string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + `'`
+}
+
+// reconcileUsers will create the missing users and update the password,
+// admin flag and privileges of the existing ones. The password is only set
+// when passwordMatches tells it changed. The created users are recorded in
+// the ledger.
+func reconcileUsers(store TimeSeriesStore, dbInfo common.DbCredential, passwordMatches func(user string, password string) bool, ledger *policyLedger) error {
+	if len(dbInfo.Users) == 0 {
+		return nil
+	}
+
+	series, err := store.Query(StoreQuery{Command: "SHOW USERS", Database: dbInfo.Database})
+	if err != nil {
+		glog.Errorf("Error: %v while reading the users", err)
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, row := range series {
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			admin, _ := record["admin"].(bool)
+			existing[toString(record["user"])] = admin
+		}
+	}
+
+	for _, user := range dbInfo.Users {
+		password := os.Getenv(user.PasswordEnv)
+
+		var commands []string
+		admin, ok := existing[user.Name]
+		if !ok {
+			command := "CREATE USER " + quoteIdent(user.Name) + " WITH PASSWORD " + quoteString(password)
+			if user.Admin {
+				command += " WITH ALL PRIVILEGES"
+			}
+			commands = append(commands, command)
+		} else {
+			if !passwordMatches(user.Name, password) {
+				commands = append(commands, "SET PASSWORD FOR "+quoteIdent(user.Name)+" = "+quoteString(password))
+			}
+			if user.Admin && !admin {
+				commands = append(commands, "GRANT ALL PRIVILEGES TO "+quoteIdent(user.Name))
+			} else if !user.Admin && admin {
+				commands = append(commands, "REVOKE ALL PRIVILEGES FROM "+quoteIdent(user.Name))
+			}
+		}
+
+		for _, command := range commands {
+			_, err = store.Query(StoreQuery{Command: command, Database: dbInfo.Database})
+			if err != nil {
+				glog.Errorf("Error: %v while reconciling user: %s", err, user.Name)
+				return err
+			}
+		}
+		if !ok {
+			ledger.add(dbInfo.Database, user.Name)
+		}
+
+		err = reconcileGrants(store, dbInfo.Database, user)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Reconciled user: %s", user.Name)
+	}
+	return nil
+}
+
+// reconcileGrants will grant the configured privileges to the user and
+// revoke the ones on the other databases
+func reconcileGrants(store TimeSeriesStore, database string, user common.UserSpec) error {
+	series, err := store.Query(StoreQuery{
+		Command:  "SHOW GRANTS FOR " + quoteIdent(user.Name),
+		Database: database,
+	})
+	if err != nil {
+		glog.Errorf("Error: %v while reading the grants of user: %s", err, user.Name)
+		return err
+	}
+	current := make(map[string]string)
+	for _, row := range series {
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			current[toString(record["database"])] = toString(record["privilege"])
+		}
+	}
+
+	var commands []string
+	for db, privilege := range user.Privileges {
+		privilege = strings.ToUpper(privilege)
+		if current[db] != privileges[privilege] {
+			commands = append(commands, "GRANT "+privilege+" ON "+quoteIdent(db)+" TO "+quoteIdent(user.Name))
+		}
+	}
+	for db, privilege := range current {
+		if _, ok := user.Privileges[db]; !ok && privilege != "NO PRIVILEGES" {
+			commands = append(commands, "REVOKE ALL ON "+quoteIdent(db)+" FROM "+quoteIdent(user.Name))
+		}
+	}
+
+	for _, command := range commands {
+		_, err = store.Query(StoreQuery{Command: command, Database: database})
+		if err != nil {
+			glog.Errorf("Error: %v while updating the privileges of user: %s", err, user.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// dropUsers will drop the users removed from the configuration and forget
+// them in the ledger
+func dropUsers(store TimeSeriesStore, database string, users []string, ledger *policyLedger) error {
+	for _, name := range users {
+		_, err := store.Query(StoreQuery{Command: "DROP USER " + quoteIdent(name), Database: database})
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			glog.Errorf("Error: %v while dropping user: %s", err, name)
+			return err
+		}
+		ledger.remove(database, name)
+		glog.Infof("Dropped user: %s", name)
+	}
+	return nil
+}
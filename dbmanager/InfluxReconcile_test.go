@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	common "influxdbconnector/common"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// userStore answers SHOW USERS with the given users and records the other
+// statements
+type userStore struct {
+	TimeSeriesStore
+	users    []string
+	commands []string
+}
+
+func (us *userStore) Query(q StoreQuery) ([]models.Row, error) {
+	switch q.Command {
+	case "SHOW USERS":
+		row := models.Row{Columns: []string{"user", "admin"}}
+		for _, user := range us.users {
+			row.Values = append(row.Values, []interface{}{user, false})
+		}
+		return []models.Row{row}, nil
+	case `SHOW GRANTS FOR "grafana"`, `SHOW GRANTS FOR "reports"`:
+		return nil, nil
+	}
+	us.commands = append(us.commands, q.Command)
+	return nil, nil
+}
+
+func TestReconcileUsersLedger(t *testing.T) {
+	os.Setenv("TEST_USER_PASSWORD", "secret")
+	defer os.Unsetenv("TEST_USER_PASSWORD")
+
+	// ops was created by the connector and removed from the config while it
+	// was down, legacy and admin were not created by it
+	ledger, _ := loadPolicyLedger("")
+	ledger.add("datain", "ops")
+	ledger.add("datain", "grafana")
+	ledger.add("other", "ops")
+	store := &userStore{users: []string{"admin", "grafana", "legacy", "ops"}}
+	dbInfo := common.DbCredential{
+		Database: "datain",
+		Username: "admin",
+		Users: []common.UserSpec{
+			{Name: "grafana", PasswordEnv: "TEST_USER_PASSWORD"},
+			{Name: "reports", PasswordEnv: "TEST_USER_PASSWORD"},
+		},
+	}
+	matches := func(user string, password string) bool { return true }
+
+	if err := reconcileUsers(store, dbInfo, matches, ledger); err != nil {
+		t.Fatalf("reconcileUsers failed: %v", err)
+	}
+	if err := dropUsers(store, dbInfo.Database, undeclaredUsers(dbInfo, ledger, []string{"legacy"}), ledger); err != nil {
+		t.Fatalf("dropUsers failed: %v", err)
+	}
+
+	expected := []string{
+		`CREATE USER "reports" WITH PASSWORD 'secret'`,
+		`DROP USER "legacy"`,
+		`DROP USER "ops"`,
+	}
+	if !reflect.DeepEqual(store.commands, expected) {
+		t.Errorf("statements %q, expected %q", store.commands, expected)
+	}
+	owned := map[string]map[string]bool{
+		"datain": {"grafana": true, "reports": true},
+		"other":  {"ops": true},
+	}
+	if !reflect.DeepEqual(ledger.owned, owned) {
+		t.Errorf("ledger %v, expected %v", ledger.owned, owned)
+	}
+}
+
+func TestUndeclaredUsers(t *testing.T) {
+	ledger, _ := loadPolicyLedger("")
+	ledger.add("datain", "b")
+	ledger.add("datain", "a")
+	ledger.add("datain", "admin")
+	dbInfo := common.DbCredential{Database: "datain", Username: "admin"}
+
+	if users := undeclaredUsers(dbInfo, ledger, []string{"b", "c"}); !reflect.DeepEqual(users, []string{"b", "c", "a"}) {
+		t.Errorf("undeclaredUsers = %v, expected [b c a]", users)
+	}
+	if users := undeclaredUsers(dbInfo, nil, nil); len(users) != 0 {
+		t.Errorf("undeclaredUsers without a ledger = %v, expected none", users)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+)
+
+const (
+	latestBackup     = "latest"
+	restoreTmpSuffix = "_restore"
+)
+
+// RestoreRequest structure
+type RestoreRequest struct {
+	// Backup is the name of the backup to restore or latest
+	Backup string
+	// Database is the database in the backup, the configured one by default
+	Database string
+	// NewDatabase is the database restored into, it can only be the
+	// configured database as the subscription and continuous queries are
+	// re-created for it only
+	NewDatabase string
+	// Overwrite drops NewDatabase before the restore when it exists
+	Overwrite bool
+}
+
+// restoreChain will return the full backup of the generation followed by its
+// incremental backups up to the requested one
+func (ib *InfluxBackup) restoreChain(name string) ([]BackupInfo, error) {
+	backups, err := ib.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, errors.New("no backup found in " + ib.Config.Directory)
+	}
+
+	target := len(backups) - 1
+	if name != latestBackup {
+		for target = len(backups) - 1; target >= 0; target-- {
+			if backups[target].Name == name {
+				break
+			}
+		}
+		if target < 0 {
+			return nil, errors.New("backup " + name + " not found")
+		}
+	}
+
+	var chain []BackupInfo
+	for _, backup := range backups[:target+1] {
+		if backup.Generation == backups[target].Generation {
+			chain = append(chain, backup)
+		}
+	}
+	if chain[0].Type != backupFull {
+		return nil, errors.New("full backup of generation " + chain[0].Generation + " is missing")
+	}
+	return chain, nil
+}
+
+// StartRestore will start restoring the backup in the background and return
+// the name of the restored backup
+func (ib *InfluxBackup) StartRestore(req RestoreRequest) (string, error) {
+	chain, err := ib.beginRestore(&req)
+	if err != nil {
+		return "", err
+	}
+	ib.jobs.Add(1)
+	go func() {
+		defer ib.jobs.Done()
+		ib.runRestore(req, chain)
+	}()
+	return chain[len(chain)-1].Name, nil
+}
+
+// Restore will restore the backup and wait for its completion
+func (ib *InfluxBackup) Restore(req RestoreRequest) error {
+	chain, err := ib.beginRestore(&req)
+	if err != nil {
+		return err
+	}
+	return ib.runRestore(req, chain)
+}
+
+// RestoreAtStartup will restore the configured backup when InfluxDB has no
+// data and the database does not exist
+func (ib *InfluxBackup) RestoreAtStartup(dataDirEmpty bool) error {
+	if ib.Config.RestoreFrom == "" {
+		return nil
+	}
+	if !dataDirEmpty {
+		glog.Infof("InfluxDB already has data, skipping the restore of %s", ib.Config.RestoreFrom)
+		return nil
+	}
+
+	store, err := NewTimeSeriesStore(ib.DbInfo, ib.CnInfo.DevMode)
+	if err != nil {
+		return err
+	}
+	exists, err := databaseExists(store, ib.DbInfo.Database)
+	store.Close()
+	if err != nil {
+		return err
+	}
+	if exists {
+		glog.Infof("Database %s already exists, skipping the restore of %s", ib.DbInfo.Database, ib.Config.RestoreFrom)
+		return nil
+	}
+
+	return ib.Restore(RestoreRequest{Backup: ib.Config.RestoreFrom})
+}
+
+func (ib *InfluxBackup) beginRestore(req *RestoreRequest) ([]BackupInfo, error) {
+	if req.Backup == "" {
+		req.Backup = latestBackup
+	}
+	if req.Database == "" {
+		req.Database = ib.DbInfo.Database
+	}
+	if req.NewDatabase == "" {
+		req.NewDatabase = ib.DbInfo.Database
+	}
+	if req.NewDatabase != ib.DbInfo.Database {
+		return nil, errors.New("backups can only be restored into database " + ib.DbInfo.Database)
+	}
+
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	if ib.running != "" {
+		return nil, errors.New(ib.running + " is already running")
+	}
+
+	chain, err := ib.restoreChain(req.Backup)
+	if err != nil {
+		return nil, err
+	}
+	ib.running = "restore of " + chain[len(chain)-1].Name
+	return chain, nil
+}
+
+func (ib *InfluxBackup) runRestore(req RestoreRequest, chain []BackupInfo) error {
+	name := chain[len(chain)-1].Name
+	err := ib.restore(req, chain)
+	if err == nil && ib.OnRestore != nil {
+		err = ib.OnRestore()
+	}
+
+	ib.mutex.Lock()
+	ib.running = ""
+	ib.lastErr = ""
+	if err != nil {
+		ib.lastErr = "restore of " + name + ": " + err.Error()
+	}
+	ib.mutex.Unlock()
+
+	if err != nil {
+		glog.Errorf("Restore of %s failed: %v", name, err)
+		return err
+	}
+	// The restored points are older than the last backup
+	ib.RequireFull()
+	glog.Infof("Restored %s into database %s", name, req.NewDatabase)
+	return nil
+}
+
+// restore will restore the full backup into the new database and merge the
+// incremental backups into it through a temporary database, as a portable
+// restore cannot write into an existing database
+func (ib *InfluxBackup) restore(req RestoreRequest, chain []BackupInfo) error {
+	store, err := NewTimeSeriesStore(ib.DbInfo, ib.CnInfo.DevMode)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	exists, err := databaseExists(store, req.NewDatabase)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !req.Overwrite {
+			return errors.New("database " + req.NewDatabase + " already exists, set overwrite to replace it")
+		}
+		glog.Warningf("Dropping database %s to restore %s", req.NewDatabase, chain[len(chain)-1].Name)
+		if err = dropDatabase(store, req.NewDatabase); err != nil {
+			return err
+		}
+	}
+
+	err = ib.influxdRestore(chain[0], req.Database, req.NewDatabase)
+	if err != nil {
+		return err
+	}
+
+	tmpDatabase := req.NewDatabase + restoreTmpSuffix
+	for _, backup := range chain[1:] {
+		if err = dropDatabase(store, tmpDatabase); err != nil {
+			return err
+		}
+		if err = ib.influxdRestore(backup, req.Database, tmpDatabase); err != nil {
+			return err
+		}
+		if err = mergeDatabase(store, tmpDatabase, req.NewDatabase); err != nil {
+			return err
+		}
+		if err = dropDatabase(store, tmpDatabase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ib *InfluxBackup) influxdRestore(backup BackupInfo, database string, newDatabase string) error {
+	glog.Infof("Restoring %s backup %s of %s into %s", backup.Type, backup.Name, database, newDatabase)
+	output, err := exec.Command(influxdBinary, "restore", "-portable", "-host", ib.Config.Host,
+		"-db", database, "-newdb", newDatabase, backup.Path).CombinedOutput()
+	if err != nil {
+		glog.Errorf("influxd restore output: %s", strings.TrimSpace(string(output)))
+		return err
+	}
+	glog.V(1).Infof("influxd restore output: %s", output)
+	return nil
+}
+
+// mergeDatabase will copy all the points of the source database into the
+// same retention policies and measurements of the target database
+func mergeDatabase(store TimeSeriesStore, source string, target string) error {
+	sourcePolicies, err := showRetentionPolicies(store, source)
+	if err != nil {
+		return err
+	}
+	targetPolicies, err := showRetentionPolicies(store, target)
+	if err != nil {
+		return err
+	}
+
+	for name, info := range sourcePolicies {
+		if _, ok := targetPolicies[name]; !ok {
+			_, err = store.Query(StoreQuery{
+				Command: "CREATE RETENTION POLICY " + quoteIdent(name) + " ON " + quoteIdent(target) +
+					" DURATION " + info.duration.String() + " REPLICATION 1",
+				Database: target,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = store.Query(StoreQuery{
+			Command: "SELECT * INTO " + quoteIdent(target) + "." + quoteIdent(name) + ".:MEASUREMENT FROM " +
+				quoteIdent(source) + "." + quoteIdent(name) + "./.*/ GROUP BY *",
+			Database: source,
+		})
+		if err != nil {
+			glog.Errorf("Error: %v while merging %s.%s into %s", err, source, name, target)
+			return err
+		}
+	}
+	return nil
+}
+
+func databaseExists(store TimeSeriesStore, database string) (bool, error) {
+	series, err := store.Query(StoreQuery{Command: "SHOW DATABASES"})
+	if err != nil {
+		return false, err
+	}
+	for _, row := range series {
+		for _, values := range row.Values {
+			if len(values) > 0 && toString(values[0]) == database {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// dropDatabase will drop the database, a missing database is not an error
+func dropDatabase(store TimeSeriesStore, database string) error {
+	_, err := store.Query(StoreQuery{Command: "DROP DATABASE " + quoteIdent(database)})
+	if err != nil {
+		glog.Errorf("Error: %v while dropping database: %s", err, database)
+	}
+	return err
+}
+
+// RestoreBackup will start restoring the backup requested in the message
+func (iq *InfluxQuery) RestoreBackup(msg *types.MsgEnvelope) (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+	if iq.Backup == nil {
+		return val, errBackupDisabled
+	}
+	if !iq.Backup.Config.AdminOps {
+		return val, errAdminOpsDisabled
+	}
+
+	var req RestoreRequest
+	req.Backup, _ = msg.Data["backup"].(string)
+	req.Database, _ = msg.Data["database"].(string)
+	req.NewDatabase, _ = msg.Data["new_database"].(string)
+	req.Overwrite, _ = msg.Data["overwrite"].(bool)
+
+	name, err := iq.Backup.StartRestore(req)
+	if err != nil {
+		return val, err
+	}
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": "", "Restore": name}, nil), nil
+}
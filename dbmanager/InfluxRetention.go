@@ -0,0 +1,446 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// downsamplePrefix marks the continuous queries owned by the connector,
+	// the other ones are left untouched
+	downsamplePrefix = "ds_"
+	defaultRetention = "autogen"
+	defaultAggregate = "mean"
+	// policyLedgerPath records the retention policies created by the
+	// connector, the other ones are left untouched
+	policyLedgerPath = "/influxdata/connector/retention_policies.json"
+)
+
+var (
+	aggregatePattern = regexp.MustCompile(`^[a-z_]+$`)
+	cqNamePattern    = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// reconcileRetention will make the retention policies and the downsampling
+// continuous queries of the database match the configuration. Missing ones
+// are created, changed ones updated and the removed ones dropped, as long as
+// the connector created them.
+func reconcileRetention(store TimeSeriesStore, dbInfo common.DbCredential, ledger *policyLedger) error {
+	existing, err := createRetentionPolicies(store, dbInfo.Database, dbInfo.RetentionPolicies, ledger)
+	if err != nil {
+		return err
+	}
+	err = reconcileContinuousQueries(store, dbInfo)
+	if err != nil {
+		return err
+	}
+	return dropRetentionPolicies(store, dbInfo.Database, dbInfo.RetentionPolicies, existing, ledger)
+}
+
+// policyLedger records the retention policies created by the connector per
+// database, the way the ds_ prefix marks its continuous queries. Only those
+// are dropped once removed from the configuration. A nil ledger owns none.
+// The users created by the connector are recorded the same way.
+type policyLedger struct {
+	path  string
+	owned map[string]map[string]bool
+}
+
+// loadPolicyLedger will read the ledger from the path, an empty path keeps
+// it in memory only
+func loadPolicyLedger(path string) (*policyLedger, error) {
+	ledger := &policyLedger{path: path, owned: make(map[string]map[string]bool)}
+	if path == "" {
+		return ledger, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ledger.owned); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return ledger, nil
+}
+
+func (pl *policyLedger) owns(database string, name string) bool {
+	return pl != nil && pl.owned[database][name]
+}
+
+func (pl *policyLedger) add(database string, name string) {
+	if pl == nil {
+		return
+	}
+	if pl.owned[database] == nil {
+		pl.owned[database] = make(map[string]bool)
+	}
+	pl.owned[database][name] = true
+}
+
+func (pl *policyLedger) remove(database string, name string) {
+	if pl == nil {
+		return
+	}
+	delete(pl.owned[database], name)
+	if len(pl.owned[database]) == 0 {
+		delete(pl.owned, database)
+	}
+}
+
+// save will write the ledger to its path
+func (pl *policyLedger) save() error {
+	if pl == nil || pl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(pl.owned, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pl.path), 0750); err != nil {
+		return err
+	}
+	tmp := pl.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pl.path)
+}
+
+// validateRetention will check the retention policies and downsampling
+// rules before touching the database
+func validateRetention(dbInfo common.DbCredential) error {
+	policies, err := validatePolicies(dbInfo.RetentionPolicies)
+	if err != nil {
+		return err
+	}
+	for _, rp := range dbInfo.RetentionPolicies {
+		if rp.Name == selfRetention {
+			return errors.New("retention policy " + selfRetention + " is reserved for the self monitoring")
+		}
+	}
+
+	// mapped holds the measurements written into each target retention
+	// policy, "" stands for all of them
+	mapped := make(map[string]map[string]bool)
+	for _, rule := range dbInfo.Downsampling {
+		if !policies[rule.From] || !policies[rule.To] {
+			return fmt.Errorf("downsampling of %q refers to an unknown retention policy", rule.Measurement)
+		}
+		if rule.From == rule.To {
+			return fmt.Errorf("downsampling of %q has the same source and target retention policy", rule.Measurement)
+		}
+		interval, err := common.ParseInfluxDuration(rule.Interval)
+		if err != nil || interval == 0 {
+			return fmt.Errorf("downsampling of %q has an invalid interval %q", rule.Measurement, rule.Interval)
+		}
+		if rule.Aggregate != "" && !aggregatePattern.MatchString(rule.Aggregate) {
+			return fmt.Errorf("downsampling of %q has an invalid aggregate %q", rule.Measurement, rule.Aggregate)
+		}
+		measurements := mapped[rule.To]
+		if measurements == nil {
+			measurements = make(map[string]bool)
+			mapped[rule.To] = measurements
+		}
+		if measurements[rule.Measurement] || measurements[""] || (rule.Measurement == "" && len(measurements) > 0) {
+			return fmt.Errorf("downsampling of %q conflicts with another rule writing into %s", rule.Measurement, rule.To)
+		}
+		measurements[rule.Measurement] = true
+	}
+	return nil
+}
+
+// validatePolicies will check the retention policies of a database and
+// return their names along with autogen
+func validatePolicies(retentionPolicies []common.RetentionPolicy) (map[string]bool, error) {
+	policies := map[string]bool{defaultRetention: true}
+	defaults := 0
+	for _, rp := range retentionPolicies {
+		if rp.Name == "" {
+			return nil, errors.New("retention policy name is empty")
+		}
+		if rp.Name != defaultRetention && policies[rp.Name] {
+			return nil, errors.New("retention policy " + rp.Name + " is defined more than once")
+		}
+		policies[rp.Name] = true
+		if _, err := common.ParseInfluxDuration(rp.Duration); err != nil {
+			return nil, fmt.Errorf("retention policy %s: %v", rp.Name, err)
+		}
+		if rp.ShardDuration != "" {
+			if _, err := common.ParseInfluxDuration(rp.ShardDuration); err != nil {
+				return nil, fmt.Errorf("retention policy %s: %v", rp.Name, err)
+			}
+		}
+		if rp.Replication < 0 {
+			return nil, fmt.Errorf("retention policy %s: invalid replication %d", rp.Name, rp.Replication)
+		}
+		if rp.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return nil, errors.New("only one retention policy can be the default")
+	}
+	return policies, nil
+}
+
+// quoteIdent will quote the InfluxQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// retentionInfo structure
+type retentionInfo struct {
+	duration      time.Duration
+	shardDuration time.Duration
+	replication   int64
+	isDefault     bool
+}
+
+// showRetentionPolicies will return the retention policies of the database
+// by name
+func showRetentionPolicies(store TimeSeriesStore, database string) (map[string]retentionInfo, error) {
+	series, err := store.Query(StoreQuery{
+		Command:  "SHOW RETENTION POLICIES ON " + quoteIdent(database),
+		Database: database,
+	})
+	if err != nil {
+		glog.Errorf("Error: %v while reading the retention policies of %s", err, database)
+		return nil, err
+	}
+
+	policies := make(map[string]retentionInfo)
+	for _, row := range series {
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			var info retentionInfo
+			info.duration, _ = time.ParseDuration(toString(record["duration"]))
+			info.shardDuration, _ = time.ParseDuration(toString(record["shardGroupDuration"]))
+			info.replication, _ = toInt64(record["replicaN"])
+			info.isDefault, _ = record["default"].(bool)
+			policies[toString(record["name"])] = info
+		}
+	}
+	return policies, nil
+}
+
+// createRetentionPolicies will create the missing retention policies and
+// alter the changed ones, it returns the policies found in the database.
+// The created ones are recorded in the ledger.
+func createRetentionPolicies(store TimeSeriesStore, database string, policies []common.RetentionPolicy, ledger *policyLedger) (map[string]retentionInfo, error) {
+	existing, err := showRetentionPolicies(store, database)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rp := range policies {
+		duration, _ := common.ParseInfluxDuration(rp.Duration)
+		shardDuration, _ := common.ParseInfluxDuration(rp.ShardDuration)
+		replication := rp.Replication
+		if replication == 0 {
+			replication = 1
+		}
+
+		var command string
+		info, ok := existing[rp.Name]
+		if !ok {
+			command = "CREATE RETENTION POLICY " + quoteIdent(rp.Name) + " ON " + quoteIdent(database) +
+				" DURATION " + rp.Duration
+		} else if info.duration != duration || info.replication != int64(replication) ||
+			(rp.ShardDuration != "" && info.shardDuration != shardDuration) || (rp.Default && !info.isDefault) {
+			command = "ALTER RETENTION POLICY " + quoteIdent(rp.Name) + " ON " + quoteIdent(database) +
+				" DURATION " + rp.Duration
+		} else {
+			continue
+		}
+		command += " REPLICATION " + strconv.Itoa(replication)
+		if rp.ShardDuration != "" {
+			command += " SHARD DURATION " + rp.ShardDuration
+		}
+		if rp.Default {
+			command += " DEFAULT"
+		}
+
+		_, err = store.Query(StoreQuery{Command: command, Database: database})
+		if err != nil {
+			glog.Errorf("Error: %v while reconciling retention policy: %s.%s", err, database, rp.Name)
+			return nil, err
+		}
+		if !ok {
+			ledger.add(database, rp.Name)
+		}
+		glog.Infof("Reconciled retention policy: %s.%s", database, rp.Name)
+	}
+	return existing, nil
+}
+
+// dropRetentionPolicies will drop the retention policies created by the
+// connector and removed from the configuration. The policies the connector
+// did not create, autogen, the self monitoring and the default policy are
+// always kept.
+func dropRetentionPolicies(store TimeSeriesStore, database string, policies []common.RetentionPolicy, existing map[string]retentionInfo, ledger *policyLedger) error {
+	configured := make(map[string]bool)
+	for _, rp := range policies {
+		configured[rp.Name] = true
+	}
+
+	for name, info := range existing {
+		if configured[name] || !ledger.owns(database, name) ||
+			name == defaultRetention || name == selfRetention || info.isDefault {
+			continue
+		}
+		_, err := store.Query(StoreQuery{
+			Command:  "DROP RETENTION POLICY " + quoteIdent(name) + " ON " + quoteIdent(database),
+			Database: database,
+		})
+		if err != nil {
+			glog.Errorf("Error: %v while dropping retention policy: %s.%s", err, database, name)
+			return err
+		}
+		ledger.remove(database, name)
+		glog.Infof("Dropped retention policy: %s.%s", database, name)
+	}
+	return nil
+}
+
+// continuousQuery will return the name and the statement of the continuous
+// query of the downsampling rule. The name ends with a hash of the statement
+// so a changed rule is replaced by a new continuous query.
+func continuousQuery(database string, rule common.DownsampleRule) (string, string) {
+	aggregate := rule.Aggregate
+	if aggregate == "" {
+		aggregate = defaultAggregate
+	}
+
+	from := "/.*/"
+	into := ":MEASUREMENT"
+	target := "all"
+	if rule.Measurement != "" {
+		from = quoteIdent(rule.Measurement)
+		into = quoteIdent(rule.Measurement)
+		target = rule.Measurement
+	}
+
+	query := "SELECT " + aggregate + "(*) INTO " + quoteIdent(database) + "." + quoteIdent(rule.To) + "." + into +
+		" FROM " + quoteIdent(database) + "." + quoteIdent(rule.From) + "." + from +
+		" GROUP BY time(" + rule.Interval + "), *"
+
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	name := downsamplePrefix + cqNamePattern.ReplaceAllString(target+"_"+rule.To, "_") +
+		"_" + strconv.FormatUint(uint64(hash.Sum32()), 16)
+
+	statement := "CREATE CONTINUOUS QUERY " + quoteIdent(name) + " ON " + quoteIdent(database) +
+		" BEGIN " + query + " END"
+	return name, statement
+}
+
+// reconcileContinuousQueries will create the continuous queries of the
+// downsampling rules and drop the ones of the removed or changed rules
+func reconcileContinuousQueries(store TimeSeriesStore, dbInfo common.DbCredential) error {
+	database := dbInfo.Database
+	series, err := store.Query(StoreQuery{
+		Command:  "SHOW CONTINUOUS QUERIES",
+		Database: database,
+	})
+	if err != nil {
+		glog.Errorf("Error: %v while reading the continuous queries", err)
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, row := range series {
+		if row.Name != database {
+			continue
+		}
+		for _, values := range row.Values {
+			name := toString(rowRecord(row, values)["name"])
+			if strings.HasPrefix(name, downsamplePrefix) {
+				existing[name] = true
+			}
+		}
+	}
+
+	wanted := make(map[string]string)
+	for _, rule := range dbInfo.Downsampling {
+		name, statement := continuousQuery(database, rule)
+		wanted[name] = statement
+	}
+
+	for name := range existing {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+		_, err = store.Query(StoreQuery{
+			Command:  "DROP CONTINUOUS QUERY " + quoteIdent(name) + " ON " + quoteIdent(database),
+			Database: database,
+		})
+		if err != nil {
+			glog.Errorf("Error: %v while dropping continuous query: %s", err, name)
+			return err
+		}
+		glog.Infof("Dropped continuous query: %s", name)
+	}
+
+	for name, statement := range wanted {
+		if existing[name] {
+			continue
+		}
+		_, err = store.Query(StoreQuery{Command: statement, Database: database})
+		if err != nil {
+			glog.Errorf("Error: %v while creating continuous query: %s", err, name)
+			return err
+		}
+		glog.Infof("Created continuous query: %s", name)
+	}
+	return nil
+}
+
+// rowRecord will map the columns of the row to the values
+func rowRecord(row models.Row, values []interface{}) map[string]interface{} {
+	record := make(map[string]interface{}, len(row.Columns))
+	for i, column := range row.Columns {
+		if i < len(values) {
+			record[column] = values[i]
+		}
+	}
+	return record
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	common "influxdbconnector/common"
+)
+
+func TestDropRetentionPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured []common.RetentionPolicy
+		kept       []string
+	}{
+		{
+			name:       "removed policy",
+			configured: []common.RetentionPolicy{{Name: "raw", Duration: "2h", Default: true}},
+			kept:       []string{"autogen", "foreign", "raw"},
+		},
+		{
+			name: "nothing removed",
+			configured: []common.RetentionPolicy{
+				{Name: "raw", Duration: "2h", Default: true},
+				{Name: "rollup_1m", Duration: "30d"},
+			},
+			kept: []string{"autogen", "foreign", "raw", "rollup_1m"},
+		},
+		{
+			// The default policy is kept even when it is not configured
+			name: "last policies removed",
+			kept: []string{"autogen", "foreign", "raw"},
+		},
+	}
+
+	for _, test := range tests {
+		store := NewMemoryStore()
+		if err := store.EnsureDatabase("datain", "7d"); err != nil {
+			t.Fatal(err)
+		}
+		// A policy created by another client is never dropped
+		if _, err := store.Query(StoreQuery{Command: `CREATE RETENTION POLICY "foreign" ON "datain" DURATION 1d REPLICATION 1`, Database: "datain"}); err != nil {
+			t.Fatal(err)
+		}
+		ledger, _ := loadPolicyLedger("")
+		_, err := createRetentionPolicies(store, "datain", []common.RetentionPolicy{
+			{Name: "raw", Duration: "2h", Default: true},
+			{Name: "rollup_1m", Duration: "30d"},
+		}, ledger)
+		if err != nil {
+			t.Fatalf("%s: createRetentionPolicies failed: %v", test.name, err)
+		}
+
+		existing, err := showRetentionPolicies(store, "datain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dropRetentionPolicies(store, "datain", test.configured, existing, ledger); err != nil {
+			t.Errorf("%s: dropRetentionPolicies failed: %v", test.name, err)
+			continue
+		}
+
+		policies, err := showRetentionPolicies(store, "datain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kept []string
+		for name := range policies {
+			kept = append(kept, name)
+		}
+		sort.Strings(kept)
+		if !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%s: kept %v, expected %v", test.name, kept, test.kept)
+		}
+		// The ledger keeps the created policies which still exist
+		for _, name := range []string{"raw", "rollup_1m"} {
+			if _, exists := policies[name]; ledger.owns("datain", name) != exists {
+				t.Errorf("%s: ledger owns %s = %v, expected %v", test.name, name, !exists, exists)
+			}
+		}
+		if ledger.owns("datain", "foreign") || ledger.owns("datain", "autogen") {
+			t.Errorf("%s: ledger owns a policy not created by the connector", test.name)
+		}
+	}
+}
+
+func TestPolicyLedgerSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "connector", "retention_policies.json")
+
+	ledger, err := loadPolicyLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.add("datain", "raw")
+	ledger.add("datain", "rollup_1m")
+	ledger.remove("datain", "rollup_1m")
+	if err := ledger.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadPolicyLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.owns("datain", "raw") || loaded.owns("datain", "rollup_1m") || loaded.owns("other", "raw") {
+		t.Errorf("loaded ledger %v, expected datain.raw only", loaded.owned)
+	}
+
+	var missing *policyLedger
+	if missing.owns("datain", "raw") {
+		t.Errorf("a nil ledger owns a policy")
+	}
+}
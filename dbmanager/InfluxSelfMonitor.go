@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+	metrics "influxdbconnector/metrics"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// selfMeasurement is the measurement of the operational stats of the
+	// connector, it is not published back from the subscription
+	selfMeasurement = "_connector"
+	// selfRetention is the retention policy of selfMeasurement, it is kept
+	// when the configured retention policies are reconciled
+	selfRetention           = "_connector"
+	defaultSelfInterval     = 10 * time.Second
+	defaultSelfRetention    = "7d"
+	defaultSelfMinRetention = time.Hour
+)
+
+// latencyQuantiles are the write latency percentiles written by field name
+var latencyQuantiles = []struct {
+	field    string
+	quantile float64
+}{
+	{"latency_p50", 0.5},
+	{"latency_p95", 0.95},
+	{"latency_p99", 0.99},
+}
+
+// SelfMonitor structure writes the operational stats of the connector into
+// selfMeasurement every interval. The counters are turned into the count and
+// rate over the last interval.
+type SelfMonitor struct {
+	DbInfo common.DbCredential
+	CnInfo common.AppConfig
+	Config common.SelfMonitoringConfig
+	// Queues report the depth of the queues written along with the stats
+	Queues []common.QueueReporter
+
+	interval time.Duration
+	// policyReady is set once the retention policy exists
+	policyReady bool
+	last        time.Time
+	counters    map[string]float64
+	latency     []uint64
+	mutex       sync.Mutex
+	done        chan struct{}
+}
+
+// Init will validate the self monitoring config
+func (sm *SelfMonitor) Init() error {
+	var err error
+	sm.interval = defaultSelfInterval
+	if sm.Config.Interval != "" {
+		sm.interval, err = time.ParseDuration(sm.Config.Interval)
+		if err != nil || sm.interval < time.Second {
+			return errors.New("invalid self monitoring interval " + sm.Config.Interval)
+		}
+	}
+	if sm.Config.Retention == "" {
+		sm.Config.Retention = defaultSelfRetention
+	}
+	retention, err := common.ParseInfluxDuration(sm.Config.Retention)
+	if err != nil || (retention != 0 && retention < defaultSelfMinRetention) {
+		return errors.New("invalid self monitoring retention " + sm.Config.Retention)
+	}
+
+	// Retention policies are not managed with influxdb2 and the dry run
+	// store, the stats go to the default one
+	sm.policyReady = sm.DbInfo.DryRun || sm.DbInfo.Backend == BackendInfluxDB2
+	sm.counters = make(map[string]float64)
+	sm.done = make(chan struct{})
+	return nil
+}
+
+// Run will write the stats every interval until Stop is called, the first
+// interval only sets the baseline of the counters
+func (sm *SelfMonitor) Run() {
+	sm.mutex.Lock()
+	done := sm.done
+	sm.mutex.Unlock()
+
+	ticker := time.NewTicker(sm.interval)
+	defer ticker.Stop()
+	sm.collect(time.Now())
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			points := sm.collect(now)
+			if err := sm.write(points); err != nil {
+				glog.Errorf("Failed to write the self monitoring stats: %v", err)
+			}
+		}
+	}
+}
+
+// Stop will stop writing the stats
+func (sm *SelfMonitor) Stop() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.done != nil {
+		close(sm.done)
+		sm.done = nil
+	}
+}
+
+// collect will read the metrics and return the points of the interval ending
+// now
+func (sm *SelfMonitor) collect(now time.Time) []Point {
+	elapsed := now.Sub(sm.last).Seconds()
+	first := sm.last.IsZero()
+	sm.last = now
+
+	var points []Point
+	point := func(stat string, tags map[string]string, fields map[string]interface{}) {
+		if first {
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["stat"] = stat
+		points = append(points, Point{
+			Measurement:     selfMeasurement,
+			Tags:            tags,
+			Fields:          fields,
+			Time:            now,
+			RetentionPolicy: selfRetention,
+		})
+	}
+
+	for _, sample := range metrics.MessagesReceived.Samples() {
+		topic := sample.LabelValues[0]
+		received := sm.delta("received:"+topic, sample.Value)
+		point("ingest", map[string]string{"topic": topic}, map[string]interface{}{
+			"messages": int64(received),
+			"rate":     received / elapsed,
+		})
+	}
+
+	published := make(map[string]map[string]interface{})
+	for _, sample := range metrics.Publishes.Samples() {
+		topic, result := sample.LabelValues[0], sample.LabelValues[1]
+		count := sm.delta("publish:"+topic+":"+result, sample.Value)
+		fields, ok := published[topic]
+		if !ok {
+			fields = map[string]interface{}{"published": int64(0), "errors": int64(0), "rate": 0.0}
+			published[topic] = fields
+		}
+		if result == "ok" {
+			fields["published"] = int64(count)
+			fields["rate"] = count / elapsed
+		} else {
+			fields["errors"] = int64(count)
+		}
+	}
+	for topic, fields := range published {
+		point("publish", map[string]string{"topic": topic}, fields)
+	}
+
+	written := sm.delta("written", metrics.PointsWritten.Value())
+	write := map[string]interface{}{
+		"points": int64(written),
+		"rate":   written / elapsed,
+	}
+	for _, kind := range []string{"parse", "client", "write"} {
+		write[kind+"_errors"] = int64(sm.delta("error:"+kind, metrics.WriteErrors.Value(kind)))
+	}
+	latency := metrics.WriteDuration.Counts()
+	interval := make([]uint64, len(latency))
+	for i, count := range latency {
+		interval[i] = count
+		if i < len(sm.latency) {
+			interval[i] -= sm.latency[i]
+		}
+	}
+	sm.latency = latency
+	for _, q := range latencyQuantiles {
+		if value := metrics.WriteDuration.Quantile(q.quantile, interval); !math.IsNaN(value) {
+			write[q.field] = value
+		}
+	}
+	point("write", nil, write)
+
+	point("subscription", nil, map[string]interface{}{
+		"received":  int64(sm.delta("subscription:received", metrics.SubscriptionPoints.Value("received"))),
+		"discarded": int64(sm.delta("subscription:discarded", metrics.SubscriptionPoints.Value("discarded"))),
+	})
+
+	for _, reporter := range sm.Queues {
+		for name, depth := range reporter.QueueDepths() {
+			point("queue", map[string]string{"queue": name}, map[string]interface{}{
+				"depth": int64(depth),
+			})
+		}
+	}
+	return points
+}
+
+// delta will return the increase of the counter since the last interval
+func (sm *SelfMonitor) delta(key string, value float64) float64 {
+	previous := sm.counters[key]
+	sm.counters[key] = value
+	if value < previous {
+		return value
+	}
+	return value - previous
+}
+
+// write will write the points into the self monitoring retention policy,
+// creating it first if needed. They are not counted in the write metrics.
+func (sm *SelfMonitor) write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	store, err := NewTimeSeriesStore(sm.DbInfo, sm.CnInfo.DevMode)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if !sm.policyReady {
+		policy := common.RetentionPolicy{Name: selfRetention, Duration: sm.Config.Retention}
+		_, err = createRetentionPolicies(store, sm.DbInfo.Database, []common.RetentionPolicy{policy}, nil)
+		if err != nil {
+			return err
+		}
+		sm.policyReady = true
+	}
+	if sm.DbInfo.DryRun || sm.DbInfo.Backend == BackendInfluxDB2 {
+		for i := range points {
+			points[i].RetentionPolicy = ""
+		}
+	}
+	return store.WritePoints(sm.DbInfo.Database, points)
+}
+
+// QueueDepths will report the points received from the subscription and
+// not yet published
+func (idbMgr *InfluxDBManager) QueueDepths() map[string]int {
+	idbMgr.mutex.Lock()
+	subCtx := idbMgr.subCtx
+	idbMgr.mutex.Unlock()
+	if subCtx == nil {
+		return nil
+	}
+	backlog, _ := subCtx.backlog()
+	return map[string]int{"subscription_buffer": backlog}
+}
+
+// isSelfPoint will check whether the line protocol line is a point of
+// selfMeasurement
+func isSelfPoint(line string) bool {
+	return strings.HasPrefix(line, selfMeasurement+",") || strings.HasPrefix(line, selfMeasurement+" ")
+}
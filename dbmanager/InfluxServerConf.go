@@ -0,0 +1,233 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+)
+
+// influxConfTemplate is the influxd config, the settings left out keep the
+// influxd defaults
+var influxConfTemplate = template.Must(template.New("influxdb.conf").Parse(`# Generated by InfluxDBConnector from the influxdb_server config, do not edit.
+
+[meta]
+  dir = {{printf "%q" .MetaDir}}
+
+[data]
+  dir = {{printf "%q" .DataDir}}
+  wal-dir = {{printf "%q" .WalDir}}
+{{- if .WalFsyncDelay}}
+  wal-fsync-delay = {{printf "%q" .WalFsyncDelay}}
+{{- end}}
+{{- if .CacheMaxMemorySize}}
+  cache-max-memory-size = {{.CacheMaxMemorySize}}
+{{- end}}
+{{- if .CacheSnapshotMemorySize}}
+  cache-snapshot-memory-size = {{.CacheSnapshotMemorySize}}
+{{- end}}
+{{- if .MaxSeriesPerDatabase}}
+  max-series-per-database = {{.MaxSeriesPerDatabase}}
+{{- end}}
+
+[coordinator]
+{{- if .QueryTimeout}}
+  query-timeout = {{printf "%q" .QueryTimeout}}
+{{- end}}
+
+[http]
+  enabled = true
+  bind-address = {{printf "%q" .BindAddress}}
+  auth-enabled = true
+  pprof-auth-enabled = true
+{{- if .TLS}}
+  https-enabled = true
+  https-certificate = {{printf "%q" .TLSCertificate}}
+  https-private-key = {{printf "%q" .TLSPrivateKey}}
+{{- else}}
+  https-enabled = false
+{{- end}}
+
+[logging]
+  level = {{printf "%q" .LogLevel}}
+
+[subscriber]
+  enabled = true
+  http-timeout = "30s"
+{{- if .TLS}}
+  insecure-skip-verify = false
+  ca-certs = {{printf "%q" .TLSCa}}
+{{- else}}
+  insecure-skip-verify = true
+{{- end}}
+  write-concurrency = 40
+  write-buffer-size = 1000
+`))
+
+// influxConfValues structure is the data of influxConfTemplate
+type influxConfValues struct {
+	MetaDir                 string
+	DataDir                 string
+	WalDir                  string
+	WalFsyncDelay           string
+	CacheMaxMemorySize      string
+	CacheSnapshotMemorySize string
+	MaxSeriesPerDatabase    string
+	QueryTimeout            string
+	BindAddress             string
+	TLS                     bool
+	TLSCertificate          string
+	TLSPrivateKey           string
+	TLSCa                   string
+	LogLevel                string
+}
+
+// RenderInfluxConf will validate the influxdb_server config and render the
+// influxd config file, TLS is enabled outside of dev mode
+func RenderInfluxConf(server common.InfluxServerConfig, dbInfo common.DbCredential, devMode bool) ([]byte, error) {
+	values := influxConfValues{
+		MetaDir:        influxMetaDir,
+		DataDir:        influxDataDir,
+		WalDir:         influxWalDir,
+		BindAddress:    ":" + dbInfo.Port,
+		TLS:            !devMode,
+		TLSCertificate: influxCertPath,
+		TLSPrivateKey:  influxKeyPath,
+		TLSCa:          influxCaPath,
+		LogLevel:       "info",
+	}
+
+	for _, size := range []struct {
+		name  string
+		value string
+		out   *string
+	}{
+		{"cache_max_memory_size", server.CacheMaxMemorySize, &values.CacheMaxMemorySize},
+		{"cache_snapshot_memory_size", server.CacheSnapshotMemorySize, &values.CacheSnapshotMemorySize},
+	} {
+		if size.value == "" {
+			continue
+		}
+		n, err := parseByteSize(size.value)
+		if err != nil || n <= 0 {
+			return nil, errors.New("invalid influxdb_server " + size.name + " " + size.value)
+		}
+		*size.out = strconv.FormatInt(n, 10)
+	}
+
+	for _, duration := range []struct {
+		name  string
+		value string
+		out   *string
+	}{
+		{"wal_fsync_delay", server.WalFsyncDelay, &values.WalFsyncDelay},
+		{"query_timeout", server.QueryTimeout, &values.QueryTimeout},
+	} {
+		if duration.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(duration.value)
+		if err != nil || d < 0 {
+			return nil, errors.New("invalid influxdb_server " + duration.name + " " + duration.value)
+		}
+		*duration.out = duration.value
+	}
+
+	if server.MaxSeriesPerDatabase != nil {
+		if *server.MaxSeriesPerDatabase < 0 {
+			return nil, errors.New("invalid influxdb_server max_series_per_database " +
+				strconv.Itoa(*server.MaxSeriesPerDatabase))
+		}
+		values.MaxSeriesPerDatabase = strconv.Itoa(*server.MaxSeriesPerDatabase)
+	}
+
+	if server.BindAddress != "" {
+		_, port, err := net.SplitHostPort(server.BindAddress)
+		if err != nil {
+			return nil, errors.New("invalid influxdb_server bind_address " + server.BindAddress)
+		}
+		if port != dbInfo.Port {
+			return nil, errors.New("influxdb_server bind_address " + server.BindAddress +
+				" must use the influxdb port " + dbInfo.Port)
+		}
+		values.BindAddress = server.BindAddress
+	}
+
+	if server.TLSCertificate != "" {
+		values.TLSCertificate = server.TLSCertificate
+	}
+	if server.TLSPrivateKey != "" {
+		values.TLSPrivateKey = server.TLSPrivateKey
+	}
+	if server.TLSCa != "" {
+		values.TLSCa = server.TLSCa
+	}
+
+	switch server.LogLevel {
+	case "":
+	case "debug", "info", "warn", "error":
+		values.LogLevel = server.LogLevel
+	default:
+		return nil, errors.New("invalid influxdb_server log_level " + server.LogLevel)
+	}
+
+	var conf bytes.Buffer
+	if err := influxConfTemplate.Execute(&conf, values); err != nil {
+		return nil, err
+	}
+	return conf.Bytes(), nil
+}
+
+// writeInfluxConf will render the influxd config file to influxConfPath
+func writeInfluxConf(server common.InfluxServerConfig, dbInfo common.DbCredential, devMode bool) error {
+	conf, err := RenderInfluxConf(server, dbInfo, devMode)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(influxConfPath), 0750)
+	if err != nil {
+		return err
+	}
+	tmpPath := influxConfPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, conf, 0640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, influxConfPath)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Rendered the influxd config to %s", influxConfPath)
+	return nil
+}
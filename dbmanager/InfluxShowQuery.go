@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	showMeasurements = "measurements"
+	showTagKeys      = "tag keys"
+	showTagValues    = "tag values"
+	showFieldKeys    = "field keys"
+	showSeries       = "series"
+	showCardinality  = "cardinality"
+)
+
+var (
+	// Read only SHOW statements allowed in the query service. The order
+	// matters as the cardinality statements share the prefix of the others.
+	showStatements = []struct {
+		kind      string
+		validator *regexp.Regexp
+	}{
+		{showCardinality, regexp.MustCompile(`^show\s+(series|measurement|tag\s+values|tag\s+key|field\s+key)\s+(exact\s+)?cardinality(\s+.*)?$`)},
+		{showMeasurements, regexp.MustCompile(`^show\s+measurements(\s+.*)?$`)},
+		{showTagKeys, regexp.MustCompile(`^show\s+tag\s+keys(\s+.*)?$`)},
+		{showTagValues, regexp.MustCompile(`^show\s+tag\s+values(\s+.*)?$`)},
+		{showFieldKeys, regexp.MustCompile(`^show\s+field\s+keys(\s+.*)?$`)},
+		{showSeries, regexp.MustCompile(`^show\s+series(\s+.*)?$`)},
+	}
+	// InfluxQL needs no space between ON and a quoted database
+	showOnDatabase = regexp.MustCompile(`(?i)\bon\s*"?([^\s"']+)"?`)
+)
+
+// matchShowStatement will return the kind of the allowed SHOW statement or
+// an empty string if the query is not one of them
+func matchShowStatement(cmdL string) string {
+	cmdL = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(cmdL), ";"))
+	// Comments could hide the database the statement runs on
+	if strings.Contains(cmdL, ";") || strings.Contains(cmdL, "--") || strings.Contains(cmdL, "/*") {
+		return ""
+	}
+	for _, statement := range showStatements {
+		if statement.validator.MatchString(cmdL) {
+			return statement.kind
+		}
+	}
+	return ""
+}
+
+// queryShow will run the SHOW statement on the configured database and
+// return a structured result
+func (iq *InfluxQuery) queryShow(store TimeSeriesStore, command string, kind string) (*types.MsgEnvelope, error) {
+	val := types.NewMsgEnvelope(map[string]interface{}{"Data": ""}, nil)
+
+	for _, db := range showOnDatabase.FindAllStringSubmatch(command, -1) {
+		if db[1] != iq.DbInfo.Database {
+			return val, errors.New("SHOW queries are allowed only on database " + iq.DbInfo.Database)
+		}
+	}
+
+	series, err := iq.showSeries(store, strings.TrimSuffix(strings.TrimSpace(command), ";"))
+	if err != nil {
+		glog.V(1).Infof("Response Error received: %v", err)
+		return val, err
+	}
+
+	output, err := json.Marshal(showResult(kind, series))
+	return types.NewMsgEnvelope(map[string]interface{}{"Data": string(output)}, nil), err
+}
+
+// showResult will convert the series returned by a SHOW statement into a
+// document keyed by measurement
+func showResult(kind string, series []models.Row) map[string]interface{} {
+	switch kind {
+	case showMeasurements:
+		measurements := []string{}
+		for _, row := range series {
+			for _, value := range row.Values {
+				measurements = append(measurements, toString(value[0]))
+			}
+		}
+		return map[string]interface{}{"measurements": measurements}
+	case showTagKeys:
+		tagKeys := make(map[string][]string)
+		for _, row := range series {
+			keys := []string{}
+			for _, value := range row.Values {
+				keys = append(keys, toString(value[0]))
+			}
+			tagKeys[row.Name] = keys
+		}
+		return map[string]interface{}{"tag_keys": tagKeys}
+	case showTagValues:
+		tagValues := make(map[string]map[string][]string)
+		for _, row := range series {
+			if _, ok := tagValues[row.Name]; !ok {
+				tagValues[row.Name] = make(map[string][]string)
+			}
+			for _, value := range row.Values {
+				if len(value) < 2 {
+					continue
+				}
+				key := toString(value[0])
+				tagValues[row.Name][key] = append(tagValues[row.Name][key], toString(value[1]))
+			}
+		}
+		return map[string]interface{}{"tag_values": tagValues}
+	case showFieldKeys:
+		fieldKeys := make(map[string]map[string]string)
+		for _, row := range series {
+			fields := make(map[string]string)
+			for _, value := range row.Values {
+				if len(value) < 2 {
+					continue
+				}
+				fields[toString(value[0])] = toString(value[1])
+			}
+			fieldKeys[row.Name] = fields
+		}
+		return map[string]interface{}{"field_keys": fieldKeys}
+	case showSeries:
+		keys := []string{}
+		for _, row := range series {
+			for _, value := range row.Values {
+				keys = append(keys, toString(value[0]))
+			}
+		}
+		return map[string]interface{}{"series": keys}
+	case showCardinality:
+		var total int64
+		byMeasurement := make(map[string]int64)
+		for _, row := range series {
+			for _, value := range row.Values {
+				if len(value) == 0 {
+					continue
+				}
+				count, err := toInt64(value[len(value)-1])
+				if err != nil {
+					continue
+				}
+				total += count
+				if row.Name != "" {
+					byMeasurement[row.Name] += count
+				}
+			}
+		}
+		return map[string]interface{}{"cardinality": total, "by_measurement": byMeasurement}
+	}
+	return map[string]interface{}{}
+}
+
+func toString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// toInt64 will convert the numeric values decoded from the InfluxDB
+// response to int64
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Int64()
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, errors.New("Not a valid number")
+}
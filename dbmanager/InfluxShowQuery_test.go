@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchShowStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		kind  string
+	}{
+		{query: "show measurements", kind: showMeasurements},
+		{query: "show measurements;", kind: showMeasurements},
+		{query: "show   measurements with measurement =~ /cam.*/", kind: showMeasurements},
+		{query: "show tag keys from cpu", kind: showTagKeys},
+		{query: `show tag values with key = "host"`, kind: showTagValues},
+		{query: "show field keys", kind: showFieldKeys},
+		{query: "show series limit 10", kind: showSeries},
+		{query: "show series cardinality", kind: showCardinality},
+		{query: "show measurement exact cardinality", kind: showCardinality},
+		{query: "show tag values cardinality with key = host", kind: showCardinality},
+		{query: "show databases", kind: ""},
+		{query: "show users", kind: ""},
+		{query: "show retention policies", kind: ""},
+		{query: "show measurements; drop database datain", kind: ""},
+		{query: "show measurements -- on _internal", kind: ""},
+		{query: "show measurements /* on _internal */", kind: ""},
+		{query: "select * from cpu", kind: ""},
+	}
+
+	for _, test := range tests {
+		if kind := matchShowStatement(test.query); kind != test.kind {
+			t.Errorf("matchShowStatement(%q) = %q, expected %q", test.query, kind, test.kind)
+		}
+	}
+}
+
+func TestShowOnDatabase(t *testing.T) {
+	tests := []struct {
+		query     string
+		databases []string
+	}{
+		{query: "SHOW MEASUREMENTS", databases: nil},
+		{query: "SHOW MEASUREMENTS ON datain", databases: []string{"datain"}},
+		{query: `SHOW MEASUREMENTS ON "datain"`, databases: []string{"datain"}},
+		{query: `SHOW MEASUREMENTS ON"_internal"`, databases: []string{"_internal"}},
+		{query: "show tag keys on _internal from cpu", databases: []string{"_internal"}},
+		{query: `SHOW FIELD KEYS ON "Datain"`, databases: []string{"Datain"}},
+		{query: "SHOW TAG VALUES WITH KEY = location", databases: nil},
+	}
+
+	for _, test := range tests {
+		var databases []string
+		for _, match := range showOnDatabase.FindAllStringSubmatch(test.query, -1) {
+			databases = append(databases, match[1])
+		}
+		if !reflect.DeepEqual(databases, test.databases) {
+			t.Errorf("showOnDatabase in %q = %v, expected %v", test.query, databases, test.databases)
+		}
+	}
+}
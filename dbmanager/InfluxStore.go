@@ -0,0 +1,244 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	common "influxdbconnector/common"
+	inflxUtil "influxdbconnector/util/influxdb"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// InfluxStore is the TimeSeriesStore backed by InfluxDB through the v1 client
+type InfluxStore struct {
+	dbInfo   common.DbCredential
+	username string
+	password string
+	devMode  bool
+	client   client.Client
+}
+
+func newInfluxStore(dbInfo common.DbCredential, username string, password string, devMode bool) (*InfluxStore, error) {
+	clientadmin, err := newInfluxClient(dbInfo, username, password, devMode)
+	if err != nil {
+		glog.Errorf("Error creating InfluxDB client: %v", err)
+		return nil, err
+	}
+	return &InfluxStore{dbInfo: dbInfo, username: username, password: password,
+		devMode: devMode, client: clientadmin}, nil
+}
+
+// WritePoints will write the points to the database in one batch per
+// retention policy
+func (is *InfluxStore) WritePoints(database string, points []Point) error {
+	var batches []client.BatchPoints
+	byPolicy := make(map[string]client.BatchPoints)
+	for _, point := range points {
+		bp, ok := byPolicy[point.RetentionPolicy]
+		if !ok {
+			var err error
+			bp, err = client.NewBatchPoints(client.BatchPointsConfig{
+				Database:        database,
+				RetentionPolicy: point.RetentionPolicy,
+				Precision:       "ns",
+			})
+			if err != nil {
+				return err
+			}
+			byPolicy[point.RetentionPolicy] = bp
+			batches = append(batches, bp)
+		}
+		pt, err := client.NewPoint(point.Measurement, point.Tags, point.Fields, point.Time)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+
+	for _, bp := range batches {
+		if err := is.client.Write(bp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query will run the InfluxQL query
+func (is *InfluxStore) Query(q StoreQuery) ([]models.Row, error) {
+	response, err := is.client.Query(client.Query{
+		Command:   q.Command,
+		Database:  q.Database,
+		Precision: q.Precision,
+		Chunked:   q.ChunkSize > 0,
+		ChunkSize: q.ChunkSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+
+	var series []models.Row
+	for _, result := range response.Results {
+		series = append(series, result.Series...)
+	}
+	return series, nil
+}
+
+// QueryChunks will run the InfluxQL query with a chunked response and hand
+// over every chunk as soon as it is decoded, the result set is never held
+// in memory as a whole
+func (is *InfluxStore) QueryChunks(q StoreQuery, each func(series []models.Row) error) error {
+	params := url.Values{}
+	params.Set("q", q.Command)
+	params.Set("db", q.Database)
+	if q.Precision != "" {
+		params.Set("epoch", q.Precision)
+	}
+	params.Set("chunked", "true")
+	if q.ChunkSize > 0 {
+		params.Set("chunk_size", strconv.Itoa(q.ChunkSize))
+	}
+
+	resp, err := is.postQuery(params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	chunks := client.NewChunkedResponse(resp.Body)
+	for {
+		response, err := chunks.NextResponse()
+		if err != nil {
+			return err
+		}
+		if response == nil {
+			break
+		}
+		if response.Error() != nil {
+			return response.Error()
+		}
+
+		var series []models.Row
+		for _, result := range response.Results {
+			series = append(series, result.Series...)
+		}
+		if len(series) == 0 {
+			continue
+		}
+		if err := each(series); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from InfluxDB")
+	}
+	return nil
+}
+
+// postQuery will send the query to the /query endpoint, with the token for
+// InfluxDB 2.x. The client has no timeout as reading a large result set
+// takes longer than a request.
+func (is *InfluxStore) postQuery(params url.Values) (*http.Response, error) {
+	httpClient, baseURL, err := newInfluxHTTPClient(is.dbInfo, is.devMode)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Timeout = 0
+
+	req, err := http.NewRequest("POST", baseURL+"/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if is.dbInfo.Backend == BackendInfluxDB2 {
+		req.Header.Set("Authorization", "Token "+is.dbInfo.Token)
+	} else if is.username != "" {
+		req.SetBasicAuth(is.username, is.password)
+	}
+	return httpClient.Do(req)
+}
+
+// EnsureDatabase will create the database, or the bucket for InfluxDB 2.x
+func (is *InfluxStore) EnsureDatabase(database string, retention string) error {
+	if v2Client, ok := is.client.(*influxV2Client); ok {
+		return v2Client.EnsureBucket(database, retention)
+	}
+
+	response, err := inflxUtil.CreateDatabase(is.client, database, retention)
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+// DropSubscription will drop the named subscription of the database on
+// whichever retention policy it was created
+func (is *InfluxStore) DropSubscription(database string, name string) error {
+	series, err := is.Query(StoreQuery{Command: "SHOW SUBSCRIPTIONS"})
+	if err != nil {
+		return err
+	}
+	for _, row := range series {
+		if row.Name != database {
+			continue
+		}
+		for _, values := range row.Values {
+			record := rowRecord(row, values)
+			if toString(record["name"]) != name {
+				continue
+			}
+			_, err := is.Query(StoreQuery{
+				Command: "DROP SUBSCRIPTION " + quoteIdent(name) + " ON " +
+					quoteIdent(database) + "." + quoteIdent(toString(record["retention_policy"])),
+				Database: database,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateSubscription will create the subscription to the subscription server
+func (is *InfluxStore) CreateSubscription(name string, subInfo common.SubScriptionInfo) error {
+	response, err := inflxUtil.CreateSubscription(is.client, name,
+		subInfo.DbName, subInfo.Host, subInfo.Port, is.devMode)
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+// Close will close the client
+func (is *InfluxStore) Close() error {
+	return is.client.Close()
+}
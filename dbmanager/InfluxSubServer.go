@@ -23,16 +23,21 @@ SOFTWARE.
 package dbmanager
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	common "influxdbconnector/common"
+	metrics "influxdbconnector/metrics"
+	tracing "influxdbconnector/tracing"
 
 	"github.com/golang/glog"
 )
@@ -40,31 +45,72 @@ import (
 // InfluxSubCtx structure
 type InfluxSubCtx struct {
 	SbInfo       common.SubScriptionInfo
-	pData        chan string
+	pData        chan subPoint
 	OutInterface common.OutPutInterface
+	// workerStops has one channel per running worker, closing it stops the
+	// worker once its current point is published
+	workerMutex sync.Mutex
+	workerStops []chan struct{}
+	// running counts the workers until they have returned
+	running sync.WaitGroup
+	server  *http.Server
+}
+
+// subPoint is a body received from the subscription along with its trace
+// context
+type subPoint struct {
+	ctx  context.Context
+	data string
 }
 
 const (
 	maxPointsBuffered = 100
+	drainPollInterval = 50 * time.Millisecond
 	influxCaPath      = "/tmp/influxdb/ssl/ca_certificate.pem"
 	influxCertPath    = "/tmp/influxdb/ssl/influxdb_server_certificate.pem"
 	influxKeyPath     = "/tmp/influxdb/ssl/influxdb_server_key.pem"
 )
 
-func (subCtx *InfluxSubCtx) handlePointData(workerID int) {
+// SetWorkers will start or stop workers to have the given number of workers
+// publishing the points, the buffered points are kept
+func (subCtx *InfluxSubCtx) SetWorkers(worker int) {
+	subCtx.workerMutex.Lock()
+	defer subCtx.workerMutex.Unlock()
+	subCtx.SbInfo.Worker = worker
+	if subCtx.pData == nil {
+		// The workers are started with the server
+		return
+	}
+	for len(subCtx.workerStops) < worker {
+		stop := make(chan struct{})
+		subCtx.workerStops = append(subCtx.workerStops, stop)
+		subCtx.running.Add(1)
+		go subCtx.handlePointData(len(subCtx.workerStops)-1, stop)
+	}
+	for len(subCtx.workerStops) > worker {
+		last := len(subCtx.workerStops) - 1
+		close(subCtx.workerStops[last])
+		subCtx.workerStops = subCtx.workerStops[:last]
+	}
+}
+
+func (subCtx *InfluxSubCtx) handlePointData(workerID int, stop chan struct{}) {
+	defer subCtx.running.Done()
 	glog.Infof("Go routine %v for subscription started", workerID)
 	for {
 		// Wait for data in point data buffer
-		buf := <-subCtx.pData
-
-		if common.Profiling == true {
-			temp := strings.Fields(buf)
-			fields := temp[1] + ",ts_idbconn_pub_queue_exit=" + strconv.FormatInt((time.Now().UnixNano()/1e6), 10)
-			buf = temp[0] + " " + fields + " " + temp[2]
-			//glog.Infof("modified reqBody is %v", buf)
+		var point subPoint
+		select {
+		case point = <-subCtx.pData:
+		case <-stop:
+			glog.Infof("Go routine %v for subscription stopped", workerID)
+			return
 		}
 
-		subCtx.OutInterface.Write([]byte(buf))
+		ctx, span := tracing.Start(point.ctx, "handlePointData", tracing.KindInternal)
+		span.SetAttribute("worker", workerID)
+		subCtx.OutInterface.Write(ctx, []byte(point.data))
+		span.End()
 	}
 }
 
@@ -74,58 +120,68 @@ func (subCtx *InfluxSubCtx) httpHandlerFunc(w http.ResponseWriter, req *http.Req
 	if err != nil {
 		glog.Errorf("Error in reading the data: %v", err)
 	}
-
-	var tsTemp1, tsTemp2 int64
-
-	if common.Profiling == true {
-		temp := strings.Fields(strings.Replace(string(reqBody), "\n", "", -1))
-		tsTemp1 = time.Now().UnixNano() / 1e6
-		fields := temp[1] + ",ts_idbconn_pub_entry=" + strconv.FormatInt(tsTemp1, 10)
-		reqBody = []byte(temp[0] + " " + fields + " " + temp[2])
+	reqBody = dropSelfPoints(reqBody)
+	if len(reqBody) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
+	ctx, span := tracing.Start(context.Background(), "httpHandlerFunc", tracing.KindServer)
+	defer span.End()
+	span.SetAttribute("bytes", len(reqBody))
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8") // normal header
 	w.Header().Set("Strict-Transport-Security", "max-age=1024000; includeSubDomains")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Received a POST request\n"))
 
-	if common.Profiling == true {
-		//glog.Infof("reqBody is %v", string(reqBody))
-		temp := strings.Fields(string(reqBody))
-		tsTemp2 = time.Now().UnixNano() / 1e6
-		diff := tsTemp2 - tsTemp1
-		fields := temp[1] + ",ts_idbconn_pub_queue_entry=" + strconv.FormatInt(tsTemp2, 10)
-		fields += ",ts_idbconn_influx_respose_write=" + strconv.FormatInt(diff, 10)
-		reqBody = []byte(temp[0] + " " + fields + " " + temp[2])
-		//glog.Infof("modified reqBody is %v", string(reqBody))
-	}
-
 	select {
-	case subCtx.pData <- string(reqBody):
+	case subCtx.pData <- subPoint{ctx: ctx, data: string(reqBody)}:
+		metrics.SubscriptionPoints.Inc("received")
 	default:
+		metrics.SubscriptionPoints.Inc("discarded")
+		span.SetError(errors.New("subscription buffer is full, the point is discarded"))
 		glog.Infof("Discarding the point. Stream generation faster than Publish!")
 	}
 }
 
+// dropSelfPoints will remove the points of the self monitoring measurement,
+// they are only kept in InfluxDB
+func dropSelfPoints(body []byte) []byte {
+	if !strings.Contains(string(body), selfMeasurement) {
+		return body
+	}
+	var kept []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" && !isSelfPoint(line) {
+			kept = append(kept, line)
+		}
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
+
 func (subCtx *InfluxSubCtx) startServer(devMode bool) {
 	var dstAddr string
 	var err error
-	if subCtx.SbInfo.Host != "" {
-		dstAddr = subCtx.SbInfo.Host + ":" + subCtx.SbInfo.Port
+	if subCtx.SbInfo.BindHost != "" {
+		dstAddr = subCtx.SbInfo.BindHost + ":" + subCtx.SbInfo.Port
 	} else {
 		dstAddr = ":" + subCtx.SbInfo.Port
 	}
 
 	// Make the channel for handling point data
-	subCtx.pData = make(chan string, maxPointsBuffered)
-	for workerID := 0; workerID < subCtx.SbInfo.Worker; workerID++ {
-		go subCtx.handlePointData(workerID)
-	}
+	subCtx.workerMutex.Lock()
+	subCtx.pData = make(chan subPoint, maxPointsBuffered)
+	worker := subCtx.SbInfo.Worker
+	subCtx.workerMutex.Unlock()
+	subCtx.SetWorkers(worker)
 
 	// Start the HTTP server handler
 	http.HandleFunc("/", subCtx.httpHandlerFunc)
 	if devMode {
-		err = http.ListenAndServe(dstAddr, nil)
+		server := &http.Server{Addr: dstAddr}
+		subCtx.setServer(server)
+		err = server.ListenAndServe()
 	} else {
 
 		serverCert, err := ioutil.ReadFile(influxCertPath)
@@ -174,12 +230,61 @@ func (subCtx *InfluxSubCtx) startServer(devMode bool) {
 			TLSConfig:         tlsConfig,
 			MaxHeaderBytes:    1 << 20,
 		}
+		subCtx.setServer(server)
 		err = server.ListenAndServeTLS(influxCertPath, influxKeyPath)
 
 	}
 
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		glog.Errorf("Error in connection to client due to: %v\n", err)
 		os.Exit(-1)
 	}
 }
+
+func (subCtx *InfluxSubCtx) setServer(server *http.Server) {
+	subCtx.workerMutex.Lock()
+	defer subCtx.workerMutex.Unlock()
+	subCtx.server = server
+}
+
+// drain will stop receiving points from the subscription, let the workers
+// publish the buffered points and stop them. It gives up on the points left
+// at the deadline of ctx.
+func (subCtx *InfluxSubCtx) drain(ctx context.Context) error {
+	subCtx.workerMutex.Lock()
+	server := subCtx.server
+	subCtx.workerMutex.Unlock()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		backlog, _ := subCtx.backlog()
+		if backlog == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			subCtx.SetWorkers(0)
+			return fmt.Errorf("%d points of the subscription are not published", backlog)
+		case <-ticker.C:
+		}
+	}
+
+	subCtx.SetWorkers(0)
+	stopped := make(chan struct{})
+	go func() {
+		subCtx.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	common "influxdbconnector/common"
+	util "influxdbconnector/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	influxdBinary      = "influxd"
+	influxConfPath     = "/tmp/influxdb/influxdb.conf"
+	influxMetaDir      = "/influxdata/influxdb/meta"
+	influxDataDir      = "/influxdata/influxdb/data"
+	influxWalDir       = "/influxdata/influxdb/wal"
+	pingInterval       = 10 * time.Second
+	maxPingFailures    = 3
+	minRestartBackoff  = 1 * time.Second
+	maxRestartBackoff  = 60 * time.Second
+	backoffResetPeriod = 5 * time.Minute
+)
+
+// InfluxSupervisor structure
+type InfluxSupervisor struct {
+	DbInfo common.DbCredential
+	CnInfo common.AppConfig
+	// OnRestart is called once influxd is reachable again after a restart
+	// to re-create the users, database and subscriptions
+	OnRestart func() error
+
+	mutex     sync.Mutex
+	cmd       *exec.Cmd
+	startTime time.Time
+	exited    chan error
+	done      chan struct{}
+	stopped   bool
+}
+
+// influxdLogWriter will forward the output of influxd line by line to glog
+type influxdLogWriter struct {
+	stream string
+	buf    []byte
+}
+
+func (lw *influxdLogWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		idx := bytes.IndexByte(lw.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		glog.Infof("influxd %s: %s", lw.stream, string(lw.buf[:idx]))
+		lw.buf = lw.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// errSupervisorStopped is returned by Start once Stop was called
+var errSupervisorStopped = errors.New("influxd supervisor is stopped")
+
+// Start will launch influxd with the config for the current mode, it refuses
+// once Stop was called so a restart pending in the backoff does not leave an
+// orphaned influxd
+func (sv *InfluxSupervisor) Start() error {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	if sv.stopped {
+		return errSupervisorStopped
+	}
+
+	if sv.exited == nil {
+		sv.exited = make(chan error, 1)
+	}
+
+	cmd := exec.Command(influxdBinary, "-config", influxConfPath)
+	cmd.Stdout = &influxdLogWriter{stream: "stdout"}
+	cmd.Stderr = &influxdLogWriter{stream: "stderr"}
+	if err := cmd.Start(); err != nil {
+		glog.Errorf("Failed to start influxdb Server, Error: %s", err)
+		return err
+	}
+	glog.Infof("Started influxd with pid %d", cmd.Process.Pid)
+
+	done := make(chan struct{})
+	sv.cmd = cmd
+	sv.done = done
+	sv.startTime = time.Now()
+	go func() {
+		err := cmd.Wait()
+		close(done)
+		sv.exited <- err
+	}()
+
+	return nil
+}
+
+// Supervise will restart influxd with backoff whenever it exits or stops
+// responding to /ping, until Stop is called
+func (sv *InfluxSupervisor) Supervise() {
+	backoff := minRestartBackoff
+	failures := 0
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-sv.exited:
+			if sv.isStopped() {
+				return
+			}
+			sv.mutex.Lock()
+			uptime := time.Since(sv.startTime)
+			sv.mutex.Unlock()
+			if uptime > backoffResetPeriod {
+				backoff = minRestartBackoff
+			}
+			glog.Errorf("influxd exited after %v: %v", uptime, err)
+			backoff = sv.restart(backoff)
+			failures = 0
+		case <-ticker.C:
+			if sv.isStopped() {
+				return
+			}
+			if err := sv.Ping(); err != nil {
+				failures++
+				glog.Warningf("influxd ping failed (%d/%d): %v", failures, maxPingFailures, err)
+				if failures >= maxPingFailures {
+					glog.Errorf("influxd is not responding, killing it for restart")
+					sv.signal(syscall.SIGKILL)
+					failures = 0
+				}
+			} else {
+				failures = 0
+			}
+		}
+	}
+}
+
+// restart will start influxd again, retrying with increasing backoff till it
+// is reachable, and returns the backoff to be used for the next restart
+func (sv *InfluxSupervisor) restart(backoff time.Duration) time.Duration {
+	for !sv.isStopped() {
+		glog.Infof("Restarting influxd in %v", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+
+		if err := sv.Start(); err != nil {
+			continue
+		}
+		if !util.CheckPortAvailability(sv.DbInfo.Host, sv.DbInfo.Port) {
+			glog.Errorf("Influx DB port not up after restart")
+			sv.signal(syscall.SIGKILL)
+			<-sv.exited
+			continue
+		}
+		if sv.OnRestart != nil {
+			if err := sv.OnRestart(); err != nil {
+				glog.Errorf("Failed to re-initialize InfluxDB after restart: %v", err)
+			}
+		}
+		glog.Infof("influxd restarted successfully")
+		break
+	}
+	return backoff
+}
+
+// Ping will check whether influxd is responding on the /ping endpoint
+func (sv *InfluxSupervisor) Ping() error {
+	return pingInflux(sv.DbInfo, sv.CnInfo.DevMode)
+}
+
+// Stop will stop supervising and terminate influxd, killing it if it does
+// not exit within the timeout
+func (sv *InfluxSupervisor) Stop(timeout time.Duration) error {
+	sv.mutex.Lock()
+	sv.stopped = true
+	cmd := sv.cmd
+	done := sv.done
+	sv.mutex.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+
+	glog.Infof("Stopping influxd")
+	sv.signal(syscall.SIGTERM)
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		glog.Errorf("influxd did not stop in %v, killing it", timeout)
+		sv.signal(syscall.SIGKILL)
+		return errors.New("influxd did not stop in time")
+	}
+}
+
+func (sv *InfluxSupervisor) signal(sig syscall.Signal) {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	if sv.cmd != nil && sv.cmd.Process != nil {
+		if err := sv.cmd.Process.Signal(sig); err != nil {
+			glog.Errorf("Failed to signal influxd: %v", err)
+		}
+	}
+}
+
+func (sv *InfluxSupervisor) isStopped() bool {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	return sv.stopped
+}
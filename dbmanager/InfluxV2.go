@@ -0,0 +1,319 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	// BackendInfluxDB1 is the InfluxDB 1.x backend using username/password
+	BackendInfluxDB1 = "influxdb1"
+	// BackendInfluxDB2 is the InfluxDB 2.x backend using token authentication
+	BackendInfluxDB2 = "influxdb2"
+)
+
+// influxV2Client implements the v1 client interface on top of the InfluxDB
+// 2.x APIs. Writes to the configured database go to /api/v2/write of the
+// bucket mapped from it, the ones to another database or retention policy
+// and the InfluxQL queries to the /write and /query compatibility endpoints.
+type influxV2Client struct {
+	httpClient *http.Client
+	baseURL    string
+	token      string
+	org        string
+	bucket     string
+	database   string
+}
+
+func newInfluxV2Client(dbInfo common.DbCredential, devMode bool) (*influxV2Client, error) {
+	httpClient, baseURL, err := newInfluxHTTPClient(dbInfo, devMode)
+	if err != nil {
+		return nil, err
+	}
+	return &influxV2Client{
+		httpClient: httpClient,
+		baseURL:    baseURL,
+		token:      dbInfo.Token,
+		org:        dbInfo.Org,
+		bucket:     bucketName(dbInfo),
+		database:   dbInfo.Database,
+	}, nil
+}
+
+// bucketName will return the 2.x bucket the database is mapped to
+func bucketName(dbInfo common.DbCredential) string {
+	if dbInfo.Bucket != "" {
+		return dbInfo.Bucket
+	}
+	return dbInfo.Database
+}
+
+func (c *influxV2Client) do(method string, path string, params url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.httpClient.Do(req)
+}
+
+// doJSON will send the request and decode the JSON response into out
+func (c *influxV2Client) doJSON(method string, path string, params url.Values, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := c.do(method, path, params, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return v2Error(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func v2Error(resp *http.Response) error {
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	var v2Err struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(respBody, &v2Err) == nil {
+		if v2Err.Message != "" {
+			return errors.New(v2Err.Message)
+		}
+		if v2Err.Error != "" {
+			return errors.New(v2Err.Error)
+		}
+	}
+	return errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from InfluxDB")
+}
+
+// Ping will check the /ping endpoint of InfluxDB
+func (c *influxV2Client) Ping(timeout time.Duration) (time.Duration, string, error) {
+	start := time.Now()
+	resp, err := c.do("GET", "/ping", nil, "", nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, "", errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from /ping")
+	}
+	return time.Since(start), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Write will write the points as line protocol to the bucket of their
+// database and retention policy
+func (c *influxV2Client) Write(bp client.BatchPoints) error {
+	var buf bytes.Buffer
+	for _, pt := range bp.Points() {
+		buf.WriteString(pt.PrecisionString(bp.Precision()))
+		buf.WriteByte('\n')
+	}
+
+	// The points of another database or retention policy go to the bucket
+	// of its DBRP mapping, InfluxDB rejects them when there is none
+	path := "/api/v2/write"
+	params := url.Values{}
+	if (bp.Database() == "" || bp.Database() == c.database) && bp.RetentionPolicy() == "" {
+		params.Set("org", c.org)
+		params.Set("bucket", c.bucket)
+	} else {
+		path = "/write"
+		params.Set("db", bp.Database())
+		if bp.RetentionPolicy() != "" {
+			params.Set("rp", bp.RetentionPolicy())
+		}
+	}
+	if bp.Precision() != "" {
+		params.Set("precision", bp.Precision())
+	}
+
+	resp, err := c.do("POST", path, params, "text/plain; charset=utf-8", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return v2Error(resp)
+	}
+	return nil
+}
+
+// Query will run the InfluxQL query on the /query compatibility endpoint
+// which resolves the database through the DBRP mapping
+func (c *influxV2Client) Query(q client.Query) (*client.Response, error) {
+	params := url.Values{}
+	params.Set("q", q.Command)
+	params.Set("db", q.Database)
+	if q.RetentionPolicy != "" {
+		params.Set("rp", q.RetentionPolicy)
+	}
+	if q.Precision != "" {
+		params.Set("epoch", q.Precision)
+	}
+
+	resp, err := c.do("POST", "/query", params, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response client.Response
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&response); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("received status code " + strconv.Itoa(resp.StatusCode) + " from InfluxDB")
+		}
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Close will release the idle connections
+func (c *influxV2Client) Close() error {
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// EnsureBucket will create the bucket with the retention if it is missing
+// and map the database to it for the InfluxQL compatibility endpoint
+func (c *influxV2Client) EnsureBucket(database string, retention string) error {
+	var orgs struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	err := c.doJSON("GET", "/api/v2/orgs", url.Values{"org": {c.org}}, nil, &orgs)
+	if err != nil {
+		return err
+	}
+	if len(orgs.Orgs) == 0 {
+		return errors.New("Organization " + c.org + " not found")
+	}
+	orgID := orgs.Orgs[0].ID
+
+	type bucket struct {
+		ID string `json:"id"`
+	}
+	var buckets struct {
+		Buckets []bucket `json:"buckets"`
+	}
+	err = c.doJSON("GET", "/api/v2/buckets", url.Values{"orgID": {orgID}, "name": {c.bucket}}, nil, &buckets)
+	if err != nil {
+		return err
+	}
+
+	var bucketID string
+	if len(buckets.Buckets) > 0 {
+		bucketID = buckets.Buckets[0].ID
+		glog.Infof("Bucket %s already exists", c.bucket)
+	} else {
+		var everySeconds int64
+		// Zero seconds keeps the data forever like the INF duration
+		if retention != "" {
+			duration, err := common.ParseInfluxDuration(retention)
+			if err != nil {
+				return err
+			}
+			everySeconds = int64(duration.Seconds())
+		}
+		newBucket := map[string]interface{}{
+			"orgID": orgID,
+			"name":  c.bucket,
+			"retentionRules": []map[string]interface{}{
+				{"type": "expire", "everySeconds": everySeconds},
+			},
+		}
+		var created bucket
+		err = c.doJSON("POST", "/api/v2/buckets", nil, newBucket, &created)
+		if err != nil {
+			return err
+		}
+		bucketID = created.ID
+		glog.Infof("Successfully created bucket: %s", c.bucket)
+	}
+
+	var dbrps struct {
+		Content []struct {
+			ID string `json:"id"`
+		} `json:"content"`
+	}
+	err = c.doJSON("GET", "/api/v2/dbrps", url.Values{"orgID": {orgID}, "db": {database}}, nil, &dbrps)
+	if err != nil {
+		return err
+	}
+	if len(dbrps.Content) > 0 {
+		return nil
+	}
+
+	mapping := map[string]interface{}{
+		"orgID":            orgID,
+		"bucketID":         bucketID,
+		"database":         database,
+		"retention_policy": "autogen",
+		"default":          true,
+	}
+	err = c.doJSON("POST", "/api/v2/dbrps", nil, mapping, nil)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Mapped database %s to bucket %s", database, c.bucket)
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	common "influxdbconnector/common"
+)
+
+// ValidateConfig will run the checks done at startup on the influxdb,
+// influxdb_server, backup, export, import, disk_quota and blacklist_query
+// settings without touching InfluxDB, all the problems found are returned
+func ValidateConfig(dbInfo common.DbCredential, server common.InfluxServerConfig,
+	backup *common.BackupConfig, export *common.ExportConfig, imports *common.ImportConfig,
+	diskQuota *common.DiskQuotaConfig, blacklist []string, devMode bool) []string {
+	var problems []string
+	if err := validateSpec(dbInfo); err != nil {
+		problems = append(problems, "influxdb: "+err.Error())
+	}
+	if !dbInfo.External {
+		if _, err := RenderInfluxConf(server, dbInfo, devMode); err != nil {
+			problems = append(problems, "influxdb_server: "+err.Error())
+		}
+	}
+	if backup != nil && backup.Schedule != "" {
+		if _, err := parseCron(backup.Schedule); err != nil {
+			problems = append(problems, "backup.schedule: "+err.Error())
+		}
+	}
+	if export != nil {
+		ie := &InfluxExport{Config: *export}
+		if err := ie.parseConfig(); err != nil {
+			problems = append(problems, "export: "+err.Error())
+		}
+	}
+	if imports != nil {
+		im := &InfluxImport{Config: *imports}
+		if err := im.parseConfig(); err != nil {
+			problems = append(problems, "import: "+err.Error())
+		}
+	}
+	if diskQuota != nil {
+		dm := &InfluxDiskMonitor{Config: *diskQuota}
+		if err := dm.parseConfig(); err != nil {
+			problems = append(problems, "disk_quota: "+err.Error())
+		}
+	}
+	if len(blacklist) > 0 {
+		if _, err := blacklistValidator(blacklist); err != nil {
+			problems = append(problems, "blacklist_query: "+err.Error())
+		}
+	}
+	return problems
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"reflect"
+	"testing"
+
+	common "influxdbconnector/common"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dbInfo := common.DbCredential{Database: "datain", Retention: "7d", External: true}
+	tests := []struct {
+		name      string
+		export    *common.ExportConfig
+		imports   *common.ImportConfig
+		diskQuota *common.DiskQuotaConfig
+		problems  []string
+	}{
+		{name: "not configured"},
+		{
+			name:      "valid",
+			export:    &common.ExportConfig{Window: "1d"},
+			imports:   &common.ImportConfig{PollInterval: "10s"},
+			diskQuota: &common.DiskQuotaConfig{Quota: "20GB", Action: "shorten_retention", MinRetention: "1d"},
+		},
+		{
+			name:      "rejected at startup",
+			export:    &common.ExportConfig{Window: "0s"},
+			imports:   &common.ImportConfig{PollInterval: "soon"},
+			diskQuota: &common.DiskQuotaConfig{Quota: "20GB", MinRetention: "30m"},
+			problems: []string{
+				"export: invalid export window 0s",
+				"import: invalid import poll_interval soon",
+				"disk_quota: invalid disk quota min_retention 30m",
+			},
+		},
+		{
+			name:      "disk quota",
+			diskQuota: &common.DiskQuotaConfig{Quota: "20 apples"},
+			problems:  []string{"disk_quota: invalid disk quota 20 apples"},
+		},
+	}
+
+	for _, test := range tests {
+		problems := ValidateConfig(dbInfo, common.InfluxServerConfig{}, nil, test.export, test.imports,
+			test.diskQuota, nil, true)
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: ValidateConfig = %q, expected %q", test.name, problems, test.problems)
+		}
+	}
+}
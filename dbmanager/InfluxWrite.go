@@ -23,18 +23,19 @@ SOFTWARE.
 package dbmanager
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
 	common "influxdbconnector/common"
-	inflxUtil "influxdbconnector/util/influxdb"
+	metrics "influxdbconnector/metrics"
+	tracing "influxdbconnector/tracing"
 	"github.com/golang/glog"
-	"github.com/influxdata/influxdb/client/v2"
 )
 
 // InfluxWriter structure
@@ -46,9 +47,30 @@ type InfluxWriter struct {
 	DbInfo      common.DbCredential
 	IgnoreList  []string
 	TagList     []string
+	// keysMutex guards IgnoreList and TagList which are swapped on config
+	// changes
+	keysMutex sync.RWMutex
 }
 
-func (ir *InfluxWriter) parseData(msg []byte, topic string) *InfluxWriter {
+// SetKeys will replace the ignore and tag lists used for the next messages
+func (ir *InfluxWriter) SetKeys(ignoreList []string, tagList []string) {
+	ir.keysMutex.Lock()
+	defer ir.keysMutex.Unlock()
+	ir.IgnoreList = ignoreList
+	ir.TagList = tagList
+}
+
+// Keys will return the current ignore and tag lists
+func (ir *InfluxWriter) Keys() ([]string, []string) {
+	ir.keysMutex.RLock()
+	defer ir.keysMutex.RUnlock()
+	return ir.IgnoreList, ir.TagList
+}
+
+func (ir *InfluxWriter) parseData(ctx context.Context, msg []byte, topic string) *InfluxWriter {
+	_, span := tracing.Start(ctx, "parseData", tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("topic", topic)
 	tags := make(map[string]string)
 	field := make(map[string]interface{})
 	data := make(map[string]interface{})
@@ -58,15 +80,13 @@ func (ir *InfluxWriter) parseData(msg []byte, topic string) *InfluxWriter {
 
 	if err != nil {
 		glog.Errorf("Not able to Parse data %s", err.Error())
+		span.SetError(err)
 		return nil
 	}
 
-	if common.Profiling == true {
-		data["tsIdbconnProcEntry"] = strconv.FormatInt((time.Now().UnixNano() / 1e6), 10)
-	}
-
+	_, tagList := ir.Keys()
 	for key, value := range data {
-		for _, tagkey := range ir.TagList {
+		for _, tagkey := range tagList {
 			if key == tagkey {
 				tags[key] = fmt.Sprintf("%v", value)
 				delete(data, key)
@@ -77,6 +97,7 @@ func (ir *InfluxWriter) parseData(msg []byte, topic string) *InfluxWriter {
 	flatjson, err := ir.getflatten(data, "")
 	if err != nil {
 		glog.Errorf("Not able to flatten json %s for:%v", err.Error(), data)
+		span.SetError(err)
 		return nil
 	}
 
@@ -104,7 +125,8 @@ func (ir *InfluxWriter) parseData(msg []byte, topic string) *InfluxWriter {
 func (ir *InfluxWriter) getflatten(nested map[string]interface{}, prefix string) (map[string]interface{}, error) {
 	flatmap := make(map[string]interface{})
 
-	err := flatten(true, flatmap, nested, prefix, ir.IgnoreList)
+	ignoreList, _ := ir.Keys()
+	err := flatten(true, flatmap, nested, prefix, ignoreList)
 	if err != nil {
 		return nil, err
 	}
@@ -236,73 +258,72 @@ func matchkey(ignorelist []string, value string) bool {
 	return false
 }
 
-func (ir *InfluxWriter) insertData(data *InfluxWriter) {
+func (ir *InfluxWriter) insertData(ctx context.Context, data *InfluxWriter) {
+	_, span := tracing.Start(ctx, "insertData", tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("measurement", data.Measurement)
+	span.SetAttribute("database", ir.DbInfo.Database)
 
-	if common.Profiling == true {
-		data.Fields["tsIdbconnHTTPEntry"] = strconv.FormatInt((time.Now().UnixNano() / 1e6), 10)
+	store, err := NewTimeSeriesStore(ir.DbInfo, ir.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("Error creating InfluxDB client: %v", err)
+		metrics.WriteErrors.Inc("client")
+		span.SetError(err)
+		return
 	}
 
-	clientadmin, err := inflxUtil.CreateHTTPClient(ir.DbInfo.Host, ir.DbInfo.Port, ir.DbInfo.Username, ir.DbInfo.Password, ir.CnInfo.DevMode)
-
-	defer clientadmin.Close()
+	defer store.Close()
 
-	if common.Profiling == true {
-		data.Fields["tsIdbconnHTTPClientReady"] = strconv.FormatInt((time.Now().UnixNano() / 1e6), 10)
+	fields := make(map[string]interface{}, len(data.Fields))
+	for key, value := range data.Fields {
+		fields[key] = value
 	}
-
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  ir.DbInfo.Database,
-		Precision: "ns",
-	})
-
-	if err != nil {
-		glog.Errorf("Error in creating batch point %s", err.Error())
+	point := Point{
+		Measurement: data.Measurement,
+		Tags:        data.Tags,
+		Fields:      fields,
+		Time:        time.Now(),
 	}
 
-	pt, err := client.NewPoint(data.Measurement, data.Tags, data.Fields, time.Now())
-	if err != nil {
-		glog.Errorf("point error %s", err.Error())
-		os.Exit(-1)
+	if err := writeBatch(store, ir.DbInfo.Database, []Point{point}); err != nil {
+		glog.Errorf("Write Error %s", err.Error())
+		span.SetError(err)
 	}
+}
 
-	bp.AddPoint(pt)
-
-	if common.Profiling == true {
-		data.Fields["tsIdbconnHTTPBatchpointReady"] = strconv.FormatInt((time.Now().UnixNano() / 1e6), 10)
+// WritePoints will write the batch of points to the database
+func (ir *InfluxWriter) WritePoints(points []Point) error {
+	store, err := NewTimeSeriesStore(ir.DbInfo, ir.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("Error creating InfluxDB client: %v", err)
+		metrics.WriteErrors.Inc("client")
+		return err
 	}
+	defer store.Close()
 
-	if err := clientadmin.Write(bp); err != nil {
-		glog.Errorf("Write Error %s", err.Error())
-	}
+	return writeBatch(store, ir.DbInfo.Database, points)
+}
 
-	if common.Profiling == true {
-		tsIdbconnExit := (time.Now().UnixNano() / 1e6)
-
-		tsIdbconnHTTPEntry, _ := strconv.ParseInt(data.Fields["tsIdbconnHTTPEntry"].(string), 10, 64)
-		tsIdbconnProcEntry, _ := strconv.ParseInt(data.Fields["tsIdbconnProcEntry"].(string), 10, 64)
-		tsIdbconnEntry, _ := strconv.ParseInt(data.Fields["tsIdbconnEntry"].(string), 10, 64)
-		tsIdbconnHTTPClientReady, _ := strconv.ParseInt(data.Fields["tsIdbconnHTTPClientReady"].(string), 10, 64)
-		tsIdbconnHTTPBatchpointReady, _ := strconv.ParseInt(data.Fields["tsIdbconnHTTPBatchpointReady"].(string), 10, 64)
-
-		tmIdbconnHTTPProc := tsIdbconnExit - tsIdbconnHTTPEntry
-		tmIdbconnJSONProc := tsIdbconnProcEntry - tsIdbconnHTTPEntry
-		tmLatencyAtInfluxdbconnector := tsIdbconnExit - tsIdbconnEntry
-		tmHTTPClientCreation := tsIdbconnHTTPClientReady - tsIdbconnHTTPEntry
-		tmBatchpointReady := tsIdbconnHTTPBatchpointReady - tsIdbconnHTTPClientReady
-
-		glog.Infof("======Start=====")
-		glog.Infof("Lattency:%v", tmLatencyAtInfluxdbconnector)
-		glog.Infof("ts_idbconn_http_proc:%v", tmIdbconnHTTPProc)
-		glog.Infof("ts_idbconn_json_proc:%v", tmIdbconnJSONProc)
-		glog.Infof("tmHTTPClientCreation:%v", tmHTTPClientCreation)
-		glog.Infof("tmBatchpointReady:%v", tmBatchpointReady)
-
-		glog.Infof("======End=====")
+// writeBatch will write the points to the store and record the write
+// metrics
+func writeBatch(store TimeSeriesStore, database string, points []Point) error {
+	start := time.Now()
+	err := store.WritePoints(database, points)
+	metrics.WriteDuration.Observe(time.Since(start).Seconds())
+	metrics.WriteBatchSize.Observe(float64(len(points)))
+	if err != nil {
+		metrics.WriteErrors.Inc("write")
+		return err
 	}
-
+	metrics.PointsWritten.Add(float64(len(points)))
+	return nil
 }
 
-func (ir *InfluxWriter) Write(data []byte, topic string) {
-	InfluxRecord := ir.parseData(data, topic)
-	ir.insertData(InfluxRecord)
+func (ir *InfluxWriter) Write(ctx context.Context, data []byte, topic string) {
+	InfluxRecord := ir.parseData(ctx, data, topic)
+	if InfluxRecord == nil {
+		metrics.WriteErrors.Inc("parse")
+		return
+	}
+	ir.insertData(ctx, InfluxRecord)
 }
@@ -0,0 +1,414 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+)
+
+// maxMemoryPoints is the number of points kept per measurement, the oldest
+// ones are dropped beyond it
+const maxMemoryPoints = 10000
+
+var (
+	memorySelect = regexp.MustCompile(`(?i)^\s*select\s+\*\s+from\s+"?([^\s";]+)"?(\s+limit\s+(\d+))?\s*;?\s*$`)
+	memoryShow   = regexp.MustCompile(`(?i)^\s*show\s+(measurements|field\s+keys|tag\s+keys|retention\s+policies)(\s+on\s+"?[^\s"]+"?)?\s*;?\s*$`)
+	memoryPolicy = regexp.MustCompile(`(?i)^\s*(create|alter|drop)\s+retention\s+policy\s+"((?:[^"\\]|\\.)*)"\s+on\s+"(?:[^"\\]|\\.)*"(.*?)\s*;?\s*$`)
+)
+
+// memoryRetention structure is a retention policy of the in-memory store,
+// the durations are formatted like InfluxDB does
+type memoryRetention struct {
+	duration      string
+	shardDuration string
+	replication   int64
+	isDefault     bool
+}
+
+// dryRunStore is shared by the writers and queries in dry run mode
+var dryRunStore = NewMemoryStore()
+
+// MemoryStore is a TimeSeriesStore keeping the points in memory. It supports
+// "SELECT * FROM <measurement> [LIMIT n]", the SHOW statements and the
+// retention policy statements used by the connector, which is enough for
+// unit tests and the dry run mode.
+type MemoryStore struct {
+	mutex         sync.Mutex
+	retention     map[string]map[string]memoryRetention
+	points        map[string]map[string][]Point
+	subscriptions map[string]map[string]common.SubScriptionInfo
+}
+
+// NewMemoryStore will create an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		retention:     make(map[string]map[string]memoryRetention),
+		points:        make(map[string]map[string][]Point),
+		subscriptions: make(map[string]map[string]common.SubScriptionInfo),
+	}
+}
+
+// WritePoints will append the points to their measurements
+func (ms *MemoryStore) WritePoints(database string, points []Point) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	measurements, ok := ms.points[database]
+	if !ok {
+		return errors.New("database not found: " + database)
+	}
+	for _, point := range points {
+		stored := append(measurements[point.Measurement], point)
+		if len(stored) > maxMemoryPoints {
+			stored = stored[len(stored)-maxMemoryPoints:]
+		}
+		measurements[point.Measurement] = stored
+	}
+	glog.V(1).Infof("Dry run: stored %d points in %s", len(points), database)
+	return nil
+}
+
+// Query will run the supported statements on the stored points
+func (ms *MemoryStore) Query(q StoreQuery) ([]models.Row, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	measurements, ok := ms.points[q.Database]
+	if !ok {
+		return nil, errors.New("database not found: " + q.Database)
+	}
+
+	if match := memorySelect.FindStringSubmatch(q.Command); match != nil {
+		points := measurements[match[1]]
+		if match[3] != "" {
+			limit, _ := strconv.Atoi(match[3])
+			if limit < len(points) {
+				points = points[:limit]
+			}
+		}
+		if len(points) == 0 {
+			return nil, nil
+		}
+		return []models.Row{pointsToRow(match[1], points)}, nil
+	}
+
+	if match := memoryPolicy.FindStringSubmatch(q.Command); match != nil {
+		return nil, ms.retentionPolicy(q.Database, strings.ToLower(match[1]), unquoteIdent(match[2]), match[3])
+	}
+
+	match := memoryShow.FindStringSubmatch(q.Command)
+	if match == nil {
+		return nil, errors.New("statement not supported by the in-memory store: " + q.Command)
+	}
+
+	var series []models.Row
+	switch strings.Join(strings.Fields(strings.ToLower(match[1])), " ") {
+	case "measurements":
+		row := models.Row{Name: "measurements", Columns: []string{"name"}}
+		for _, name := range sortedKeys(measurements) {
+			row.Values = append(row.Values, []interface{}{name})
+		}
+		if len(row.Values) > 0 {
+			series = append(series, row)
+		}
+	case "field keys":
+		for _, name := range sortedKeys(measurements) {
+			fields := make(map[string]string)
+			for _, point := range measurements[name] {
+				for key, value := range point.Fields {
+					fields[key] = fieldType(value)
+				}
+			}
+			row := models.Row{Name: name, Columns: []string{"fieldKey", "fieldType"}}
+			for _, key := range sortedStringKeys(fields) {
+				row.Values = append(row.Values, []interface{}{key, fields[key]})
+			}
+			series = append(series, row)
+		}
+	case "tag keys":
+		for _, name := range sortedKeys(measurements) {
+			tags := make(map[string]string)
+			for _, point := range measurements[name] {
+				for key := range point.Tags {
+					tags[key] = key
+				}
+			}
+			row := models.Row{Name: name, Columns: []string{"tagKey"}}
+			for _, key := range sortedStringKeys(tags) {
+				row.Values = append(row.Values, []interface{}{key})
+			}
+			series = append(series, row)
+		}
+	case "retention policies":
+		row := models.Row{Columns: []string{"name", "duration", "shardGroupDuration", "replicaN", "default"}}
+		policies := ms.retention[q.Database]
+		names := make([]string, 0, len(policies))
+		for name := range policies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rp := policies[name]
+			row.Values = append(row.Values, []interface{}{name, rp.duration, rp.shardDuration, rp.replication, rp.isDefault})
+		}
+		series = append(series, row)
+	}
+	return series, nil
+}
+
+// retentionPolicy will run the CREATE, ALTER or DROP RETENTION POLICY
+// statement with its DURATION, REPLICATION, SHARD DURATION and DEFAULT
+// clauses
+func (ms *MemoryStore) retentionPolicy(database string, action string, name string, clauses string) error {
+	policies := ms.retention[database]
+	rp, exists := policies[name]
+	switch {
+	case action == "drop":
+		delete(policies, name)
+		return nil
+	case action == "create" && exists:
+		return errors.New("retention policy already exists")
+	case action == "alter" && !exists:
+		return errors.New("retention policy not found: " + name)
+	case action == "create":
+		rp = memoryRetention{shardDuration: memoryDuration(time.Hour), replication: 1}
+	}
+
+	tokens := strings.Fields(clauses)
+	for i := 0; i < len(tokens); i++ {
+		var value string
+		if i+1 < len(tokens) {
+			value = tokens[i+1]
+		}
+		switch strings.ToLower(tokens[i]) {
+		case "duration":
+			duration, err := common.ParseInfluxDuration(value)
+			if err != nil {
+				return err
+			}
+			rp.duration = memoryDuration(duration)
+			i++
+		case "shard":
+			if i+2 >= len(tokens) || !strings.EqualFold(value, "duration") {
+				return errors.New("invalid retention policy clause " + clauses)
+			}
+			duration, err := common.ParseInfluxDuration(tokens[i+2])
+			if err != nil {
+				return err
+			}
+			rp.shardDuration = memoryDuration(duration)
+			i += 2
+		case "replication":
+			replication, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("invalid replication " + value)
+			}
+			rp.replication = replication
+			i++
+		case "default":
+			for other, policy := range policies {
+				policy.isDefault = false
+				policies[other] = policy
+			}
+			rp.isDefault = true
+		default:
+			return errors.New("invalid retention policy clause " + clauses)
+		}
+	}
+	policies[name] = rp
+	return nil
+}
+
+// memoryDuration will format the duration like SHOW RETENTION POLICIES
+func memoryDuration(duration time.Duration) string {
+	if duration == 0 {
+		return "0s"
+	}
+	return duration.String()
+}
+
+// unquoteIdent will reverse quoteIdent
+func unquoteIdent(name string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(name)
+}
+
+// QueryChunks will run the query and split the series in chunks of
+// ChunkSize rows
+func (ms *MemoryStore) QueryChunks(q StoreQuery, each func(series []models.Row) error) error {
+	series, err := ms.Query(q)
+	if err != nil {
+		return err
+	}
+	for _, row := range series {
+		size := q.ChunkSize
+		if size <= 0 {
+			size = len(row.Values)
+		}
+		for start := 0; start < len(row.Values); start += size {
+			end := start + size
+			if end > len(row.Values) {
+				end = len(row.Values)
+			}
+			chunk := row
+			chunk.Values = row.Values[start:end]
+			if err := each([]models.Row{chunk}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnsureDatabase will create the database if missing
+func (ms *MemoryStore) EnsureDatabase(database string, retention string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.points[database]; !ok {
+		ms.points[database] = make(map[string][]Point)
+		ms.subscriptions[database] = make(map[string]common.SubScriptionInfo)
+		ms.retention[database] = make(map[string]memoryRetention)
+	}
+	var duration time.Duration
+	if retention != "" {
+		var err error
+		if duration, err = common.ParseInfluxDuration(retention); err != nil {
+			return err
+		}
+	}
+	rp := ms.retention[database][defaultRetention]
+	rp.duration = memoryDuration(duration)
+	if rp.replication == 0 {
+		rp.shardDuration = memoryDuration(time.Hour)
+		rp.replication = 1
+		rp.isDefault = true
+	}
+	ms.retention[database][defaultRetention] = rp
+	return nil
+}
+
+// DropSubscription will drop the named subscription of the database
+func (ms *MemoryStore) DropSubscription(database string, name string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.subscriptions[database], name)
+	return nil
+}
+
+// CreateSubscription will only record the subscription, no data is sent to
+// the subscription server
+func (ms *MemoryStore) CreateSubscription(name string, subInfo common.SubScriptionInfo) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	subscriptions, ok := ms.subscriptions[subInfo.DbName]
+	if !ok {
+		return errors.New("database not found: " + subInfo.DbName)
+	}
+	if _, ok := subscriptions[name]; ok {
+		return errors.New("subscription already exists")
+	}
+	subscriptions[name] = subInfo
+	return nil
+}
+
+// Close does nothing as the points are kept for the other users of the store
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// pointsToRow will convert the points to a series with the time, tag and
+// field columns
+func pointsToRow(name string, points []Point) models.Row {
+	keys := make(map[string]string)
+	for _, point := range points {
+		for key := range point.Tags {
+			keys[key] = key
+		}
+		for key := range point.Fields {
+			keys[key] = key
+		}
+	}
+	columns := append([]string{"time"}, sortedStringKeys(keys)...)
+
+	row := models.Row{Name: name, Columns: columns}
+	for _, point := range points {
+		values := []interface{}{point.Time.UnixNano()}
+		for _, column := range columns[1:] {
+			if value, ok := point.Fields[column]; ok {
+				values = append(values, value)
+			} else if value, ok := point.Tags[column]; ok {
+				values = append(values, value)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		row.Values = append(row.Values, values)
+	}
+	return row
+}
+
+func fieldType(value interface{}) string {
+	switch value.(type) {
+	case float32, float64:
+		return "float"
+	case int, int32, int64:
+		return "integer"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func sortedKeys(measurements map[string][]Point) []string {
+	keys := make([]string, 0, len(measurements))
+	for key := range measurements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedStringKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
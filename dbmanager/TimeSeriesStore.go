@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dbmanager
+
+import (
+	"time"
+
+	common "influxdbconnector/common"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Point structure
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+	// RetentionPolicy the point is written into, empty for the default one
+	RetentionPolicy string
+}
+
+// StoreQuery structure
+type StoreQuery struct {
+	Command   string
+	Database  string
+	Precision string
+	// ChunkSize lets the store fetch the result set in chunks, 0 to get it
+	// in one go
+	ChunkSize int
+}
+
+// TimeSeriesStore interface is the storage used by the writers, queries and
+// the database manager
+type TimeSeriesStore interface {
+	// WritePoints will write the points to the database
+	WritePoints(database string, points []Point) error
+	// Query will run the InfluxQL query and return the series of all the
+	// statement results
+	Query(q StoreQuery) ([]models.Row, error)
+	// QueryChunks will run the InfluxQL query in chunks of ChunkSize rows
+	// and call each with the series of every chunk as it is received
+	QueryChunks(q StoreQuery, each func(series []models.Row) error) error
+	// EnsureDatabase will create the database with the retention if missing
+	EnsureDatabase(database string, retention string) error
+	// DropSubscription will drop the named subscription of the database,
+	// the subscriptions of the other consumers are kept
+	DropSubscription(database string, name string) error
+	// CreateSubscription will create the subscription sending the points
+	// written to the database to the subscription server
+	CreateSubscription(name string, subInfo common.SubScriptionInfo) error
+	// Close will release the resources held by the store
+	Close() error
+}
+
+// NewTimeSeriesStore will return the store as per the configuration, the
+// in-memory store in dry run mode and InfluxDB otherwise
+func NewTimeSeriesStore(dbInfo common.DbCredential, devMode bool) (TimeSeriesStore, error) {
+	if dbInfo.DryRun {
+		return dryRunStore, nil
+	}
+	return newInfluxStore(dbInfo, dbInfo.Username, dbInfo.Password, devMode)
+}
@@ -23,9 +23,12 @@ SOFTWARE.
 package dbmanager
 
 import (
+	"context"
 	"errors"
-	"os/exec"
+	"io/ioutil"
 	"strings"
+	"sync"
+	"time"
 
 	common "influxdbconnector/common"
 	util "influxdbconnector/util"
@@ -38,11 +41,28 @@ import (
 type InfluxDBManager struct {
 	CnInfo common.AppConfig
 	DbInfo common.DbCredential
+	// Server is rendered into the influxd config before influxd is started
+	Server     common.InfluxServerConfig
+	supervisor *InfluxSupervisor
+	mutex      sync.Mutex
+	subInfo    *common.SubScriptionInfo
+	subCtx     *InfluxSubCtx
+	// reconcileMutex serializes the reconciliations of the configuration
+	reconcileMutex sync.Mutex
 }
 
 // Init will start the InfluxDb server and create a user
 func (idbMgr *InfluxDBManager) Init() error {
 
+	if idbMgr.DbInfo.DryRun {
+		glog.Infof("Dry run mode, InfluxDB is not started and points are kept in memory")
+		return nil
+	}
+
+	if idbMgr.DbInfo.External {
+		return idbMgr.initExternal()
+	}
+
 	portUp := util.CheckPortOccupied(idbMgr.DbInfo.Host, idbMgr.DbInfo.Port)
 	portupErrmsg := "Influx DB port is already up, Exiting service!!!"
 	portdownErrmsg := "Influx DB port not up"
@@ -51,17 +71,19 @@ func (idbMgr *InfluxDBManager) Init() error {
 		return errors.New(portupErrmsg)
 	}
 
-	var cmd *exec.Cmd
-
-	if idbMgr.CnInfo.DevMode {
-		cmd = exec.Command("./influx_start.sh", "dev_mode")
-	} else {
-		cmd = exec.Command("./influx_start.sh")
+	err := writeInfluxConf(idbMgr.Server, idbMgr.DbInfo, idbMgr.CnInfo.DevMode)
+	if err != nil {
+		glog.Errorf("Failed to render the influxd config: %v", err)
+		return err
 	}
 
-	err := cmd.Run()
+	idbMgr.supervisor = &InfluxSupervisor{
+		DbInfo:    idbMgr.DbInfo,
+		CnInfo:    idbMgr.CnInfo,
+		OnRestart: idbMgr.Reinit,
+	}
+	err = idbMgr.supervisor.Start()
 	if err != nil {
-		glog.Errorf("Failed to start influxdb Server, Error: %s", err)
 		return err
 	}
 
@@ -70,7 +92,33 @@ func (idbMgr *InfluxDBManager) Init() error {
 		glog.Error(portdownErrmsg)
 		return errors.New(portdownErrmsg)
 	}
-	clientAdmin, err := inflxUtil.CreateHTTPClient(idbMgr.DbInfo.Host, idbMgr.DbInfo.Port, "", "", idbMgr.CnInfo.DevMode)
+
+	err = idbMgr.createAdminUser()
+	if err != nil {
+		return err
+	}
+	go idbMgr.supervisor.Supervise()
+
+	return nil
+}
+
+// initExternal will only check that the external InfluxDB is reachable, the
+// process and the admin user are managed outside of the connector
+func (idbMgr *InfluxDBManager) initExternal() error {
+	glog.Infof("Using external InfluxDB at %s:%s", idbMgr.DbInfo.Host, idbMgr.DbInfo.Port)
+	portUp := util.CheckPortAvailability(idbMgr.DbInfo.Host, idbMgr.DbInfo.Port)
+	if !portUp {
+		errMsg := "External Influx DB " + idbMgr.DbInfo.Host + ":" + idbMgr.DbInfo.Port + " not reachable"
+		glog.Error(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// createAdminUser will create the admin user, an existing user is not
+// treated as an error
+func (idbMgr *InfluxDBManager) createAdminUser() error {
+	clientAdmin, err := newInfluxClient(idbMgr.DbInfo, "", "", idbMgr.CnInfo.DevMode)
 	if err != nil {
 		glog.Errorf("Error creating InfluxDB client: %v", err)
 		return err
@@ -91,87 +139,185 @@ func (idbMgr *InfluxDBManager) Init() error {
 	return nil
 }
 
+// Reinit will re-create the admin user, databases, retention policies,
+// continuous queries, users and subscription after influxd has been
+// restarted or a backup restored
+func (idbMgr *InfluxDBManager) Reinit() error {
+	if !idbMgr.DbInfo.External {
+		err := idbMgr.createAdminUser()
+		if err != nil {
+			return err
+		}
+	}
+	err := idbMgr.CreateDataBase(idbMgr.DbInfo.Database, idbMgr.DbInfo.Retention)
+	if err != nil {
+		return err
+	}
+	err = idbMgr.Reconcile()
+	if err != nil {
+		return err
+	}
+
+	idbMgr.mutex.Lock()
+	subInfo := idbMgr.subInfo
+	idbMgr.mutex.Unlock()
+	if subInfo != nil {
+		err = idbMgr.createSubscription(*subInfo)
+	}
+	return err
+}
+
+// DataDirEmpty will check whether influxd has no data yet, it is always
+// true for an external InfluxDB whose data directory is not known
+func (idbMgr *InfluxDBManager) DataDirEmpty() bool {
+	if idbMgr.DbInfo.External {
+		return true
+	}
+	entries, err := ioutil.ReadDir(influxDataDir)
+	return err != nil || len(entries) == 0
+}
+
+// Stop will stop supervising influxd and terminate it within the timeout
+func (idbMgr *InfluxDBManager) Stop(timeout time.Duration) error {
+	if idbMgr.supervisor == nil {
+		return nil
+	}
+	return idbMgr.supervisor.Stop(timeout)
+}
+
 // CreateDataBase will create a database in InfluxDb
 func (idbMgr *InfluxDBManager) CreateDataBase(dbName string, retention string) error {
 	// Create InfluxDB database
-	glog.Infof("Creating InfluxDB database: %s", idbMgr.DbInfo.Database)
-	client, err := inflxUtil.CreateHTTPClient(idbMgr.DbInfo.Host,
-		idbMgr.DbInfo.Port, idbMgr.DbInfo.Username, idbMgr.DbInfo.Password, idbMgr.CnInfo.DevMode)
-
+	glog.Infof("Creating InfluxDB database: %s", dbName)
+	store, err := NewTimeSeriesStore(idbMgr.DbInfo, idbMgr.CnInfo.DevMode)
 	if err != nil {
 		glog.Errorf("Error creating InfluxDB client: %v", err)
 		return err
 	}
-	defer client.Close()
-	response, err := inflxUtil.CreateDatabase(client, dbName, retention)
-	if err != nil {
-		glog.Errorf("Cannot create database: %s", response.Error())
-		return err
-	}
+	defer store.Close()
 
-	if err == nil && response.Error() == nil {
-		glog.Infof("Successfully created database: %s", dbName)
-	} else {
-		if response.Error() != nil {
-			glog.Errorf("Error code: %v, Error Response: %s while creating "+
-				"database: %s", err, response.Error(), dbName)
-		} else {
-			glog.Errorf("Error code: %v while creating "+"database: %s", err, dbName)
-		}
+	err = store.EnsureDatabase(dbName, retention)
+	if err != nil {
+		glog.Errorf("Error: %v while creating database: %s", err, dbName)
 		return err
 	}
 
+	glog.Infof("Successfully created database: %s", dbName)
 	return nil
 }
 
 // Subscribe func subscribes to InfluxDB and starts up the udp server
 func (idbMgr *InfluxDBManager) Subscribe(subInfo common.SubScriptionInfo, out common.OutPutInterface) error {
 
+	if idbMgr.DbInfo.Backend == BackendInfluxDB2 {
+		glog.Warningf("Subscriptions are not supported by %s, points written to InfluxDB will not be published", BackendInfluxDB2)
+		return nil
+	}
+
 	//Setup the subscription for the DB
 	// We have one DB only to be used by DA. Hence adding subscription
 	// only during inititialization.
+	err := idbMgr.createSubscription(subInfo)
+	if err != nil {
+		return err
+	}
+
+	InfluxSC := &InfluxSubCtx{
+		SbInfo:       subInfo,
+		OutInterface: out,
+	}
+
+	idbMgr.mutex.Lock()
+	idbMgr.subInfo = &subInfo
+	idbMgr.subCtx = InfluxSC
+	idbMgr.mutex.Unlock()
+
+	if !idbMgr.DbInfo.DryRun {
+		go InfluxSC.startServer(idbMgr.CnInfo.DevMode)
+	}
+
+	return nil
+}
+
+// StopSubscription will drop the subscription so InfluxDB stops sending the
+// written points, then publish the points already received within the
+// deadline of ctx
+func (idbMgr *InfluxDBManager) StopSubscription(ctx context.Context) error {
+	idbMgr.mutex.Lock()
+	subInfo := idbMgr.subInfo
+	subCtx := idbMgr.subCtx
+	idbMgr.subInfo = nil
+	idbMgr.subCtx = nil
+	idbMgr.mutex.Unlock()
+	if subCtx == nil {
+		return nil
+	}
 
-	client, err := inflxUtil.CreateHTTPClient(idbMgr.DbInfo.Host,
-		idbMgr.DbInfo.Port, idbMgr.DbInfo.Username, idbMgr.DbInfo.Password, idbMgr.CnInfo.DevMode)
+	if !idbMgr.DbInfo.DryRun {
+		store, err := NewTimeSeriesStore(idbMgr.DbInfo, idbMgr.CnInfo.DevMode)
+		if err == nil {
+			err = store.DropSubscription(subInfo.DbName, subInfo.DbName+"Subscription")
+			store.Close()
+		}
+		if err != nil {
+			glog.Errorf("Error: %v while dropping the subscription", err)
+		} else {
+			glog.Infof("Dropped subscription: %sSubscription", subInfo.DbName)
+		}
+	}
 
+	return subCtx.drain(ctx)
+}
+
+// SetPubWorkers will resize the pool of workers publishing the points
+// received from the subscription
+func (idbMgr *InfluxDBManager) SetPubWorkers(worker int) {
+	idbMgr.mutex.Lock()
+	subCtx := idbMgr.subCtx
+	if idbMgr.subInfo != nil {
+		idbMgr.subInfo.Worker = worker
+	}
+	idbMgr.mutex.Unlock()
+
+	if subCtx != nil {
+		subCtx.SetWorkers(worker)
+	}
+}
+
+// createSubscription will replace the subscription of the connector on the
+// database with the one pointing to the subscription server. The other
+// subscriptions are kept as the database may be shared with other consumers.
+func (idbMgr *InfluxDBManager) createSubscription(subInfo common.SubScriptionInfo) error {
+	store, err := NewTimeSeriesStore(idbMgr.DbInfo, idbMgr.CnInfo.DevMode)
 	if err != nil {
 		glog.Errorf("Error creating InfluxDB client: %v", err)
 		return err
 	}
 
-	defer client.Close()
+	defer store.Close()
 
-	response, err := inflxUtil.DropAllSubscriptions(client, idbMgr.DbInfo.Database)
+	subscriptionName := subInfo.DbName + "Subscription"
+	err = store.DropSubscription(subInfo.DbName, subscriptionName)
 	if err != nil {
-		glog.Errorln("Error in dropping subscriptions")
+		glog.Errorf("Error: %v while dropping subscription %s", err, subscriptionName)
 		return err
 	}
 
-	subscriptionName := subInfo.DbName + "Subscription"
-	response, err = inflxUtil.CreateSubscription(client, subscriptionName,
-		subInfo.DbName, subInfo.Host, subInfo.Port, idbMgr.CnInfo.DevMode)
-
-	var InfluxSC InfluxSubCtx
-	InfluxSC.SbInfo = subInfo
-	InfluxSC.OutInterface = out
-
-	if err == nil && response.Error() == nil {
+	err = store.CreateSubscription(subscriptionName, subInfo)
+	if err == nil {
 		glog.Infoln("Successfully created subscription")
-		go InfluxSC.startServer(idbMgr.CnInfo.DevMode)
-	} else if response.Error() != nil {
-		glog.Errorf("Response error: %v while creating subscription", response.Error())
-		const str = "already exists"
-
-		// TODO: we need to handle this situation in a more better way in
-		// future in cases when DataAgent dies abruptly, system reboots etc.,
-		if strings.Contains(response.Error().Error(), str) {
-			glog.Infoln("subscription already exists, let's start the UDP" +
-				" server anyways..")
-			go InfluxSC.startServer(idbMgr.CnInfo.DevMode)
-		}
+		return nil
 	}
 
-	return nil
+	// Another connector may have created it since it was dropped
+	if strings.Contains(err.Error(), "already exists") {
+		glog.Infoln("subscription already exists, let's start the HTTP" +
+			" server anyways..")
+		return nil
+	}
+
+	glog.Errorf("Response error: %v while creating subscription", err)
+	return err
 }
 
 // GetAttribute func will return the measurement name from the data
@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package metrics
+
+// Buckets of the durations in seconds and of the batch sizes in points
+var (
+	latencyBuckets   = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	batchSizeBuckets = []float64{1, 10, 50, 100, 500, 1000, 5000, 10000}
+)
+
+// Metrics of the connector, they are exposed on /metrics
+var (
+	// MessagesReceived counts the messages received per subscribed topic
+	MessagesReceived = NewCounterVec("influxdbconnector_messages_received_total",
+		"Messages received from the message bus per topic.", "topic")
+	// PointsWritten counts the points written to InfluxDB
+	PointsWritten = NewCounterVec("influxdbconnector_points_written_total",
+		"Points written to InfluxDB.")
+	// WriteErrors counts the failed writes by type: parse, client or write
+	WriteErrors = NewCounterVec("influxdbconnector_write_errors_total",
+		"Failed writes to InfluxDB by type.", "type")
+	// WriteDuration is the latency of the writes to InfluxDB
+	WriteDuration = NewHistogramVec("influxdbconnector_write_duration_seconds",
+		"Latency of the writes to InfluxDB.", latencyBuckets)
+	// WriteBatchSize is the number of points per write to InfluxDB
+	WriteBatchSize = NewHistogramVec("influxdbconnector_write_batch_size",
+		"Points per write to InfluxDB.", batchSizeBuckets)
+	// SubscriptionPoints counts the points received from the InfluxDB
+	// subscription, result is received or discarded
+	SubscriptionPoints = NewCounterVec("influxdbconnector_subscription_points_total",
+		"Points received from the InfluxDB subscription by result.", "result")
+	// Publishes counts the messages published per topic, result is ok or
+	// error
+	Publishes = NewCounterVec("influxdbconnector_publishes_total",
+		"Messages published on the message bus per topic and result.", "topic", "result")
+	// Queries counts the requests of the query service per kind and result
+	Queries = NewCounterVec("influxdbconnector_queries_total",
+		"Requests of the query service per kind and result.", "kind", "result")
+	// QueryDuration is the latency of the requests of the query service
+	QueryDuration = NewHistogramVec("influxdbconnector_query_duration_seconds",
+		"Latency of the requests of the query service per kind.", latencyBuckets, "kind")
+	// QueriesRejected counts the queries rejected before reaching InfluxDB
+	QueriesRejected = NewCounterVec("influxdbconnector_queries_rejected_total",
+		"Queries rejected by the query service per reason.", "reason")
+)
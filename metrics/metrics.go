@@ -0,0 +1,310 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelSeparator joins the label values into the key of a series, it
+// cannot be part of a valid UTF-8 label value
+const labelSeparator = "\xff"
+
+// collector is a metric written in the Prometheus text format
+type collector interface {
+	write(out *bytes.Buffer)
+}
+
+// registry holds the metrics in the order of their registration
+var registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+// register will add the metric to the registry, a name can be registered
+// only once
+func register(name string, c collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.names == nil {
+		registry.names = make(map[string]bool)
+	}
+	if registry.names[name] {
+		panic("metric " + name + " is registered more than once")
+	}
+	registry.names[name] = true
+	registry.collectors = append(registry.collectors, c)
+}
+
+// series is the key and the label values of a labelled value
+type series struct {
+	key    string
+	values []string
+}
+
+// CounterVec structure is a counter for each combination of label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	counts map[string]float64
+	series map[string][]string
+}
+
+// NewCounterVec will create and register a counter with the given labels
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		counts: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+	register(name, c)
+	return c
+}
+
+// Inc will increment the counter of the label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add will increment the counter of the label values, negative values are
+// ignored as a counter only goes up
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	key := checkLabels(c.name, c.labels, labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.series[key]; !ok {
+		c.series[key] = labelValues
+	}
+	c.counts[key] += value
+}
+
+func (c *CounterVec) write(out *bytes.Buffer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(out, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		writeSample(out, c.name, nil, nil, "", "", 0)
+	}
+	for _, s := range sortedSeries(c.series) {
+		writeSample(out, c.name, c.labels, s.values, "", "", c.counts[s.key])
+	}
+}
+
+// HistogramVec structure is a histogram for each combination of label
+// values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogram
+	series  map[string][]string
+}
+
+// histogram holds the count of the observations per bucket, the last one
+// being +Inf
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec will create and register a histogram with the given upper
+// bounds of the buckets and labels
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: bounds,
+		values:  make(map[string]*histogram),
+		series:  make(map[string][]string),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe will add the value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := checkLabels(h.name, h.labels, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+		h.series[key] = labelValues
+	}
+	index := sort.SearchFloat64s(h.buckets, value)
+	hist.counts[index]++
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) write(out *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(out, h.name, h.help, "histogram")
+	for _, s := range sortedSeries(h.series) {
+		hist := h.values[s.key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			writeSample(out, h.name+"_bucket", h.labels, s.values, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(out, h.name+"_bucket", h.labels, s.values, "le", "+Inf", float64(hist.count))
+		writeSample(out, h.name+"_sum", h.labels, s.values, "", "", hist.sum)
+		writeSample(out, h.name+"_count", h.labels, s.values, "", "", float64(hist.count))
+	}
+}
+
+// GaugeFunc structure is a gauge whose value is read when the metrics are
+// scraped
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc will create and register a gauge reading its value from the
+// function
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(out *bytes.Buffer) {
+	writeHeader(out, g.name, g.help, "gauge")
+	writeSample(out, g.name, nil, nil, "", "", g.value())
+}
+
+// Handler will return the HTTP handler writing all the registered metrics
+// in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		registry.mutex.Lock()
+		collectors := append([]collector(nil), registry.collectors...)
+		registry.mutex.Unlock()
+
+		var out bytes.Buffer
+		for _, c := range collectors {
+			c.write(&out)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	})
+}
+
+// checkLabels will return the key of the label values, a wrong number of
+// values is a programming error
+func checkLabels(name string, labels []string, values []string) string {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", name, len(labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+// sortedSeries will return the series ordered by their label values
+func sortedSeries(values map[string][]string) []series {
+	sorted := make([]series, 0, len(values))
+	for key, labelValues := range values {
+		sorted = append(sorted, series{key, labelValues})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+	return sorted
+}
+
+func writeHeader(out *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, escape(help, false))
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample will write a sample line, extraLabel is the le label of the
+// histogram buckets
+func writeSample(out *bytes.Buffer, name string, labels []string, values []string,
+	extraLabel string, extraValue string, value float64) {
+	out.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", label, escape(values[i], true))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		out.WriteByte('}')
+	}
+	out.WriteByte(' ')
+	out.WriteString(formatFloat(value))
+	out.WriteByte('\n')
+}
+
+// escape will escape the backslashes and new lines of the help text, and the
+// double quotes of the label values
+func escape(value string, quotes bool) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	if quotes {
+		value = strings.Replace(value, `"`, `\"`, -1)
+	}
+	return value
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
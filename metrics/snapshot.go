@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"math"
+)
+
+// Sample structure is the value of a series of a counter
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Samples will return the value of each series of the counter ordered by
+// their label values
+func (c *CounterVec) Samples() []Sample {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	samples := make([]Sample, 0, len(c.series))
+	for _, s := range sortedSeries(c.series) {
+		samples = append(samples, Sample{LabelValues: s.values, Value: c.counts[s.key]})
+	}
+	return samples
+}
+
+// Value will return the counter of the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := checkLabels(c.name, c.labels, labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[key]
+}
+
+// Counts will return the count of the observations per bucket of the
+// histogram of the label values, the last one being +Inf. It is nil when
+// nothing was observed.
+func (h *HistogramVec) Counts(labelValues ...string) []uint64 {
+	key := checkLabels(h.name, h.labels, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		return nil
+	}
+	return append([]uint64(nil), hist.counts...)
+}
+
+// Quantile will estimate the q quantile of the observations counted per
+// bucket by Counts, interpolating linearly inside the bucket like the
+// histogram_quantile function of Prometheus. The highest bound is returned
+// for the +Inf bucket and NaN when there is no observation.
+func (h *HistogramVec) Quantile(q float64, counts []uint64) float64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 || len(counts) != len(h.buckets)+1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(total)
+	var cumulative uint64
+	for i, count := range counts {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		if i == len(h.buckets) {
+			if i == 0 {
+				return math.NaN()
+			}
+			return h.buckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(count)
+	}
+	// Only reached for q above 1
+	return math.NaN()
+}
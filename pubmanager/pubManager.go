@@ -23,10 +23,14 @@ SOFTWARE.
 package pubmanager
 
 import (
+	"context"
+	"errors"
 	eiimsgbus "github.com/open-edge-insights/eii-messagebus-go/eiimsgbus"
 	common "influxdbconnector/common"
-        "strings"
-        "strconv"
+	metrics "influxdbconnector/metrics"
+	tracing "influxdbconnector/tracing"
+        "sort"
+        "sync"
         "time"
 	"github.com/golang/glog"
 )
@@ -49,17 +53,47 @@ type PubManager struct {
 
 	//This is for filtering the data
 	filter common.Filter
+
+	// Will keep the map of Topic Name to the message bus config of its
+	// client, to detect the changed interfaces
+	configs map[string]map[string]interface{}
+
+	// mutex guards the maps, publishing holds it for reading so that a
+	// publisher is only closed once its in-flight messages are sent
+	mutex sync.RWMutex
+
+	// failures keeps the last publish error of each topic for the health
+	// checks, it has its own mutex as publishing only reads lock mutex
+	failures      map[string]publishFailure
+	failuresMutex sync.Mutex
 }
 
-//Init will initailize the maps
+// publishFailure is the last failed publish of a topic
+type publishFailure struct {
+	err  error
+	time time.Time
+}
+
+// healthWindow is how long a failed publish keeps a publisher degraded
+const healthWindow = time.Minute
+
+//Init will initailize the maps, the health checks may already read them
 func (pubMgr *PubManager) Init() {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
 	pubMgr.clients = make(map[string]*eiimsgbus.MsgbusClient)
 	pubMgr.publishers = make(map[string]*eiimsgbus.Publisher)
+	pubMgr.configs = make(map[string]map[string]interface{})
+	pubMgr.failuresMutex.Lock()
+	pubMgr.failures = make(map[string]publishFailure)
+	pubMgr.failuresMutex.Unlock()
 }
 
 // RegPublisherList function will register the publishers and maintain
 // pubEndPoint
 func (pubMgr *PubManager) RegPublisherList(pubName string) error {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
 
 	pubMgr.pubConfigList = append(pubMgr.pubConfigList, common.PubEndPoint{pubName})
 
@@ -75,6 +109,8 @@ func (pubMgr *PubManager) RegFilter(fltr common.Filter) {
 // RegClientList will register the clients and maintain
 // Clients
 func (pubMgr *PubManager) RegClientList(clientName string) error {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
 
 	pubMgr.clientConfigList = append(pubMgr.clientConfigList, common.Clients{clientName})
 	return nil
@@ -83,17 +119,93 @@ func (pubMgr *PubManager) RegClientList(clientName string) error {
 // CreateClient will create the clients
 func (pubMgr *PubManager) CreateClient(key string, config map[string]interface{}) error {
 
-	var err error
-	pubMgr.clients[key], err = eiimsgbus.NewMsgbusClient(config)
+	client, err := eiimsgbus.NewMsgbusClient(config)
+	if err != nil {
+		glog.Errorf("-- Error creating context: %v\n", err)
+	}
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
+	pubMgr.clients[key] = client
+	pubMgr.configs[key] = config
+	return nil
+}
+
+// Topics will return the message bus config of the registered publishers by
+// topic
+func (pubMgr *PubManager) Topics() map[string]map[string]interface{} {
+	pubMgr.mutex.RLock()
+	defer pubMgr.mutex.RUnlock()
+	topics := make(map[string]map[string]interface{}, len(pubMgr.configs))
+	for topic, config := range pubMgr.configs {
+		topics[topic] = config
+	}
+	return topics
+}
+
+// AddPublisher will create the client and start the publisher of a topic
+// added to the interfaces
+func (pubMgr *PubManager) AddPublisher(topic string, config map[string]interface{}) error {
+	client, err := eiimsgbus.NewMsgbusClient(config)
 	if err != nil {
 		glog.Errorf("-- Error creating context: %v\n", err)
+		return err
+	}
+	publisher, err := client.NewPublisher(topic)
+	if err != nil {
+		glog.Errorf("-- Error creating publisher: %v\n", err)
+		client.Close()
+		return err
 	}
+
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
+	pubMgr.pubConfigList = append(pubMgr.pubConfigList, common.PubEndPoint{topic})
+	pubMgr.clientConfigList = append(pubMgr.clientConfigList, common.Clients{topic})
+	pubMgr.clients[topic] = client
+	pubMgr.publishers[topic] = publisher
+	pubMgr.configs[topic] = config
+	glog.Infof("Publisher topic added : %s", topic)
 	return nil
 }
 
+// RemovePublisher will close the publisher and the client of a topic removed
+// from the interfaces once the messages being published are sent
+func (pubMgr *PubManager) RemovePublisher(topic string) {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
+	if pub, ok := pubMgr.publishers[topic]; ok {
+		pub.Close()
+		delete(pubMgr.publishers, topic)
+	}
+	if client, ok := pubMgr.clients[topic]; ok {
+		client.Close()
+		delete(pubMgr.clients, topic)
+	}
+	delete(pubMgr.configs, topic)
+	pubMgr.failuresMutex.Lock()
+	delete(pubMgr.failures, topic)
+	pubMgr.failuresMutex.Unlock()
+
+	for i, pConfig := range pubMgr.pubConfigList {
+		if pConfig.Name == topic {
+			pubMgr.pubConfigList = append(pubMgr.pubConfigList[:i], pubMgr.pubConfigList[i+1:]...)
+			break
+		}
+	}
+	for i, cConfig := range pubMgr.clientConfigList {
+		if cConfig.Name == topic {
+			pubMgr.clientConfigList = append(pubMgr.clientConfigList[:i], pubMgr.clientConfigList[i+1:]...)
+			break
+		}
+	}
+	glog.Infof("Publisher topic removed : %s", topic)
+}
+
 // StartAllPublishers function will start all the registered endpoints
 // if not started already
 func (pubMgr *PubManager) StartAllPublishers() error {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
 
 	var err error
 	for _, pConfig := range pubMgr.pubConfigList {
@@ -110,38 +222,111 @@ func (pubMgr *PubManager) StartAllPublishers() error {
 	return nil
 }
 
-func (pubMgr *PubManager) Write(data []byte) {
+// Write will publish the point received from the subscription on the topic
+// of its measurement, the envelope carries the trace context of the
+// PubManager.Write span
+func (pubMgr *PubManager) Write(ctx context.Context, data []byte) {
+	ctx, span := tracing.Start(ctx, "PubManager.Write", tracing.KindProducer)
+	defer span.End()
 
 	attribute, err := pubMgr.filter.GetAttribute(data)
 	if err != nil {
 		glog.Errorf("server not responding %s", err.Error())
+		span.SetError(err)
 		return
 	}
+	span.SetAttribute("topic", attribute)
+	pubMgr.mutex.RLock()
+	defer pubMgr.mutex.RUnlock()
 	pub, ok := pubMgr.publishers[attribute]
 
 	if ok {
-                if common.Profiling == true {
-                    temp := strings.Fields(string(data))
-                    fields := temp[1] + ",ts_idbconn_pub_exit=" + strconv.FormatInt((time.Now().UnixNano()/1e6), 10)
-                    data = []byte(temp[0] + " " + fields + " " + temp[2])
-                }
-
 		msg := map[string]interface{}{"data": string(data)}
                 msg["idbconn_pub"] = "true"
+		tracing.Inject(ctx, msg)
 		glog.Infof("Published message: %v", msg)
-		pub.Publish(msg)
+		err = pub.Publish(msg)
+		pubMgr.recordPublish(attribute, err)
+		span.SetError(err)
+	}
+}
+
+// Publish function will publish the message on the publisher registered
+// for the given topic
+func (pubMgr *PubManager) Publish(topic string, msg map[string]interface{}) error {
+	pubMgr.mutex.RLock()
+	defer pubMgr.mutex.RUnlock()
+	pub, ok := pubMgr.publishers[topic]
+	if !ok {
+		return errors.New("No publisher registered for topic: " + topic)
+	}
+
+	err := pub.Publish(msg)
+	pubMgr.recordPublish(topic, err)
+	return err
+}
+
+// recordPublish will count the published message of the topic and keep the
+// error for the health checks
+func (pubMgr *PubManager) recordPublish(topic string, err error) {
+	if err != nil {
+		glog.Errorf("Failed to publish on topic %s: %v", topic, err)
+		metrics.Publishes.Inc(topic, "error")
+		pubMgr.failuresMutex.Lock()
+		pubMgr.failures[topic] = publishFailure{err: err, time: time.Now()}
+		pubMgr.failuresMutex.Unlock()
+		return
+	}
+	metrics.Publishes.Inc(topic, "ok")
+}
+
+// Health will report whether the publisher of each topic was created, a
+// publisher whose last failed publish is within the last minute is degraded.
+// The message bus does not expose the state of its connection.
+func (pubMgr *PubManager) Health() []common.ComponentStatus {
+	pubMgr.mutex.RLock()
+	topics := make([]string, 0, len(pubMgr.configs))
+	created := make(map[string]bool, len(pubMgr.configs))
+	for topic := range pubMgr.configs {
+		topics = append(topics, topic)
+		created[topic] = pubMgr.publishers[topic] != nil
+	}
+	pubMgr.mutex.RUnlock()
+	sort.Strings(topics)
+
+	pubMgr.failuresMutex.Lock()
+	defer pubMgr.failuresMutex.Unlock()
+	statuses := make([]common.ComponentStatus, 0, len(topics))
+	for _, topic := range topics {
+		status := common.ComponentStatus{Name: "publisher:" + topic, Status: common.StatusOK, Detail: "created, no publish error in the last minute"}
+		failure, failed := pubMgr.failures[topic]
+		if !created[topic] {
+			status.Status = common.StatusDown
+			status.Detail = "publisher is not created"
+		} else if failed && time.Since(failure.time) < healthWindow {
+			status.Status = common.StatusDegraded
+			status.Detail = "publish failed in the last minute: " + failure.err.Error()
+		}
+		statuses = append(statuses, status)
 	}
+	return statuses
 }
 
 // StopAllPublisher function will stop all the registered publishers
 func (pubMgr *PubManager) StopAllPublisher() {
-	for _, pub := range pubMgr.publishers {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
+	for topic, pub := range pubMgr.publishers {
 		pub.Close()
+		// The closed publisher is not used by the writes still running
+		delete(pubMgr.publishers, topic)
 	}
 }
 
 // StopAllClient function will stop all the registered clients
 func (pubMgr *PubManager) StopAllClient() {
+	pubMgr.mutex.Lock()
+	defer pubMgr.mutex.Unlock()
 	for _, client := range pubMgr.clients {
 		client.Close()
 	}
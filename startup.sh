@@ -32,4 +32,4 @@ else
     mkdir -p /tmp/influxdb/log
 fi
 
-./InfluxDBConnector
+exec ./InfluxDBConnector
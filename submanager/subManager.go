@@ -24,9 +24,14 @@ package submanager
 
 import (
 	eiimsgbus "github.com/open-edge-insights/eii-messagebus-go/eiimsgbus"
+	types "github.com/open-edge-insights/eii-messagebus-go/pkg/types"
 	common "influxdbconnector/common"
+	metrics "influxdbconnector/metrics"
+	tracing "influxdbconnector/tracing"
+	"context"
 	"encoding/json"
-	"strconv"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -45,17 +50,55 @@ type SubManager struct {
 
 	// Info of registered clients
 	clientConfigList []common.Clients
+
+	// Will keep the map of Topic Name to the message bus config of its
+	// client, to detect the changed interfaces
+	configs map[string]map[string]interface{}
+
+	// Will keep the map of Topic Name to the stop channels of its workers
+	workers map[string][]chan struct{}
+	// Will keep the map of Topic Name to the running workers
+	running map[string]*sync.WaitGroup
+
+	out    common.InsertInterface
+	worker int
+	mutex  sync.Mutex
+
+	// failures keeps the last receive error of each topic for the health
+	// checks, it has its own mutex as the workers report errors while
+	// RemoveSubscriber holds mutex
+	failures      map[string]receiveFailure
+	failuresMutex sync.Mutex
 }
 
-//Init will initailize the maps
+// receiveFailure is the last receive error of a topic
+type receiveFailure struct {
+	err  error
+	time time.Time
+}
+
+// healthWindow is how long a receive error keeps a subscriber degraded
+const healthWindow = time.Minute
+
+//Init will initailize the maps, the health checks may already read them
 func (subMgr *SubManager) Init() {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
 	subMgr.clients = make(map[string]*eiimsgbus.MsgbusClient)
 	subMgr.subscribers = make(map[string]*eiimsgbus.Subscriber)
+	subMgr.configs = make(map[string]map[string]interface{})
+	subMgr.workers = make(map[string][]chan struct{})
+	subMgr.running = make(map[string]*sync.WaitGroup)
+	subMgr.failuresMutex.Lock()
+	subMgr.failures = make(map[string]receiveFailure)
+	subMgr.failuresMutex.Unlock()
 }
 
 // RegSubscriberList function will register the publishers and maintain
 // pubEndPoint
 func (subMgr *SubManager) RegSubscriberList(subName string) error {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
 
 	subMgr.subConfigList = append(subMgr.subConfigList, common.SubEndPoint{subName})
 
@@ -65,6 +108,8 @@ func (subMgr *SubManager) RegSubscriberList(subName string) error {
 // RegClientList will register the clients and maintain
 // pubEndPoint
 func (subMgr *SubManager) RegClientList(clientName string) error {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
 
 	subMgr.clientConfigList = append(subMgr.clientConfigList, common.Clients{clientName})
 	return nil
@@ -73,11 +118,14 @@ func (subMgr *SubManager) RegClientList(clientName string) error {
 // CreateClient will create the clients
 func (subMgr *SubManager) CreateClient(key string, config map[string]interface{}) error {
 
-	var err error
-	subMgr.clients[key], err = eiimsgbus.NewMsgbusClient(config)
+	client, err := eiimsgbus.NewMsgbusClient(config)
 	if err != nil {
 		glog.Errorf("-- Error creating context: %v\n", err)
 	}
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	subMgr.clients[key] = client
+	subMgr.configs[key] = config
 
 	return nil
 }
@@ -85,6 +133,8 @@ func (subMgr *SubManager) CreateClient(key string, config map[string]interface{}
 // StartAllSubscribers function will start all teh registered endpoints
 // if not started already
 func (subMgr *SubManager) StartAllSubscribers() error {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
 
 	for _, pConfig := range subMgr.subConfigList {
 		msgbusclient, ok := subMgr.clients[pConfig.Measurement]
@@ -104,46 +154,280 @@ func (subMgr *SubManager) StartAllSubscribers() error {
 // ReceiveFromAll function will receive data from all the subscriber
 // end points
 func (subMgr *SubManager) ReceiveFromAll(out common.InsertInterface, worker int) {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	subMgr.out = out
+	subMgr.worker = worker
 	glog.Infof("Subscriber available is: %v", subMgr.subscribers)
-	for topic, sub := range subMgr.subscribers {
+	for topic := range subMgr.subscribers {
 		glog.Infof("Subscriber topic is: %s", topic)
-		for workerID := 0; workerID < worker; workerID++ {
-			go processMsg(sub, out, workerID)
+		subMgr.setTopicWorkers(topic, worker)
+	}
+}
+
+// SetWorkers will start or stop workers to have the given number of workers
+// per subscriber, a stopped worker finishes the message it is writing
+func (subMgr *SubManager) SetWorkers(worker int) {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	subMgr.worker = worker
+	for topic := range subMgr.subscribers {
+		subMgr.setTopicWorkers(topic, worker)
+	}
+}
+
+func (subMgr *SubManager) setTopicWorkers(topic string, worker int) {
+	sub := subMgr.subscribers[topic]
+	running, ok := subMgr.running[topic]
+	if !ok {
+		running = &sync.WaitGroup{}
+		subMgr.running[topic] = running
+	}
+	stops := subMgr.workers[topic]
+	for len(stops) < worker {
+		stop := make(chan struct{})
+		stops = append(stops, stop)
+		running.Add(1)
+		go processMsg(sub, subMgr.out, len(stops)-1, stop, running, func(err error) {
+			subMgr.recordFailure(topic, err)
+		})
+	}
+	for len(stops) > worker {
+		close(stops[len(stops)-1])
+		stops = stops[:len(stops)-1]
+	}
+	subMgr.workers[topic] = stops
+}
+
+// Topics will return the message bus config of the registered subscribers by
+// topic
+func (subMgr *SubManager) Topics() map[string]map[string]interface{} {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	topics := make(map[string]map[string]interface{}, len(subMgr.configs))
+	for topic, config := range subMgr.configs {
+		topics[topic] = config
+	}
+	return topics
+}
+
+// AddSubscriber will create the client and the subscriber of a topic added
+// to the interfaces and start its workers
+func (subMgr *SubManager) AddSubscriber(topic string, config map[string]interface{}) error {
+	client, err := eiimsgbus.NewMsgbusClient(config)
+	if err != nil {
+		glog.Errorf("-- Error creating context: %v\n", err)
+		return err
+	}
+	sub, err := client.NewSubscriber(topic)
+	if err != nil {
+		glog.Errorf("-- Error creating Subscribers: %v\n", err)
+		client.Close()
+		return err
+	}
+
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	subMgr.subConfigList = append(subMgr.subConfigList, common.SubEndPoint{topic})
+	subMgr.clientConfigList = append(subMgr.clientConfigList, common.Clients{topic})
+	subMgr.clients[topic] = client
+	subMgr.subscribers[topic] = sub
+	subMgr.configs[topic] = config
+	subMgr.setTopicWorkers(topic, subMgr.worker)
+	glog.Infof("Subscriber topic added : %s", topic)
+	return nil
+}
+
+// RemoveSubscriber will stop the workers of a topic removed from the
+// interfaces, write the messages already received and close the subscriber
+// and its client
+func (subMgr *SubManager) RemoveSubscriber(topic string) {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	sub, ok := subMgr.subscribers[topic]
+	if ok {
+		subMgr.setTopicWorkers(topic, 0)
+		subMgr.running[topic].Wait()
+		drainMsg(sub, subMgr.out)
+		sub.Close()
+		delete(subMgr.subscribers, topic)
+	}
+	delete(subMgr.workers, topic)
+	delete(subMgr.running, topic)
+	if client, ok := subMgr.clients[topic]; ok {
+		client.Close()
+		delete(subMgr.clients, topic)
+	}
+	delete(subMgr.configs, topic)
+	subMgr.failuresMutex.Lock()
+	delete(subMgr.failures, topic)
+	subMgr.failuresMutex.Unlock()
+
+	for i, sConfig := range subMgr.subConfigList {
+		if sConfig.Measurement == topic {
+			subMgr.subConfigList = append(subMgr.subConfigList[:i], subMgr.subConfigList[i+1:]...)
+			break
+		}
+	}
+	for i, cConfig := range subMgr.clientConfigList {
+		if cConfig.Name == topic {
+			subMgr.clientConfigList = append(subMgr.clientConfigList[:i], subMgr.clientConfigList[i+1:]...)
+			break
 		}
 	}
+	glog.Infof("Subscriber topic removed : %s", topic)
 }
 
-func processMsg(sub *eiimsgbus.Subscriber, out common.InsertInterface, workerID int) {
+func processMsg(sub *eiimsgbus.Subscriber, out common.InsertInterface, workerID int, stop chan struct{}, running *sync.WaitGroup, onError func(error)) {
+	defer running.Done()
 	for {
 		select {
 		case msg := <-sub.MessageChannel:
-			if common.Profiling == true {
-				msg.Data["tsIdbconnEntry"] = strconv.FormatInt((time.Now().UnixNano() / 1e6), 10)
-			}
-
-			bytemsg, marshalError := json.Marshal(msg.Data)
-			if marshalError != nil {
-				glog.Errorf("Error while converting data: %v", marshalError)
-				continue;
-			}
-
-			glog.Infof("Subscribe data received from topic: %s in subroutine %v", msg.Name, workerID)
-			out.Write(bytemsg, msg.Name)
+			writeMsg(msg, out, workerID)
 		case err := <-sub.ErrorChannel:
 			glog.Errorf("-- Error receiving message: %v", err)
+			onError(err)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// drainMsg will write the messages left in the channel of the subscriber
+func drainMsg(sub *eiimsgbus.Subscriber, out common.InsertInterface) {
+	for {
+		select {
+		case msg := <-sub.MessageChannel:
+			writeMsg(msg, out, -1)
+		default:
+			return
+		}
+	}
+}
+
+// writeMsg will write the message, the processMsg span continues the trace
+// of the publisher when the envelope carries one. The trace context is not
+// written as a field.
+func writeMsg(msg *types.MsgEnvelope, out common.InsertInterface, workerID int) {
+	metrics.MessagesReceived.Inc(msg.Name)
+	ctx := tracing.Extract(context.Background(), msg.Data)
+	delete(msg.Data, tracing.TraceparentKey)
+	ctx, span := tracing.Start(ctx, "processMsg", tracing.KindConsumer)
+	defer span.End()
+	span.SetAttribute("topic", msg.Name)
+	span.SetAttribute("worker", workerID)
+
+	bytemsg, marshalError := json.Marshal(msg.Data)
+	if marshalError != nil {
+		glog.Errorf("Error while converting data: %v", marshalError)
+		span.SetError(marshalError)
+		return
+	}
+
+	glog.Infof("Subscribe data received from topic: %s in subroutine %v", msg.Name, workerID)
+	out.Write(ctx, bytemsg, msg.Name)
+}
+
+// recordFailure will keep the receive error of the topic for the health
+// checks
+func (subMgr *SubManager) recordFailure(topic string, err error) {
+	subMgr.failuresMutex.Lock()
+	defer subMgr.failuresMutex.Unlock()
+	subMgr.failures[topic] = receiveFailure{err: err, time: time.Now()}
+}
+
+// Health will report whether the subscriber of each topic was created and has
+// workers, a subscriber whose last receive error is within the last minute is
+// degraded. The message bus does not expose the state of its connection.
+func (subMgr *SubManager) Health() []common.ComponentStatus {
+	subMgr.mutex.Lock()
+	topics := make([]string, 0, len(subMgr.configs))
+	workers := make(map[string]int, len(subMgr.configs))
+	created := make(map[string]bool, len(subMgr.configs))
+	for topic := range subMgr.configs {
+		topics = append(topics, topic)
+		workers[topic] = len(subMgr.workers[topic])
+		created[topic] = subMgr.subscribers[topic] != nil
+	}
+	subMgr.mutex.Unlock()
+	sort.Strings(topics)
+
+	subMgr.failuresMutex.Lock()
+	defer subMgr.failuresMutex.Unlock()
+	statuses := make([]common.ComponentStatus, 0, len(topics))
+	for _, topic := range topics {
+		status := common.ComponentStatus{Name: "subscriber:" + topic, Status: common.StatusOK, Detail: "created, no receive error in the last minute"}
+		failure, failed := subMgr.failures[topic]
+		switch {
+		case !created[topic]:
+			status.Status = common.StatusDown
+			status.Detail = "subscriber is not created"
+		case workers[topic] == 0:
+			status.Status = common.StatusDown
+			status.Detail = "no worker is receiving"
+		case failed && time.Since(failure.time) < healthWindow:
+			status.Status = common.StatusDegraded
+			status.Detail = "receive failed in the last minute: " + failure.err.Error()
 		}
+		statuses = append(statuses, status)
 	}
+	return statuses
 }
 
-// StopAllSubscribers function will stop all the registered subscriber
-func (subMgr *SubManager) StopAllSubscribers() {
-	for _, sub := range subMgr.subscribers {
+// QueueDepths will report the messages received and not yet written for
+// each topic
+func (subMgr *SubManager) QueueDepths() map[string]int {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	depths := make(map[string]int, len(subMgr.subscribers))
+	for topic, sub := range subMgr.subscribers {
+		depths["subscriber:"+topic] = len(sub.MessageChannel)
+	}
+	return depths
+}
+
+// StopAllSubscribers function will stop the workers of all the registered
+// subscribers, write the messages already received and close the subscribers.
+// It stops waiting for the workers at the deadline of ctx, the messages left
+// are then not written.
+func (subMgr *SubManager) StopAllSubscribers(ctx context.Context) error {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
+	var stopErr error
+	for topic, sub := range subMgr.subscribers {
+		subMgr.setTopicWorkers(topic, 0)
+		if err := waitWorkers(ctx, subMgr.running[topic]); err != nil {
+			glog.Errorf("Workers of subscriber topic %s not stopped : %v", topic, err)
+			stopErr = err
+		} else if subMgr.out != nil {
+			drainMsg(sub, subMgr.out)
+		}
 		sub.Close()
+		delete(subMgr.subscribers, topic)
+		glog.Infof("Subscriber topic stopped : %s", topic)
+	}
+	return stopErr
+}
+
+// waitWorkers will wait for the workers until the deadline of ctx
+func waitWorkers(ctx context.Context, running *sync.WaitGroup) error {
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // StopAllClient function will stop all the registered client
 func (subMgr *SubManager) StopAllClient() {
+	subMgr.mutex.Lock()
+	defer subMgr.mutex.Unlock()
 	for _, client := range subMgr.clients {
 		client.Close()
 	}
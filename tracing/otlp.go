@@ -0,0 +1,320 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	tracesPath    = "/v1/traces"
+	queueSize     = 2048
+	maxBatch      = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// tracer structure queues the ended spans and exports them in batches to
+// the OTLP/HTTP endpoint of a collector
+type tracer struct {
+	endpoint  string
+	service   string
+	threshold uint64
+	client    *http.Client
+	spans     chan *Span
+	dropped   uint64
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// active is the tracer set by Init, nil while tracing is disabled
+var active struct {
+	sync.RWMutex
+	t *tracer
+}
+
+func activeTracer() *tracer {
+	active.RLock()
+	defer active.RUnlock()
+	return active.t
+}
+
+// Init will start exporting the spans to the collector at endpoint, e.g.
+// http://localhost:4318. sampleRatio is the share of the traces started by
+// the connector which are exported, the traces started upstream follow the
+// sampled flag of their parent.
+func Init(endpoint string, sampleRatio float64, serviceName string) error {
+	target, err := url.Parse(endpoint)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("invalid tracing endpoint " + endpoint)
+	}
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return fmt.Errorf("invalid tracing sample ratio %v", sampleRatio)
+	}
+	if !strings.HasSuffix(target.Path, tracesPath) {
+		target.Path = strings.TrimSuffix(target.Path, "/") + tracesPath
+	}
+
+	t := &tracer{
+		endpoint:  target.String(),
+		service:   serviceName,
+		threshold: uint64(sampleRatio * math.MaxInt64),
+		client:    &http.Client{Timeout: exportTimeout},
+		spans:     make(chan *Span, queueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if sampleRatio >= 1 {
+		t.threshold = math.MaxUint64
+	}
+
+	Shutdown()
+	active.Lock()
+	active.t = t
+	active.Unlock()
+	go t.run()
+	glog.Infof("Exporting the traces to %s", t.endpoint)
+	return nil
+}
+
+// Shutdown will stop tracing and export the queued spans
+func Shutdown() {
+	active.Lock()
+	t := active.t
+	active.t = nil
+	active.Unlock()
+	if t != nil {
+		close(t.done)
+		<-t.stopped
+	}
+}
+
+// sample will decide from the trace id whether a new trace is exported, so
+// all the spans of the trace get the same decision
+func (t *tracer) sample(traceID [16]byte) bool {
+	return t.threshold == math.MaxUint64 || binary.BigEndian.Uint64(traceID[8:])>>1 < t.threshold
+}
+
+// queue will add the span to the next batch, it is dropped when the
+// collector falls behind
+func (t *tracer) queue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatch)
+	flush := func() {
+		if dropped := atomic.SwapUint64(&t.dropped, 0); dropped > 0 {
+			glog.Warningf("Dropped %d spans, the trace queue is full", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			glog.Errorf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) == maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+					if len(batch) == maxBatch {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export will send the spans to the collector in the OTLP/HTTP JSON encoding
+func (t *tracer) export(spans []*Span) error {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector replied %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// OTLP JSON encoding of the export request, the ids are hex encoded and the
+// 64-bit integers are strings
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+// Status codes of OTLP
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+func (t *tracer) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mutex.Lock()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        attributes(span.attributes),
+			Status:            otlpStatus{Code: statusUnset},
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		if span.err != nil {
+			s.Status = otlpStatus{Code: statusError, Message: span.err.Error()}
+		}
+		span.mutex.Unlock()
+		encoded = append(encoded, s)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: attributes(map[string]interface{}{
+			"service.name": t.service,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "influxdbconnector"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+// attributes will encode the attributes as OTLP key values
+func attributes(values map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encoded := make([]otlpAttribute, 0, len(values))
+	for _, key := range keys {
+		value := values[key]
+		var v map[string]interface{}
+		switch typed := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": typed}
+		case bool:
+			v = map[string]interface{}{"boolValue": typed}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(typed)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": typed}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprintf("%v", typed)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: key, Value: v})
+	}
+	return encoded
+}
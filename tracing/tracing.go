@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2021 Intel Corporation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of span as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+	KindProducer = 4
+	KindConsumer = 5
+)
+
+// TraceparentKey is the key of the W3C trace context in the message bus
+// envelopes
+const TraceparentKey = "traceparent"
+
+// SpanContext structure identifies a span of a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid will check that the trace and span ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent will return the span context in the W3C traceparent format
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent will read the span context from the W3C traceparent
+// format, the value is ignored when it is not valid
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// contextKey is the key of the current SpanContext in a context
+type contextKey struct{}
+
+// ContextWithSpanContext will return a copy of ctx carrying the span context,
+// the spans started from it are its children
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFromContext will return the span context carried by ctx
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Extract will return a copy of ctx carrying the span context found in the
+// message, ctx is returned when there is none
+func Extract(ctx context.Context, msg map[string]interface{}) context.Context {
+	value, ok := msg[TraceparentKey].(string)
+	if !ok {
+		return ctx
+	}
+	sc, ok := ParseTraceparent(value)
+	if !ok {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject will add the span context carried by ctx to the message
+func Inject(ctx context.Context, msg map[string]interface{}) {
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		msg[TraceparentKey] = sc.Traceparent()
+	}
+}
+
+// Span structure is a timed operation of a trace
+type Span struct {
+	name       string
+	kind       int
+	context    SpanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	mutex      sync.Mutex
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+// Start will start a span, child of the span context carried by ctx if any.
+// The returned context carries the new span. The span is nil when tracing is
+// disabled, the methods of a nil span do nothing.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := activeTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parentID = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sample(span.context.TraceID)
+	}
+	rand.Read(span.context.SpanID[:])
+	return ContextWithSpanContext(ctx, span.context), span
+}
+
+// SetAttribute will set an attribute of the span, the value is a string, a
+// bool, an integer or a float
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError will mark the span as failed with the error, nil is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+// End will end the span and queue it for the export when it is sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	if t := activeTracer(); t != nil && s.context.Sampled {
+		t.queue(s)
+	}
+}